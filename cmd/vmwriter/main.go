@@ -11,9 +11,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -22,6 +26,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	vmdiscovery "github.dev.pages/infrastructure/vmwriter/internal/discovery"
 	vmhandlers "github.dev.pages/infrastructure/vmwriter/internal/handlers"
 	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
 	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
@@ -32,29 +37,12 @@ const receiver = "receiver"
 
 func main() {
 
-	var wait time.Duration
-
-	var config utility.VConfig
-
-	// Command flags
-	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
-	awsRegion := flag.String("region", "us-west-2", "sets regions to look for instances")
-	awsSearchTag := flag.String("clustertag", "Cluster", "Tag to look for when looking the metrics cluster.  Default - Cluster")
-	awsSearchTagValue := flag.String("clustertagvalue", "victoriametrix", "Value to search for when selecting the metrics cluster. Default - victoriametrix")
-	awsURITag := flag.String("clusteruritag", "ClusterVMURI", "Tag to set for upstream URI. Default - api/v1/write")
-	awsPortTag := flag.String("clusterporttag", "ClusterVMPort", "Tag to search for upstream port. Default - 8428")
-	httpTimeOut := flag.Int("httptimeout", 3, "Sets the http client timeout. Default 3 seconds")
-	debug := flag.Bool("debug", false, "sets log level to debug")
+	// Command flags, the configuration file is read first and any flag given
+	// on the command line overrides the value from the file
+	config := utility.DefaultConfig()
+	flags := registerFlags(flag.CommandLine, &config)
 	flag.Parse()
 
-	// Load the configuration object
-	config.AWSRegion = *awsRegion
-	config.AWSSearchTag = *awsSearchTag
-	config.AWSSearchTagValue = *awsSearchTagValue
-	config.AWSURITag = *awsURITag
-	config.AWSPortTag = *awsPortTag
-	config.HTTPTimeOut = *httpTimeOut
-
 	// Set the http client timeout to prevent lingering connections and exhaustion of our http thread pool!
 	// SEE: https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
 
@@ -65,27 +53,61 @@ func main() {
 
 	// Default level for this example is info, unless debug flag is present
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if *debug {
+	if *flags.debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
 
-	// Test that we can talk to AWS and we can find some nodes
-	instances, err := utility.GetAWSInstancesByTag(&config)
+	config, err := loadConfig(*flags.configFile, os.Args[1:])
 	if err != nil {
-		log.Error().Err(err).Msg("Quiting, could not get AWS instances")
-		os.Exit(0)
+		log.Error().Err(err).Msg("Quiting, invalid configuration")
+		os.Exit(1)
 	}
+	setOwnZone(&config)
 
-	if len(instances) == 0 {
-		log.Error().Msg("Could not find any instances for upstreams.  Did you set up your tags for the cluster correctly?")
-		os.Exit(0)
+	// Discovery runs once here, writes are refused until upstreams show up but the
+	// next discovery poll may well find them so only a failing discovery is fatal
+	vmUpstreams, err := startUpstreams(&config)
+	if err != nil {
+		log.Error().Err(err).Msg("Quiting, could not discover upstreams")
+		os.Exit(1)
 	}
 
-	var vmUpstreams vmupstreams.VMUpstreams
-	vmUpstreams.VMUpstreamsInitialize(&config)
+	// Named pools the routing rules send series to, each with its own discovery
+	pools := make(map[string]*vmupstreams.VMUpstreams)
+	allPools := []*vmupstreams.VMUpstreams{vmUpstreams}
+	for _, p := range config.Pools {
+		poolConfig, _ := config.PoolConfig(p.Name)
+		d, err := vmdiscovery.FromConfig(&poolConfig)
+		if err != nil {
+			log.Error().Err(err).Msgf("Quiting, invalid discovery configuration for pool %s", p.Name)
+			os.Exit(1)
+		}
+		pool := &vmupstreams.VMUpstreams{Name: p.Name}
+		pool.SetDiscoverer(d)
+		if err := pool.VMUpstreamsInitialize(&poolConfig); err != nil {
+			log.Error().Err(err).Msgf("Could not discover upstreams for pool %s, retrying on the next poll", p.Name)
+		}
+		pools[p.Name] = pool
+		allPools = append(allPools, pool)
+	}
 
 	// Set up our handlers
-	pctx := vmhandlers.PCTXHandlerContext(&vmUpstreams, &config)
+	pctx := vmhandlers.PCTXHandlerContext(vmUpstreams, &config)
+	pctx.SetPools(pools)
+	pctx.SetConfigLoader(func() (utility.VConfig, error) {
+		c, err := loadConfig(*flags.configFile, os.Args[1:])
+		if err == nil {
+			setOwnZone(&c)
+		}
+		return c, err
+	})
+
+	if config.QueueDir != "" {
+		if err := pctx.EnableRetryQueue(config.QueueDir, config.QueueMaxBytes); err != nil {
+			log.Error().Err(err).Msgf("Quiting, could not open retry queues in %s", config.QueueDir)
+			os.Exit(1)
+		}
+	}
 
 	r := mux.NewRouter()
 
@@ -98,6 +120,26 @@ func main() {
 		http.HandlerFunc(
 			pctx.HomeHandler)).Methods("GET")
 
+	// Configuration reload, the admin routes need the credentials of an admin client
+	r.Handle(
+		"/-/reload",
+		pctx.AdminHandler(http.HandlerFunc(
+			pctx.ReloadHandler))).Methods("POST")
+
+	// Upstream maintenance
+	r.Handle(
+		"/admin/upstreams/{host}/drain",
+		pctx.AdminHandler(http.HandlerFunc(
+			pctx.DrainHandler))).Methods("POST")
+	r.Handle(
+		"/admin/upstreams/{host}/drain",
+		pctx.AdminHandler(http.HandlerFunc(
+			pctx.UndrainHandler))).Methods("DELETE")
+	r.Handle(
+		"/admin/upstreams/{host}/drain",
+		pctx.AdminHandler(http.HandlerFunc(
+			pctx.DrainStatusHandler))).Methods("GET")
+
 	// Prometheus Metrics
 	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
@@ -107,12 +149,18 @@ func main() {
 		http.HandlerFunc(
 			pctx.PromHandler))
 
+	// Same API for a VictoriaMetrics cluster tenant
+	r.Handle(
+		"/insert/{tenant}/prometheus/api/v1/write",
+		http.HandlerFunc(
+			pctx.PromHandler))
+
 	srv := &http.Server{
 		Handler: r,
-		Addr:    "0.0.0.0:5000",
+		Addr:    config.ListenAddress,
 		// Good practice: enforce timeouts for servers you create!
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		WriteTimeout: time.Duration(config.ServerWriteTimeoutSeconds) * time.Second,
+		ReadTimeout:  time.Duration(config.ServerReadTimeoutSeconds) * time.Second,
 	}
 
 	// Run our server in a goroutine so that it doesn't block.
@@ -122,23 +170,40 @@ func main() {
 		}
 	}()
 
-	// Monitoring thread for changes in AWS
-	go func() {
-		if err := vmUpstreams.AWSServiceWorker(); err != nil {
-			log.Error().Err(err).Str("service", receiver).Msg("Failed to create AWS Service Worker")
+	for _, pool := range allPools {
+		pool := pool
+
+		// Monitoring thread for changes in AWS
+		go func() {
+			if err := pool.AWSServiceWorker(); err != nil {
+				log.Error().Err(err).Str("service", receiver).Msg("Failed to create AWS Service Worker")
+			}
+		}()
+
+		// Health checks for the upstreams
+		if config.ServicePollingSeconds > 0 {
+			go func() {
+				if err := pool.HealthServiceWorker(); err != nil {
+					log.Error().Err(err).Str("service", receiver).Msg("Failed to create Health Service Worker")
+				}
+			}()
 		}
-	}()
+	}
 
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
 	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// SIGHUP reloads the configuration file.
+	signal.Notify(c, os.Interrupt, syscall.SIGHUP)
 
 	// Block until we receive our signal.
-	<-c
+	for sig := <-c; sig == syscall.SIGHUP; sig = <-c {
+		log.Info().Msg("Received SIGHUP, reloading configuration")
+		pctx.Reload()
+	}
 
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.GracefulShutdownSeconds)*time.Second)
 	defer cancel()
 
 	// Doesn't block if no connections, but will otherwise wait
@@ -152,3 +217,169 @@ func main() {
 	os.Exit(0)
 
 }
+
+// startUpstreams sets up discovery of the default pool and loads its upstreams
+func startUpstreams(config *utility.VConfig) (*vmupstreams.VMUpstreams, error) {
+	discoverer, err := vmdiscovery.FromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var vmUpstreams vmupstreams.VMUpstreams
+	vmUpstreams.SetDiscoverer(discoverer)
+	if err := vmUpstreams.VMUpstreamsInitialize(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", discoverer.Name(), err)
+	}
+
+	if list, _ := vmUpstreams.UpstreamList(); len(list) == 0 {
+		log.Warn().Msg("Could not find any upstreams.  Did you set up your tags for the cluster or your upstream files correctly?")
+	}
+	return &vmUpstreams, nil
+}
+
+// cmdFlags flags that are not part of the configuration
+type cmdFlags struct {
+	configFile *string
+	debug      *bool
+}
+
+// registerFlags registers the command flags, configuration flags write straight into config
+func registerFlags(fs *flag.FlagSet, config *utility.VConfig) cmdFlags {
+	var flags cmdFlags
+
+	flags.configFile = fs.String("config.file", "", "Path to the YAML configuration file, flags override values from the file")
+	flags.debug = fs.Bool("debug", false, "sets log level to debug")
+
+	fs.Var(secondsValue{&config.GracefulShutdownSeconds}, "graceful-timeout", "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
+	fs.StringVar(&config.ListenAddress, "listen", config.ListenAddress, "Address to accept remote writes on. Default - 0.0.0.0:5000")
+	fs.BoolVar(&config.AWSDiscoveryEnabled, "ec2discovery", config.AWSDiscoveryEnabled, "Discover upstreams from EC2 instances with the cluster tag. Default false")
+	fs.StringVar(&config.AWSRegion, "region", config.AWSRegion, "sets regions to look for instances")
+	fs.StringVar(&config.AWSAutoScalingGroup, "asg", config.AWSAutoScalingGroup, "Use the in service, healthy instances of this auto scaling group instead of the cluster tag. Default - none")
+	fs.Var(listValue{&config.AWSRegions}, "regions", "Comma separated regions to look for instances in, overrides -region. Default - none")
+	fs.Var(listValue{&config.AWSRoleARNs}, "rolearns", "Comma separated roles to assume to look for instances in other accounts. Default - none")
+	fs.StringVar(&config.AWSEndpoint, "awsendpoint", config.AWSEndpoint, "URL of an EC2 compatible API to use instead of AWS, e.g. a local stand-in. Default - none")
+	fs.StringVar(&config.AWSAddressType, "addresstype", config.AWSAddressType, "Address used to reach instances, private, public or ipv6. Default - private")
+	fs.StringVar(&config.AWSSearchTag, "clustertag", config.AWSSearchTag, "Tag to look for when looking the metrics cluster.  Default - Cluster")
+	fs.StringVar(&config.AWSSearchTagValue, "clustertagvalue", config.AWSSearchTagValue, "Value to search for when selecting the metrics cluster. Default - victoriametrix")
+	fs.StringVar(&config.AWSURITag, "clusteruritag", config.AWSURITag, "Tag to set for upstream URI. Default - api/v1/write")
+	fs.StringVar(&config.AWSPortTag, "clusterporttag", config.AWSPortTag, "Tag to search for upstream port. Default - 8428")
+	fs.StringVar(&config.AWSWeightTag, "clusterweighttag", config.AWSWeightTag, "Tag to search for upstream weight. Default - 1")
+	fs.StringVar(&config.AWSDrainTag, "clusterdraintag", config.AWSDrainTag, "Tag that drains the upstream when true")
+	fs.Var(listValue{&config.FileSDFiles}, "filesd", "Comma separated files or globs listing upstreams in the Prometheus file_sd format. Default - none")
+	fs.StringVar(&config.ConsulAddress, "consuladdress", config.ConsulAddress, "Address of the Consul agent. Default - http://127.0.0.1:8500")
+	fs.StringVar(&config.ConsulService, "consulservice", config.ConsulService, "Consul service whose passing instances are upstreams. Default - none")
+	fs.StringVar(&config.ConsulTag, "consultag", config.ConsulTag, "Only use Consul instances with this tag. Default - none")
+	fs.StringVar(&config.KubeSelector, "kubeselector", config.KubeSelector, "Label selector of the Kubernetes services whose ready endpoints are upstreams. Default - none")
+	fs.StringVar(&config.KubeNamespace, "kubenamespace", config.KubeNamespace, "Namespace of the Kubernetes services. Default - all namespaces")
+	fs.Var(listValue{&config.DNSNames}, "dnssd", "Comma separated DNS names to resolve for upstreams. Default - none")
+	fs.StringVar(&config.DNSType, "dnstype", config.DNSType, "DNS record type looked up for upstreams, SRV, A or AAAA. Default - SRV")
+	fs.IntVar(&config.DNSPort, "dnsport", config.DNSPort, "Port of the upstreams found in A or AAAA records")
+	fs.IntVar(&config.AWSPollingIntervalSeconds, "awspolling", config.AWSPollingIntervalSeconds, "How often AWS is polled for upstream changes in seconds. Default 30")
+	fs.IntVar(&config.HTTPTimeOut, "httptimeout", config.HTTPTimeOut, "Sets the http client timeout. Default 3 seconds")
+	fs.IntVar(&config.ServicePollingSeconds, "servicepolling", config.ServicePollingSeconds, "How often upstreams are health checked in seconds, 0 disables health checks. Default 10")
+	fs.StringVar(&config.HealthCheckPath, "healthpath", config.HealthCheckPath, "Path probed on each upstream to check it is healthy. Default - /health")
+	fs.IntVar(&config.HealthRise, "healthrise", config.HealthRise, "Consecutive passing health checks before an upstream is marked up. Default 2")
+	fs.IntVar(&config.HealthFall, "healthfall", config.HealthFall, "Consecutive failing health checks before an upstream is marked down. Default 3")
+	fs.IntVar(&config.BreakerFailures, "breakerfailures", config.BreakerFailures, "Consecutive failed writes that take an upstream out of rotation, 0 disables. Default 5")
+	fs.IntVar(&config.BreakerCoolDownSeconds, "breakercooldown", config.BreakerCoolDownSeconds, "Seconds an upstream stays out of rotation before a trial write. Default 30")
+	fs.StringVar(&config.RoutingMode, "routingmode", config.RoutingMode, "How series are spread over upstreams, replicate or shard. Default - replicate")
+	fs.IntVar(&config.ReplicationFactor, "replicationfactor", config.ReplicationFactor, "Number of distinct upstreams each series is written to in shard mode. Default 1")
+	fs.StringVar(&config.WriteConsistency, "writeconsistency", config.WriteConsistency, "Upstreams that must accept a write before it is acknowledged, any, quorum or all. Default - any")
+	fs.BoolVar(&config.ZoneAware, "zoneaware", config.ZoneAware, "Prefer upstreams in our own availability zone to save cross zone traffic. Default false")
+	fs.StringVar(&config.Zone, "zone", config.Zone, "Our own availability zone, looked up from the instance metadata when empty. Default - none")
+	fs.Var(listValue{&config.TenantSources}, "tenantsources", "Comma separated places to look for the tenant in order, path, header, user or label. Default - path")
+	fs.StringVar(&config.TenantHeader, "tenantheader", config.TenantHeader, "Request header carrying the tenant. Default - X-Scope-OrgID")
+	fs.StringVar(&config.TenantLabel, "tenantlabel", config.TenantLabel, "Series label carrying the tenant. Default - vm_account_id")
+	fs.StringVar(&config.TenantDefault, "tenantdefault", config.TenantDefault, "Tenant of writes without one. Default - none, sent to the upstream URI")
+	fs.StringVar(&config.TenantURI, "tenanturi", config.TenantURI, "Write path of a tenant on the upstreams. Default - /insert/{tenant}/prometheus/api/v1/write")
+	fs.StringVar(&config.LimitsBy, "limitsby", config.LimitsBy, "What active series and samples rate limits apply to, tenant, client or source_ip. Default - disabled")
+	fs.StringVar(&config.LimitsAction, "limitsaction", config.LimitsAction, "What happens to writes over a limit, reject with a 429 or drop the series over it. Default - reject")
+	fs.IntVar(&config.MaxActiveSeries, "maxactiveseries", config.MaxActiveSeries, "Active series limit of each tenant, 0 is unlimited. Default 0")
+	fs.Float64Var(&config.MaxSamplesPerSecond, "maxsamplespersecond", config.MaxSamplesPerSecond, "Samples per second limit of each tenant, 0 is unlimited. Default 0")
+	fs.StringVar(&config.QueueDir, "queuedir", config.QueueDir, "Directory for the on disk retry queues of failed writes. Default - disabled")
+	fs.Int64Var(&config.QueueMaxBytes, "queuemaxbytes", config.QueueMaxBytes, "Maximum size of the retry queue of each upstream. Default 512MB")
+	fs.IntVar(&config.QueueMaxAgeSeconds, "queuemaxageseconds", config.QueueMaxAgeSeconds, "Queued writes older than this are dropped instead of replayed. Default 86400")
+
+	return flags
+}
+
+// setOwnZone looks up the availability zone we run in when zone aware routing needs it and it is not configured
+func setOwnZone(config *utility.VConfig) {
+	if !config.ZoneAware || config.Zone != "" {
+		return
+	}
+
+	zone, err := utility.GetAvailabilityZone()
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not look up our availability zone, zone aware routing is off until it is configured")
+		return
+	}
+
+	log.Info().Msgf("Running in availability zone %s", zone)
+	config.Zone = zone
+}
+
+// loadConfig builds the configuration from the defaults, the configuration file and
+// then the flags given in args so the command line always wins
+func loadConfig(path string, args []string) (utility.VConfig, error) {
+	config := utility.DefaultConfig()
+
+	if path != "" {
+		if err := utility.LoadConfigFile(path, &config); err != nil {
+			return config, err
+		}
+	}
+
+	// Parsing the arguments again only sets the flags that were actually given
+	fs := flag.NewFlagSet("vmwriter", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	registerFlags(fs, &config)
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+// secondsValue flag holding a duration such as 15s or 1m stored as whole seconds
+type secondsValue struct {
+	seconds *int
+}
+
+func (s secondsValue) String() string {
+	if s.seconds == nil {
+		return ""
+	}
+	return (time.Duration(*s.seconds) * time.Second).String()
+}
+
+func (s secondsValue) Set(v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*s.seconds = int(d.Seconds())
+	return nil
+}
+
+// listValue flag holding a comma separated list
+type listValue struct {
+	list *[]string
+}
+
+func (l listValue) String() string {
+	if l.list == nil {
+		return ""
+	}
+	return strings.Join(*l.list, ",")
+}
+
+func (l listValue) Set(v string) error {
+	*l.list = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l.list = append(*l.list, item)
+		}
+	}
+	return nil
+}
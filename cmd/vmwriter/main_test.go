@@ -1,8 +1,14 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.dev.pages/infrastructure/vmwriter/internal/awsfake"
 	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
 	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
 )
@@ -12,7 +18,20 @@ func TestAbc(t *testing.T) {
 	//t.Error() // to indicate test failed
 }
 
+// useFakeEC2 serves the EC2 calls from an in-memory fake holding two tagged instances
+func useFakeEC2(t *testing.T) {
+	fake := awsfake.NewEC2(0,
+		awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", map[string]string{"Cluster": "victoriametrix", "test": "8428"}),
+		awsfake.Instance("i-2", "10.0.0.2", ec2.InstanceStateNameRunning, "us-west-2b", map[string]string{"Cluster": "victoriametrix", "test": "8428"}),
+	)
+	old := utility.NewAWSClients
+	utility.NewAWSClients = awsfake.Clients(fake, nil)
+	t.Cleanup(func() { utility.NewAWSClients = old })
+}
+
 func TestConfig(t *testing.T) {
+	useFakeEC2(t)
+
 	var config utility.VConfig
 
 	config.AWSPollingIntervalSeconds = 4
@@ -32,8 +51,11 @@ func TestConfig(t *testing.T) {
 }
 
 func TestVMWriter(t *testing.T) {
+	useFakeEC2(t)
+
 	var config utility.VConfig
 
+	config.AWSDiscoveryEnabled = true
 	config.AWSPollingIntervalSeconds = 4
 	config.AWSPortTag = "test"
 	config.AWSRegion = "us-west-2"
@@ -56,3 +78,100 @@ func TestVMWriter(t *testing.T) {
 	}
 
 }
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "vmwriter*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`
+listener:
+  address: 127.0.0.1:6000
+discovery:
+  ec2:
+    tag_value: victoriametrics-prod
+routing:
+  mode: shard
+  replication_factor: 2
+  rules:
+    - match: {environment: dev}
+      pools: [dev]
+pools:
+  - name: dev
+    discovery:
+      ec2:
+        tag_value: victoriametrics-dev
+`)
+	f.Close()
+
+	config, err := loadConfig(f.Name(), []string{"-config.file", f.Name(), "-replicationfactor", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ListenAddress != "127.0.0.1:6000" || config.AWSSearchTagValue != "victoriametrics-prod" || config.RoutingMode != utility.RoutingShard {
+		t.Errorf("values from the file were not loaded: %+v", config)
+	}
+	if config.ReplicationFactor != 3 {
+		t.Errorf("flag should override the file, got replication factor %d", config.ReplicationFactor)
+	}
+	if config.AWSSearchTag != "Cluster" || config.HTTPTimeOut != 3 {
+		t.Errorf("defaults should apply to values missing from the file: %+v", config)
+	}
+	if config.AWSDiscoveryEnabled {
+		t.Error("EC2 discovery should stay off unless it is enabled")
+	}
+
+	dev, ok := config.PoolConfig("dev")
+	if !ok || dev.AWSSearchTagValue != "victoriametrics-dev" || dev.AWSSearchTag != "Cluster" || dev.ReplicationFactor != 3 {
+		t.Errorf("expected the pool to use its own discovery on top of the defaults: %+v", dev.DiscoveryConfig)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	f, err := ioutil.TempFile("", "vmwriter*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("routing:\n  mdoe: shard\n")
+	f.Close()
+
+	if _, err := loadConfig(f.Name(), nil); err == nil {
+		t.Error("expected unknown field to be rejected")
+	}
+}
+
+func TestStartUpstreamsFailsWhenDiscoveryFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "upstreams.yaml")
+	if err := ioutil.WriteFile(file, []byte("- targets: [\"10.0.0.1:8428\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := utility.DefaultConfig()
+	config.FileSDFiles = []string{file}
+	upstreams, err := startUpstreams(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := upstreams.UpstreamList(); len(list) != 1 {
+		t.Errorf("expected the upstream from the file, got %v", list)
+	}
+
+	// An unreadable upstream file stops vmwriter from starting
+	if err := ioutil.WriteFile(file, []byte("targets: {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startUpstreams(&config); err == nil {
+		t.Error("expected startup to fail when discovery fails")
+	}
+}
@@ -4,10 +4,18 @@ go 1.15
 
 require (
 	github.com/aws/aws-sdk-go v1.27.0
+	github.com/cespare/xxhash/v2 v2.1.1
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang/snappy v0.0.1
 	github.com/gorilla/mux v1.8.0
+	github.com/miekg/dns v1.1.31
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/prometheus/client_golang v1.8.0
 	github.com/rs/zerolog v1.20.0
+	google.golang.org/protobuf v1.24.0
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
-
+	gopkg.in/yaml.v2 v2.3.0
+	k8s.io/api v0.19.2
+	k8s.io/apimachinery v0.19.2
+	k8s.io/client-go v0.19.2
 )
@@ -0,0 +1,245 @@
+//Package awsfake provides in-memory stand-ins for the EC2 and auto scaling APIs used by discovery
+//
+// Only the calls vmwriter makes are implemented, anything else panics through the embedded
+// nil interface so a test notices straight away.
+package awsfake
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+//EC2 in-memory EC2 API holding a list of instances
+type EC2 struct {
+	ec2iface.EC2API
+
+	mu        sync.Mutex
+	instances []*ec2.Instance
+	pageSize  int
+	calls     int
+	err       error
+}
+
+//NewEC2 creates a fake returning pageSize instances per page, all of them in one page when pageSize is 0
+func NewEC2(pageSize int, instances ...*ec2.Instance) *EC2 {
+	return &EC2{instances: instances, pageSize: pageSize}
+}
+
+//SetInstances replaces the instances
+func (f *EC2) SetInstances(instances ...*ec2.Instance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances = instances
+}
+
+//SetError makes every call fail with err, nil serves the instances again
+func (f *EC2) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+//Calls number of DescribeInstances pages served
+func (f *EC2) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+//DescribeInstances returns one page of the instances matching the filters and instance ids
+func (f *EC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var matched []*ec2.Instance
+	for _, i := range f.instances {
+		if matchInstance(i, input) {
+			matched = append(matched, i)
+		}
+	}
+
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	end := len(matched)
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+	}
+
+	// Each instance in its own reservation, like instances launched by an autoscaling group
+	out := &ec2.DescribeInstancesOutput{}
+	for _, i := range matched[start:end] {
+		out.Reservations = append(out.Reservations, &ec2.Reservation{Instances: []*ec2.Instance{i}})
+	}
+	if end < len(matched) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+//DescribeInstancesPages calls fn with every page of DescribeInstances
+func (f *EC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	params := *input
+	for {
+		out, err := f.DescribeInstances(&params)
+		if err != nil {
+			return err
+		}
+		last := out.NextToken == nil
+		if !fn(out, last) || last {
+			return nil
+		}
+		params.NextToken = out.NextToken
+	}
+}
+
+// matchInstance applies the instance ids and the tag and state filters, filters are ANDed and their values ORed
+func matchInstance(i *ec2.Instance, input *ec2.DescribeInstancesInput) bool {
+	if len(input.InstanceIds) > 0 {
+		found := false
+		for _, id := range input.InstanceIds {
+			if aws.StringValue(id) == aws.StringValue(i.InstanceId) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, filter := range input.Filters {
+		name := aws.StringValue(filter.Name)
+
+		var value *string
+		switch {
+		case name == "instance-state-name":
+			if i.State != nil {
+				value = i.State.Name
+			}
+		case strings.HasPrefix(name, "tag:"):
+			for _, t := range i.Tags {
+				if aws.StringValue(t.Key) == strings.TrimPrefix(name, "tag:") {
+					value = t.Value
+				}
+			}
+		default:
+			panic("awsfake: unsupported filter " + name)
+		}
+
+		ok := false
+		for _, v := range filter.Values {
+			if value != nil && *value == aws.StringValue(v) {
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Instance builds an instance, an empty ip leaves the private address unset
+func Instance(id string, ip string, state string, zone string, tags map[string]string) *ec2.Instance {
+	i := &ec2.Instance{
+		InstanceId: aws.String(id),
+		State:      &ec2.InstanceState{Name: aws.String(state)},
+		Placement:  &ec2.Placement{AvailabilityZone: aws.String(zone)},
+	}
+	if ip != "" {
+		i.PrivateIpAddress = aws.String(ip)
+	}
+	for k, v := range tags {
+		i.Tags = append(i.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return i
+}
+
+//AutoScaling in-memory auto scaling API holding a list of groups
+type AutoScaling struct {
+	autoscalingiface.AutoScalingAPI
+
+	mu     sync.Mutex
+	groups []*autoscaling.Group
+	err    error
+}
+
+//NewAutoScaling creates a fake with the groups
+func NewAutoScaling(groups ...*autoscaling.Group) *AutoScaling {
+	return &AutoScaling{groups: groups}
+}
+
+//SetGroups replaces the groups
+func (f *AutoScaling) SetGroups(groups ...*autoscaling.Group) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.groups = groups
+}
+
+//SetError makes every call fail with err, nil serves the groups again
+func (f *AutoScaling) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+//DescribeAutoScalingGroupsPages calls fn with the named groups in a single page
+func (f *AutoScaling) DescribeAutoScalingGroupsPages(input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool) error {
+	f.mu.Lock()
+	if err := f.err; err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	out := &autoscaling.DescribeAutoScalingGroupsOutput{}
+	for _, g := range f.groups {
+		for _, name := range input.AutoScalingGroupNames {
+			if aws.StringValue(name) == aws.StringValue(g.AutoScalingGroupName) {
+				out.AutoScalingGroups = append(out.AutoScalingGroups, g)
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	fn(out, true)
+	return nil
+}
+
+//Group builds an auto scaling group, members maps instance ids to "LifecycleState/HealthStatus"
+func Group(name string, members map[string]string) *autoscaling.Group {
+	g := &autoscaling.Group{AutoScalingGroupName: aws.String(name)}
+	for id, state := range members {
+		parts := strings.SplitN(state, "/", 2)
+		i := &autoscaling.Instance{InstanceId: aws.String(id), LifecycleState: aws.String(parts[0])}
+		if len(parts) == 2 {
+			i.HealthStatus = aws.String(parts[1])
+		}
+		g.Instances = append(g.Instances, i)
+	}
+	return g
+}
+
+//Clients returns a replacement for utility.NewAWSClients that serves every configured region from the fakes
+func Clients(e *EC2, a *AutoScaling) func(config *utility.VConfig) ([]utility.AWSClients, error) {
+	return func(config *utility.VConfig) ([]utility.AWSClients, error) {
+		var clients []utility.AWSClients
+		for _, region := range config.Regions() {
+			clients = append(clients, utility.AWSClients{Region: region, EC2: e, AutoScaling: a})
+		}
+		return clients, nil
+	}
+}
@@ -0,0 +1,58 @@
+package vmdiscovery
+
+import (
+	"errors"
+	"strconv"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+//FromConfig builds the discoverer for the discovery section of the configuration,
+//combining every mechanism that is enabled
+func FromConfig(config *utility.VConfig) (Discoverer, error) {
+	var discoverers []Discoverer
+
+	if config.AWSDiscoveryEnabled {
+		discoverers = append(discoverers, &EC2{Config: config.EC2Config})
+	}
+
+	if len(config.FileSDFiles) > 0 {
+		discoverers = append(discoverers, &File{Patterns: config.FileSDFiles})
+	}
+
+	if config.ConsulService != "" {
+		discoverers = append(discoverers, &Consul{Config: config.ConsulSDConfig})
+	}
+
+	if config.KubeSelector != "" {
+		k, err := NewKubernetes(config.KubernetesSDConfig)
+		if err != nil {
+			return nil, err
+		}
+		discoverers = append(discoverers, k)
+	}
+
+	if len(config.DNSNames) > 0 {
+		discoverers = append(discoverers, &DNS{Config: config.DNSSDConfig})
+	}
+
+	if len(config.StaticUpstreams) > 0 {
+		var static Static
+		for _, u := range config.StaticUpstreams {
+			t := Target{Host: u.Host, Port: u.Port, URI: u.URI, Meta: u.Labels}
+			if u.Weight != nil {
+				t.Meta = withMeta(u.Labels, MetaWeight, strconv.FormatFloat(*u.Weight, 'g', -1, 64))
+			}
+			static = append(static, t)
+		}
+		discoverers = append(discoverers, static)
+	}
+
+	switch len(discoverers) {
+	case 0:
+		return nil, errors.New("no upstream discovery configured")
+	case 1:
+		return discoverers[0], nil
+	}
+	return &Multi{Discoverers: discoverers}, nil
+}
@@ -0,0 +1,193 @@
+package vmdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// consulWait how long a blocking query waits for a change before Consul answers anyway
+const consulWait = 5 * time.Minute
+
+// consulRetry how long to wait before querying again after an error
+const consulRetry = 5 * time.Second
+
+// consulTimeout how long a query may take on top of the wait of a blocking query, so a hung
+// agent can not stop discovery for good
+var consulTimeout = 30 * time.Second
+
+// consulClient used when Consul.Client is not set, Consul adds up to wait/16 to the wait of a blocking query
+var consulClient = &http.Client{Timeout: consulWait + consulWait/16 + consulTimeout}
+
+//Consul discovers upstreams from the passing instances of a Consul service
+type Consul struct {
+	Config utility.ConsulSDConfig
+	Client *http.Client // Client used for the queries, must not time out before a blocking query returns
+}
+
+// consulServiceEntry the parts of an entry of /v1/health/service that are used
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+//Name identifies the discoverer in logs
+func (c *Consul) Name() string {
+	return "consul"
+}
+
+//Discover returns the passing instances of the service
+func (c *Consul) Discover() ([]Target, error) {
+	targets, _, err := c.query(context.Background(), 0)
+	return targets, err
+}
+
+//Watch runs blocking queries against the health API and calls notify whenever the instances changed
+func (c *Consul) Watch(ctx context.Context, notify func()) {
+	var last []Target
+	var index uint64
+
+	for {
+		targets, next, err := c.query(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("service", discoveryservice).Msgf("Error querying consul for %s", c.Config.ConsulService)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(consulRetry):
+			}
+			continue
+		}
+
+		if index != 0 && !sameTargets(last, targets) {
+			notify()
+		}
+		last = targets
+
+		// The index can go backwards, for example when the servers were restored from a snapshot
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// query asks the health API for the passing instances, blocking until the index changed when index is set
+func (c *Consul) query(ctx context.Context, index uint64) ([]Target, uint64, error) {
+	params := url.Values{}
+	params.Set("passing", "true")
+	if c.Config.ConsulTag != "" {
+		params.Set("tag", c.Config.ConsulTag)
+	}
+	if c.Config.ConsulDatacenter != "" {
+		params.Set("dc", c.Config.ConsulDatacenter)
+	}
+	timeout := consulTimeout
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", consulWait.String())
+		timeout += consulWait + consulWait/16
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", strings.TrimSuffix(c.Config.ConsulAddress, "/"),
+		url.PathEscape(c.Config.ConsulService), params.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if c.Config.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", c.Config.ConsulToken)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = consulClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	targets := make([]Target, 0, len(entries))
+	for _, e := range entries {
+		targets = append(targets, c.target(e))
+	}
+	SortTargets(targets)
+
+	return targets, next, nil
+}
+
+// target converts a service entry, the port and URI come from the service metadata like the EC2 tags
+func (c *Consul) target(e consulServiceEntry) Target {
+	host := e.Service.Address
+	if host == "" {
+		host = e.Node.Address
+	}
+
+	port := e.Service.Port
+	if port == 0 {
+		port = 8428
+	}
+	uri := "/api/v1/write"
+
+	for k, v := range e.Service.Meta {
+		if k == c.Config.ConsulPortMeta {
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				log.Error().Err(err).Str("service", discoveryservice).Msgf("Invalid port %s in consul metadata of %s", v, e.Service.ID)
+				continue
+			}
+			port = p
+		}
+		if k == c.Config.ConsulURIMeta {
+			uri = v
+		}
+	}
+
+	return Target{
+		Host: host,
+		Port: port,
+		URI:  uri,
+		Meta: map[string]string{
+			MetaSource:     "consul",
+			MetaInstanceID: e.Service.ID,
+			MetaName:       e.Node.Node,
+		},
+	}
+}
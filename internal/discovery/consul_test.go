@@ -0,0 +1,143 @@
+package vmdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// testConsul stand-in for the Consul health API of a single service
+type testConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []map[string]interface{}
+	changed chan struct{}
+}
+
+func (c *testConsul) set(entries ...map[string]interface{}) {
+	c.mu.Lock()
+	c.index++
+	c.entries = entries
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+func (c *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/victoriametrics" || r.URL.Query().Get("passing") != "true" || r.URL.Query().Get("tag") != "write" {
+		http.Error(w, "unexpected query "+r.URL.String(), http.StatusBadRequest)
+		return
+	}
+
+	// Block until the index moves past the one the client has seen
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	c.mu.Lock()
+	current, changed := c.index, c.changed
+	c.mu.Unlock()
+	if index != 0 && index >= current {
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(w).Encode(c.entries)
+}
+
+func consulEntry(node string, address string, port int, meta map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"Node":    map[string]interface{}{"Node": node, "Address": address},
+		"Service": map[string]interface{}{"ID": "vm-" + node, "Service": "victoriametrics", "Port": port, "Meta": meta},
+	}
+}
+
+func TestConsulDiscover(t *testing.T) {
+	consul := &testConsul{changed: make(chan struct{})}
+	consul.set(
+		consulEntry("node1", "10.0.0.1", 8428, nil),
+		consulEntry("node2", "10.0.0.2", 8480, map[string]string{"ClusterVMPort": "8481", "ClusterVMURI": "/insert/0/prometheus/api/v1/write"}),
+	)
+	srv := httptest.NewServer(consul)
+	defer srv.Close()
+
+	config := utility.DefaultConfig().ConsulSDConfig
+	config.ConsulAddress = srv.URL
+	config.ConsulService = "victoriametrics"
+	config.ConsulTag = "write"
+	c := &Consul{Config: config, Client: srv.Client()}
+
+	targets, err := c.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %v", targets)
+	}
+	if tg := targets[0]; tg.Host != "10.0.0.1" || tg.Port != 8428 || tg.URI != "/api/v1/write" || tg.Meta[MetaName] != "node1" {
+		t.Errorf("unexpected target %+v", tg)
+	}
+	if tg := targets[1]; tg.Port != 8481 || tg.URI != "/insert/0/prometheus/api/v1/write" {
+		t.Errorf("expected port and uri from the metadata, got %+v", tg)
+	}
+
+	changed := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Watch(ctx, func() { changed <- struct{}{} })
+
+	// Node 2 fails its health check and drops out of the passing instances
+	time.Sleep(100 * time.Millisecond)
+	consul.set(consulEntry("node1", "10.0.0.1", 8428, nil))
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification when the instances changed")
+	}
+	if targets, _ := c.Discover(); len(targets) != 1 {
+		t.Errorf("expected 1 target, got %v", targets)
+	}
+}
+
+func TestConsulHungAgentTimesOut(t *testing.T) {
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer srv.Close()
+	defer close(hung)
+
+	old := consulTimeout
+	consulTimeout = 100 * time.Millisecond
+	defer func() { consulTimeout = old }()
+
+	config := utility.DefaultConfig().ConsulSDConfig
+	config.ConsulAddress = srv.URL
+	config.ConsulService = "victoriametrics"
+	c := &Consul{Config: config}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Discover()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error from a hung agent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("discovery is stuck on a hung agent")
+	}
+}
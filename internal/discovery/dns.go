@@ -0,0 +1,272 @@
+package vmdiscovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// dnsMinTTL floor for the record TTL so names with a zero TTL are not resolved in a tight loop
+const dnsMinTTL = time.Second
+
+// dnsRetry how long to wait before resolving again after an error
+const dnsRetry = 5 * time.Second
+
+//DNS discovers upstreams by resolving SRV, A or AAAA records
+//
+// Results are cached for the lowest TTL of the records they came from, Watch resolves the
+// names again when that expires and reports any change straight away.
+type DNS struct {
+	Config utility.DNSSDConfig
+	Client *dns.Client // Client used for the queries, a default udp client when nil
+
+	mu      sync.Mutex
+	targets []Target
+	expires time.Time
+}
+
+//Name identifies the discoverer in logs
+func (d *DNS) Name() string {
+	return "dns"
+}
+
+//Discover returns the cached targets, resolving the names again once their TTL expired
+func (d *DNS) Discover() ([]Target, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if time.Now().Before(d.expires) {
+		return append([]Target(nil), d.targets...), nil
+	}
+
+	targets, ttl, err := d.resolve()
+	if err != nil {
+		return nil, err
+	}
+	d.targets = targets
+	d.expires = time.Now().Add(ttl)
+
+	return append([]Target(nil), targets...), nil
+}
+
+//Watch resolves the names whenever their TTL expires and calls notify when the targets changed
+func (d *DNS) Watch(ctx context.Context, notify func()) {
+	var last []Target
+	first := true
+
+	for {
+		targets, err := d.Discover()
+
+		wait := dnsRetry
+		if err != nil {
+			log.Error().Err(err).Str("service", discoveryservice).Msg("Error resolving upstreams")
+		} else {
+			if !first && !sameTargets(last, targets) {
+				notify()
+			}
+			last, first = targets, false
+
+			d.mu.Lock()
+			wait = time.Until(d.expires)
+			d.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resolve looks up every name, returning the targets and how long they may be cached
+func (d *DNS) resolve() ([]Target, time.Duration, error) {
+	server := d.Config.DNSServer
+	if server == "" {
+		cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(cc.Servers) == 0 {
+			return nil, 0, errors.New("no nameservers in /etc/resolv.conf")
+		}
+		server = net.JoinHostPort(cc.Servers[0], cc.Port)
+	}
+
+	r := resolver{client: d.Client, server: server, ttl: -1}
+	if r.client == nil {
+		r.client = &dns.Client{Timeout: 5 * time.Second}
+	}
+
+	var targets []Target
+	for _, name := range d.Config.DNSNames {
+		var found []Target
+		var err error
+		switch d.Config.DNSType {
+		case utility.DNSTypeSRV:
+			found, err = r.srv(name, d.Config.DNSURI)
+		case utility.DNSTypeAAAA:
+			found, err = r.address(name, dns.TypeAAAA, d.Config.DNSPort, d.Config.DNSURI)
+		default:
+			found, err = r.address(name, dns.TypeA, d.Config.DNSPort, d.Config.DNSURI)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", name, err)
+		}
+		targets = append(targets, found...)
+	}
+
+	ttl := r.ttl
+	if ttl < dnsMinTTL {
+		ttl = dnsMinTTL
+	}
+
+	SortTargets(targets)
+	return targets, ttl, nil
+}
+
+// resolver runs the queries of one resolution and tracks the lowest TTL seen
+type resolver struct {
+	client *dns.Client
+	server string
+	ttl    time.Duration
+}
+
+// query asks the server for name, a name that does not exist has no records
+func (r *resolver) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	in, _, err := r.client.Exchange(m, r.server)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("lookup failed with %s", dns.RcodeToString[in.Rcode])
+	}
+
+	for _, rr := range append(in.Answer, in.Extra...) {
+		r.seen(rr)
+	}
+	return in, nil
+}
+
+// seen lowers the TTL of the resolution to the TTL of rr
+func (r *resolver) seen(rr dns.RR) {
+	ttl := time.Duration(rr.Header().Ttl) * time.Second
+	if r.ttl < 0 || ttl < r.ttl {
+		r.ttl = ttl
+	}
+}
+
+// srv resolves the SRV records of name and the addresses of their targets
+func (r *resolver) srv(name string, uri string) ([]Target, error) {
+	in, err := r.query(name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers usually send the addresses of the targets along as additional records
+	extra := make(map[string][]string)
+	for _, rr := range in.Extra {
+		switch a := rr.(type) {
+		case *dns.A:
+			extra[a.Hdr.Name] = append(extra[a.Hdr.Name], a.A.String())
+		case *dns.AAAA:
+			extra[a.Hdr.Name] = append(extra[a.Hdr.Name], a.AAAA.String())
+		}
+	}
+
+	var targets []Target
+	for _, rr := range in.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+
+		hosts, ok := extra[srv.Target]
+		if !ok {
+			found, err := r.address(srv.Target, dns.TypeA, 0, "")
+			if err != nil {
+				return nil, err
+			}
+			if len(found) == 0 {
+				if found, err = r.address(srv.Target, dns.TypeAAAA, 0, ""); err != nil {
+					return nil, err
+				}
+			}
+			for _, t := range found {
+				hosts = append(hosts, t.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			targets = append(targets, Target{
+				Host: host,
+				Port: int(srv.Port),
+				URI:  uri,
+				Meta: map[string]string{
+					MetaSource: "dns",
+					MetaName:   strings.TrimSuffix(srv.Target, "."),
+				},
+			})
+		}
+	}
+
+	return targets, nil
+}
+
+// address resolves the A or AAAA records of name
+func (r *resolver) address(name string, qtype uint16, port int, uri string) ([]Target, error) {
+	in, err := r.query(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	for _, rr := range in.Answer {
+		var host string
+		switch a := rr.(type) {
+		case *dns.A:
+			host = a.A.String()
+		case *dns.AAAA:
+			host = a.AAAA.String()
+		default:
+			// CNAMEs are followed by the server and come before the addresses
+			continue
+		}
+		targets = append(targets, Target{
+			Host: host,
+			Port: port,
+			URI:  uri,
+			Meta: map[string]string{
+				MetaSource: "dns",
+				MetaName:   strings.TrimSuffix(name, "."),
+			},
+		})
+	}
+
+	return targets, nil
+}
+
+// sameTargets whether both lists hold the same targets, the lists are sorted
+func sameTargets(a []Target, b []Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key() != b[i].Key() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package vmdiscovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// testDNSServer in-process DNS server answering from a mutable zone
+type testDNSServer struct {
+	mu      sync.Mutex
+	records map[uint16][]string // records zone file lines by query type
+}
+
+func (s *testDNSServer) set(qtype uint16, records ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[qtype] = records
+}
+
+func (s *testDNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	q := req.Question[0]
+	for _, line := range s.records[q.Qtype] {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			panic(err)
+		}
+		if rr.Header().Name == q.Name {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(m)
+}
+
+func startDNSServer(t *testing.T) (*testDNSServer, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &testDNSServer{records: make(map[uint16][]string)}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return handler, pc.LocalAddr().String()
+}
+
+func TestDNSDiscoverSRV(t *testing.T) {
+	server, addr := startDNSServer(t)
+	server.set(dns.TypeSRV,
+		"_vm._tcp.example.com. 30 IN SRV 0 0 8428 vm1.example.com.",
+		"_vm._tcp.example.com. 30 IN SRV 0 0 8429 vm2.example.com.")
+	server.set(dns.TypeA,
+		"vm1.example.com. 30 IN A 10.0.0.1",
+		"vm2.example.com. 30 IN A 10.0.0.2")
+
+	d := &DNS{Config: utility.DNSSDConfig{DNSNames: []string{"_vm._tcp.example.com"}, DNSType: utility.DNSTypeSRV, DNSURI: "/api/v1/write", DNSServer: addr}}
+	targets, err := d.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %v", targets)
+	}
+	if targets[0].Host != "10.0.0.1" || targets[0].Port != 8428 || targets[1].Host != "10.0.0.2" || targets[1].Port != 8429 {
+		t.Errorf("unexpected targets %v", targets)
+	}
+	if targets[0].Meta[MetaName] != "vm1.example.com" {
+		t.Errorf("expected the SRV target as name, got %v", targets[0].Meta)
+	}
+}
+
+func TestDNSRespectsTTL(t *testing.T) {
+	server, addr := startDNSServer(t)
+	server.set(dns.TypeA, "vm.example.com. 1 IN A 10.0.0.1")
+
+	d := &DNS{Config: utility.DNSSDConfig{DNSNames: []string{"vm.example.com"}, DNSType: utility.DNSTypeA, DNSPort: 8428, DNSServer: addr}}
+	if targets, err := d.Discover(); err != nil || len(targets) != 1 {
+		t.Fatalf("expected 1 target, got %v %v", targets, err)
+	}
+
+	server.set(dns.TypeA, "vm.example.com. 1 IN A 10.0.0.1", "vm.example.com. 1 IN A 10.0.0.2")
+
+	// Still cached
+	if targets, _ := d.Discover(); len(targets) != 1 {
+		t.Fatalf("expected the cached target until the TTL expires, got %v", targets)
+	}
+
+	changed := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Watch(ctx, func() { changed <- struct{}{} })
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification once the TTL expired")
+	}
+	if targets, _ := d.Discover(); len(targets) != 2 {
+		t.Fatalf("expected 2 targets after the TTL expired, got %v", targets)
+	}
+
+	// A name that went away has no upstreams
+	server.set(dns.TypeA)
+	time.Sleep(1100 * time.Millisecond)
+	if targets, err := d.Discover(); err != nil || len(targets) != 0 {
+		t.Fatalf("expected no targets for a missing name, got %v %v", targets, err)
+	}
+}
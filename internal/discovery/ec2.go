@@ -0,0 +1,54 @@
+package vmdiscovery
+
+import (
+	"strconv"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+//EC2 discovers upstreams from EC2 instances carrying the cluster tag or from the members of an auto scaling group
+type EC2 struct {
+	Config utility.EC2Config
+}
+
+//Name identifies the discoverer in logs
+func (e *EC2) Name() string {
+	return "ec2"
+}
+
+//Discover returns the running instances with the cluster tag, or the in service and healthy
+//instances of the auto scaling group when one is configured
+func (e *EC2) Discover() ([]Target, error) {
+	var config utility.VConfig
+	config.EC2Config = e.Config
+
+	var instances []utility.VInstance
+	var err error
+	if e.Config.AWSAutoScalingGroup != "" {
+		instances, err = utility.GetAWSInstancesByASG(&config)
+	} else {
+		instances, err = utility.GetAWSInstancesByTag(&config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, len(instances))
+	for _, inst := range instances {
+		targets = append(targets, Target{
+			Host: inst.AWSHost,
+			Port: inst.AWSPort,
+			URI:  inst.AWSURI,
+			Meta: map[string]string{
+				MetaSource:     "ec2",
+				MetaInstanceID: inst.AWSInstanceID,
+				MetaName:       inst.AWSName,
+				MetaRegion:     inst.AWSRegion,
+				MetaZone:       inst.AWSAvailabilityZone,
+				MetaWeight:     strconv.FormatFloat(inst.AWSWeight, 'g', -1, 64),
+			},
+			Draining: inst.AWSDraining,
+		})
+	}
+	return targets, nil
+}
@@ -0,0 +1,174 @@
+package vmdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+const discoveryservice = "discovery"
+
+// Labels of a file_sd target group that set the upstream itself instead of its metadata
+const (
+	fileLabelURI    = "__uri__"
+	fileLabelWeight = "__weight__"
+)
+
+//FileTargetGroup a group of upstreams in a file, the same shape as a Prometheus file_sd target group
+//
+// The __uri__ label sets the write path of the group and __weight__ its weight, every other
+// label is passed on as metadata.
+type FileTargetGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+//File discovers upstreams listed in .json, .yml or .yaml files and watches them for changes
+type File struct {
+	Patterns []string // Patterns file paths or globs
+}
+
+//Name identifies the discoverer in logs
+func (f *File) Name() string {
+	return "file"
+}
+
+//Discover reads every file matching the patterns
+func (f *File) Discover() ([]Target, error) {
+	var targets []Target
+
+	for _, pattern := range f.Patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			found, err := readTargetFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			targets = append(targets, found...)
+		}
+	}
+
+	SortTargets(targets)
+	return targets, nil
+}
+
+//Watch calls notify whenever a file matching the patterns is written, created, renamed or removed
+//
+// The directories are watched rather than the files so files replaced by a rename, as
+// configuration management tools do, keep being watched.
+func (f *File) Watch(ctx context.Context, notify func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Str("service", discoveryservice).Msg("Could not watch upstream files, changes are picked up on the next poll")
+		return
+	}
+	defer watcher.Close()
+
+	dirs := make(map[string]bool)
+	for _, pattern := range f.Patterns {
+		dir := filepath.Dir(pattern)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			log.Error().Err(err).Str("service", discoveryservice).Msgf("Could not watch %s, changes are picked up on the next poll", dir)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if f.matches(event.Name) {
+				log.Debug().Str("service", discoveryservice).Msgf("Upstream file %s changed", event.Name)
+				notify()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Str("service", discoveryservice).Msg("Error watching upstream files")
+		}
+	}
+}
+
+// matches whether the file is one of the watched files
+func (f *File) matches(file string) bool {
+	for _, pattern := range f.Patterns {
+		if ok, _ := filepath.Match(filepath.Clean(pattern), filepath.Clean(file)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readTargetFile parses one file_sd file into targets
+func readTargetFile(file string) ([]Target, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []FileTargetGroup
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		err = json.Unmarshal(data, &groups)
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(data, &groups)
+	default:
+		return nil, fmt.Errorf("unknown file type, expected .json, .yml or .yaml")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	for _, group := range groups {
+		uri := "/api/v1/write"
+		meta := make(map[string]string)
+		for k, v := range group.Labels {
+			switch k {
+			case fileLabelURI:
+				uri = v
+			case fileLabelWeight:
+				if w, err := strconv.ParseFloat(v, 64); err != nil || w < 0 {
+					return nil, fmt.Errorf("invalid weight %q", v)
+				}
+				meta[MetaWeight] = v
+			default:
+				meta[k] = v
+			}
+		}
+
+		for _, address := range group.Targets {
+			host, portStr, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: %v", address, err)
+			}
+			port, err := strconv.Atoi(portStr)
+			if err != nil || port <= 0 {
+				return nil, fmt.Errorf("target %s has an invalid port", address)
+			}
+			targets = append(targets, Target{Host: host, Port: port, URI: uri, Meta: withMeta(meta, MetaSource, "file")})
+		}
+	}
+
+	return targets, nil
+}
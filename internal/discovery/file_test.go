@@ -0,0 +1,92 @@
+package vmdiscovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "vmdiscovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDiscover(t *testing.T) {
+	dir := tempDir(t)
+
+	writeFile(t, filepath.Join(dir, "a.yml"), `
+- targets: ["10.0.0.1:8428", "10.0.0.2:8428"]
+  labels:
+    zone: us-west-2a
+    __weight__: "2"
+`)
+	writeFile(t, filepath.Join(dir, "b.json"), `[{"targets": ["[::1]:8480"], "labels": {"__uri__": "/insert/0/prometheus/api/v1/write"}}]`)
+
+	f := &File{Patterns: []string{filepath.Join(dir, "*.yml"), filepath.Join(dir, "*.json")}}
+	targets, err := f.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 {
+		t.Fatalf("expected 3 targets, got %v", targets)
+	}
+
+	byHost := make(map[string]Target)
+	for _, target := range targets {
+		byHost[target.Host] = target
+	}
+	if tg := byHost["10.0.0.1"]; tg.Port != 8428 || tg.URI != "/api/v1/write" || tg.Meta["zone"] != "us-west-2a" || tg.Meta[MetaWeight] != "2" {
+		t.Errorf("unexpected target %+v", tg)
+	}
+	if tg := byHost["::1"]; tg.Port != 8480 || tg.URI != "/insert/0/prometheus/api/v1/write" || tg.Meta[MetaSource] != "file" {
+		t.Errorf("unexpected target %+v", tg)
+	}
+
+	writeFile(t, filepath.Join(dir, "c.yml"), `- targets: ["10.0.0.3"]`)
+	if _, err := f.Discover(); err == nil {
+		t.Error("expected an error for a target without a port")
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "upstreams.yml")
+	writeFile(t, path, `- targets: ["10.0.0.1:8428"]`)
+
+	f := &File{Patterns: []string{path}}
+	changed := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Watch(ctx, func() { changed <- struct{}{} })
+
+	// Give the watcher time to start, then replace the file like a deploy would
+	time.Sleep(100 * time.Millisecond)
+	writeFile(t, path+".new", `- targets: ["10.0.0.1:8428", "10.0.0.2:8428"]`)
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification after the file changed")
+	}
+
+	targets, err := f.Discover()
+	if err != nil || len(targets) != 2 {
+		t.Fatalf("expected 2 targets after the change, got %v %v", targets, err)
+	}
+}
@@ -0,0 +1,216 @@
+package vmdiscovery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	listersdiscoveryv1beta1 "k8s.io/client-go/listers/discovery/v1beta1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// kubeResync how often the informers replay their whole cache
+const kubeResync = 10 * time.Minute
+
+// kubeZoneLabel topology key holding the zone of an endpoint
+const kubeZoneLabel = "topology.kubernetes.io/zone"
+
+//Kubernetes discovers upstreams from the ready endpoints of labelled services
+//
+// Watch keeps informers on the EndpointSlices and services so changes are seen straight away,
+// Discover reads from their caches once they synced and from the API server before that.
+type Kubernetes struct {
+	Config utility.KubernetesSDConfig
+	Client kubernetes.Interface
+
+	mu       sync.Mutex
+	slices   listersdiscoveryv1beta1.EndpointSliceLister // slices set while Watch runs
+	services listerscorev1.ServiceLister                 // services set while Watch runs
+}
+
+//NewKubernetes connects to the cluster with the kubeconfig file or the in-cluster configuration
+func NewKubernetes(config utility.KubernetesSDConfig) (*Kubernetes, error) {
+	var rc *rest.Config
+	var err error
+	if config.KubeConfig != "" {
+		rc, err = clientcmd.BuildConfigFromFlags("", config.KubeConfig)
+	} else {
+		rc, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes client configuration: %v", err)
+	}
+
+	client, err := kubernetes.NewForConfig(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Kubernetes{Config: config, Client: client}, nil
+}
+
+//Name identifies the discoverer in logs
+func (k *Kubernetes) Name() string {
+	return "kubernetes"
+}
+
+//Discover returns the ready endpoints of the selected services
+func (k *Kubernetes) Discover() ([]Target, error) {
+	selector, err := labels.Parse(k.Config.KubeSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	slices, services := k.slices, k.services
+	k.mu.Unlock()
+
+	var serviceList []*corev1.Service
+	var sliceList []*discoveryv1beta1.EndpointSlice
+
+	if slices != nil {
+		if serviceList, err = services.List(selector); err != nil {
+			return nil, err
+		}
+		if sliceList, err = slices.List(labels.Everything()); err != nil {
+			return nil, err
+		}
+	} else {
+		ctx := context.Background()
+		sl, err := k.Client.CoreV1().Services(k.Config.KubeNamespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, err
+		}
+		for i := range sl.Items {
+			serviceList = append(serviceList, &sl.Items[i])
+		}
+		el, err := k.Client.DiscoveryV1beta1().EndpointSlices(k.Config.KubeNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range el.Items {
+			sliceList = append(sliceList, &el.Items[i])
+		}
+	}
+
+	// Slices carry the name of their service in a well known label
+	byService := make(map[string][]*discoveryv1beta1.EndpointSlice)
+	for _, s := range sliceList {
+		key := s.Namespace + "/" + s.Labels[discoveryv1beta1.LabelServiceName]
+		byService[key] = append(byService[key], s)
+	}
+
+	var targets []Target
+	for _, svc := range serviceList {
+		for _, s := range byService[svc.Namespace+"/"+svc.Name] {
+			targets = append(targets, k.targets(svc, s)...)
+		}
+	}
+
+	SortTargets(targets)
+	return targets, nil
+}
+
+//Watch runs informers on the services and EndpointSlices and calls notify on every change
+func (k *Kubernetes) Watch(ctx context.Context, notify func()) {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.Client, kubeResync, informers.WithNamespace(k.Config.KubeNamespace))
+	slices := factory.Discovery().V1beta1().EndpointSlices()
+	services := factory.Core().V1().Services()
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { notify() },
+		UpdateFunc: func(old, obj interface{}) {
+			// Resyncs replay objects that did not change
+			o, ok1 := old.(metav1.Object)
+			n, ok2 := obj.(metav1.Object)
+			if ok1 && ok2 && o.GetResourceVersion() == n.GetResourceVersion() {
+				return
+			}
+			notify()
+		},
+		DeleteFunc: func(obj interface{}) { notify() },
+	}
+	slices.Informer().AddEventHandler(handler)
+	services.Informer().AddEventHandler(handler)
+
+	factory.Start(ctx.Done())
+	for t, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			log.Error().Str("service", discoveryservice).Msgf("Kubernetes cache of %v did not sync", t)
+			return
+		}
+	}
+
+	k.mu.Lock()
+	k.slices, k.services = slices.Lister(), services.Lister()
+	k.mu.Unlock()
+
+	<-ctx.Done()
+
+	k.mu.Lock()
+	k.slices, k.services = nil, nil
+	k.mu.Unlock()
+}
+
+// targets the ready endpoints of one slice, the port and URI come from the service annotations like the EC2 tags
+func (k *Kubernetes) targets(svc *corev1.Service, s *discoveryv1beta1.EndpointSlice) []Target {
+	uri := "/api/v1/write"
+	if v, ok := svc.Annotations[k.Config.KubeURIAnnotation]; ok {
+		uri = v
+	}
+
+	port, ok := slicePort(s, svc.Annotations[k.Config.KubePortAnnotation])
+	if !ok {
+		log.Error().Str("service", discoveryservice).Msgf("No port %q on the endpoints of service %s/%s", svc.Annotations[k.Config.KubePortAnnotation], svc.Namespace, svc.Name)
+		return nil
+	}
+
+	var targets []Target
+	for _, e := range s.Endpoints {
+		// Endpoints without a condition are ready
+		if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+			continue
+		}
+
+		meta := make(map[string]string)
+		if e.TargetRef != nil {
+			meta[MetaName] = e.TargetRef.Name
+			meta[MetaInstanceID] = string(e.TargetRef.UID)
+		}
+		if zone, ok := e.Topology[kubeZoneLabel]; ok {
+			meta[MetaZone] = zone
+		}
+
+		for _, address := range e.Addresses {
+			targets = append(targets, Target{Host: address, Port: port, URI: uri, Meta: withMeta(meta, MetaSource, "kubernetes")})
+		}
+	}
+	return targets
+}
+
+// slicePort finds the port named or numbered by want, the first port of the slice when want is empty
+func slicePort(s *discoveryv1beta1.EndpointSlice, want string) (int, bool) {
+	for _, p := range s.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if want == "" || (p.Name != nil && *p.Name == want) || strconv.Itoa(int(*p.Port)) == want {
+			return int(*p.Port), true
+		}
+	}
+	return 0, false
+}
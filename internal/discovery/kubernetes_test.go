@@ -0,0 +1,121 @@
+package vmdiscovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func kubeService(name string, labels map[string]string, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "metrics", Labels: labels, Annotations: annotations}}
+}
+
+func kubeSlice(service string, ready map[string]bool) *discoveryv1beta1.EndpointSlice {
+	name, port := "http", int32(8428)
+	s := &discoveryv1beta1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service + "-abcde",
+			Namespace: "metrics",
+			Labels:    map[string]string{discoveryv1beta1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1beta1.AddressTypeIPv4,
+		Ports:       []discoveryv1beta1.EndpointPort{{Name: &name, Port: &port}},
+	}
+	for address, r := range ready {
+		r := r
+		s.Endpoints = append(s.Endpoints, discoveryv1beta1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1beta1.EndpointConditions{Ready: &r},
+			Topology:   map[string]string{kubeZoneLabel: "us-west-2a"},
+		})
+	}
+	return s
+}
+
+func TestKubernetesDiscover(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		kubeService("vmstorage", map[string]string{"app": "victoriametrics"}, map[string]string{"ClusterVMPort": "http", "ClusterVMURI": "/write"}),
+		kubeSlice("vmstorage", map[string]bool{"10.1.0.1": true, "10.1.0.2": true, "10.1.0.3": false}),
+		kubeService("other", map[string]string{"app": "other"}, nil),
+		kubeSlice("other", map[string]bool{"10.2.0.1": true}),
+	)
+
+	config := utility.DefaultConfig().KubernetesSDConfig
+	config.KubeSelector = "app=victoriametrics"
+	config.KubeNamespace = "metrics"
+	k := &Kubernetes{Config: config, Client: client}
+
+	targets, err := k.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected the 2 ready endpoints, got %v", targets)
+	}
+	if tg := targets[0]; tg.Host != "10.1.0.1" || tg.Port != 8428 || tg.URI != "/write" || tg.Meta[MetaZone] != "us-west-2a" {
+		t.Errorf("unexpected target %+v", tg)
+	}
+
+	changed := make(chan struct{}, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go k.Watch(ctx, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	// Wait for the informers to sync and drain the notifications of the initial list
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		k.mu.Lock()
+		synced := k.slices != nil
+		k.mu.Unlock()
+		if synced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("informers did not sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for len(changed) > 0 {
+		<-changed
+	}
+
+	// An endpoint that stops being ready is removed without waiting for a poll
+	updated := kubeSlice("vmstorage", map[string]bool{"10.1.0.1": true, "10.1.0.2": false})
+	updated.ResourceVersion = "2"
+	if _, err := client.DiscoveryV1beta1().EndpointSlices("metrics").Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification when the endpoints changed")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		targets, err := k.Discover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(targets) == 1 && targets[0].Host == "10.1.0.1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only 10.1.0.1 to be left, got %v", targets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
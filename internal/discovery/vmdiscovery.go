@@ -0,0 +1,153 @@
+//Package vmdiscovery provides the service discovery mechanisms used to find upstreams
+package vmdiscovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Metadata keys set by the discoverers
+const (
+	//MetaSource name of the discoverer that found the target
+	MetaSource = "source"
+	//MetaInstanceID cloud instance id of the target
+	MetaInstanceID = "instance_id"
+	//MetaName human readable name of the target
+	MetaName = "name"
+	//MetaRegion cloud region of the target
+	MetaRegion = "region"
+	//MetaZone availability zone of the target
+	MetaZone = "zone"
+	//MetaWeight relative share of the series the target should receive
+	MetaWeight = "weight"
+)
+
+//Target an upstream found by a discoverer
+type Target struct {
+	Host string
+	Port int
+	URI  string
+	Meta map[string]string // Meta metadata about the target, see the Meta constants
+
+	Draining bool // Draining the target is going away and should receive no new writes
+}
+
+//Key identifies the target, two targets with the same key are the same upstream
+func (t Target) Key() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port)) + t.URI
+}
+
+//Discoverer finds the upstreams to write to
+type Discoverer interface {
+	// Name identifies the discoverer in logs
+	Name() string
+	// Discover returns every target currently known
+	Discover() ([]Target, error)
+}
+
+//Watcher is implemented by discoverers that learn about changes between polls
+type Watcher interface {
+	// Watch watches for changes until ctx is done and calls notify whenever the targets changed
+	Watch(ctx context.Context, notify func())
+}
+
+//Multi combines several discoverers into one
+type Multi struct {
+	Discoverers []Discoverer
+
+	mu   sync.Mutex
+	last map[int][]Target // last targets found by each discoverer, by index
+}
+
+//Name identifies the discoverer in logs
+func (m *Multi) Name() string {
+	return "multi"
+}
+
+//Discover returns the targets of every discoverer, a target found by several of them is
+//returned once.  A discoverer that fails is skipped and the targets it found last are used,
+//so one source that can not be reached neither removes its upstreams nor hides the upstreams
+//of the others.  Discovery only fails when every discoverer fails.
+func (m *Multi) Discover() ([]Target, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last == nil {
+		m.last = make(map[int][]Target)
+	}
+
+	seen := make(map[string]bool)
+	var targets []Target
+	var errs []string
+	for i, d := range m.Discoverers {
+		found, err := d.Discover()
+		if err != nil {
+			log.Error().Err(err).Str("service", discoveryservice).Msgf("%s discovery failed, keeping the %d upstreams it found last", d.Name(), len(m.last[i]))
+			errs = append(errs, fmt.Sprintf("%s discovery: %v", d.Name(), err))
+			found = m.last[i]
+		} else {
+			m.last[i] = found
+		}
+		for _, t := range found {
+			if seen[t.Key()] {
+				continue
+			}
+			seen[t.Key()] = true
+			targets = append(targets, t)
+		}
+	}
+	if len(errs) == len(m.Discoverers) {
+		return nil, errors.New(strings.Join(errs, ", "))
+	}
+	return targets, nil
+}
+
+//Watch runs the watches of the discoverers that support it
+func (m *Multi) Watch(ctx context.Context, notify func()) {
+	for _, d := range m.Discoverers {
+		if w, ok := d.(Watcher); ok {
+			go w.Watch(ctx, notify)
+		}
+	}
+	<-ctx.Done()
+}
+
+//Static a fixed list of targets
+type Static []Target
+
+//Name identifies the discoverer in logs
+func (s Static) Name() string {
+	return "static"
+}
+
+//Discover returns the fixed targets
+func (s Static) Discover() ([]Target, error) {
+	targets := make([]Target, 0, len(s))
+	for _, t := range s {
+		t.Meta = withMeta(t.Meta, MetaSource, "static")
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// withMeta returns a copy of meta with key set to value
+func withMeta(meta map[string]string, key string, value string) map[string]string {
+	out := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+//SortTargets sorts targets by key so results are stable between polls
+func SortTargets(targets []Target) {
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Key() < targets[j].Key() })
+}
@@ -0,0 +1,69 @@
+package vmdiscovery
+
+import (
+	"errors"
+	"testing"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// flaky a discoverer that fails while err is set
+type flaky struct {
+	targets []Target
+	err     error
+}
+
+func (f *flaky) Name() string { return "flaky" }
+
+func (f *flaky) Discover() ([]Target, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.targets, nil
+}
+
+func TestMultiSkipsFailingDiscoverer(t *testing.T) {
+	ec2 := &flaky{err: errors.New("no credentials")}
+	m := &Multi{Discoverers: []Discoverer{ec2, Static{{Host: "10.0.0.1", Port: 8428, URI: "/api/v1/write"}}}}
+
+	// A source that never worked does not hide the upstreams of the others
+	targets, err := m.Discover()
+	if err != nil || len(targets) != 1 || targets[0].Host != "10.0.0.1" {
+		t.Fatalf("expected the static upstream, got %v %v", targets, err)
+	}
+
+	// A source that stops working keeps the upstreams it found last
+	ec2.err = nil
+	ec2.targets = []Target{{Host: "10.0.0.2", Port: 8428, URI: "/api/v1/write"}}
+	if targets, _ := m.Discover(); len(targets) != 2 {
+		t.Fatalf("expected both upstreams, got %v", targets)
+	}
+	ec2.err = errors.New("throttled")
+	if targets, err := m.Discover(); err != nil || len(targets) != 2 {
+		t.Errorf("expected the upstreams of the failing source to be kept, got %v %v", targets, err)
+	}
+
+	// Only when every source fails does discovery fail
+	all := &Multi{Discoverers: []Discoverer{&flaky{err: errors.New("down")}, &flaky{err: errors.New("down")}}}
+	if _, err := all.Discover(); err == nil {
+		t.Error("expected an error when every discoverer fails")
+	}
+}
+
+func TestFromConfigLeavesEC2Off(t *testing.T) {
+	config := utility.DefaultConfig()
+	config.FileSDFiles = []string{"targets/*.yml"}
+
+	d, err := FromConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(*File); !ok {
+		t.Errorf("expected only file discovery without EC2 enabled, got %T", d)
+	}
+
+	config.AWSDiscoveryEnabled = true
+	if d, _ := FromConfig(&config); d.(*Multi).Discoverers[0].Name() != "ec2" {
+		t.Errorf("expected EC2 discovery once enabled, got %+v", d)
+	}
+}
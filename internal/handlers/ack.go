@@ -0,0 +1,128 @@
+package vmhandlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	writesNotAcknowledged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_writes_not_acknowledged_total",
+		Help: "The total number of remote write requests answered with an error because the write consistency was not met",
+	}, []string{"code"})
+)
+
+// writeOutcome result of one forward as far as acknowledging the write is concerned
+type writeOutcome struct {
+	forward   HTTPForward
+	ok        bool   // ok the upstream accepted the write or it was durably queued
+	retryable bool   // retryable the failure may go away if prometheus sends the write again
+	reason    string // reason why the forward failed
+}
+
+// resultOutcome converts the response of a forward into an outcome
+func resultOutcome(r *HTTPResponse) writeOutcome {
+	o := writeOutcome{forward: r.forward, retryable: retryable(r)}
+	switch {
+	case r.err != nil:
+		o.reason = fmt.Sprintf("%s: %v", r.url, r.err)
+	case r.response == nil:
+		o.reason = fmt.Sprintf("%s: empty response", r.url)
+	case r.response.StatusCode/100 == 2:
+		o.ok = true
+	default:
+		o.reason = fmt.Sprintf("%s: upstream returned %s", r.url, r.response.Status)
+	}
+	return o
+}
+
+// ackStatus decides the status code for prometheus from the outcomes of the forwards
+//
+// Every series must have been accepted by any, a quorum or all of the upstreams it was sent to.
+// Failures that may succeed on a retry are answered with a 5xx so prometheus retries, failures
+// where the upstreams refused the payload are answered with a 400 so it does not.
+func ackStatus(consistency string, seriesCount int, hostCount int, outcomes []writeOutcome) (int, string) {
+
+	if len(outcomes) == 0 {
+		if hostCount == 0 {
+			writesNotAcknowledged.WithLabelValues("503").Inc()
+			return http.StatusServiceUnavailable, "no upstreams available"
+		}
+		// Nothing had to be sent
+		return http.StatusOK, ""
+	}
+
+	// A write without series (metadata only) is treated as a single unit
+	units := seriesCount
+	if units == 0 {
+		units = 1
+	}
+	succeeded := make([]int, units)
+	total := make([]int, units)
+
+	retry := false
+	reason := ""
+	for _, o := range outcomes {
+		if !o.ok {
+			retry = retry || o.retryable
+			if reason == "" {
+				reason = o.reason
+			}
+		}
+
+		if o.forward.seriesIdx == nil {
+			for i := range total {
+				total[i]++
+				if o.ok {
+					succeeded[i]++
+				}
+			}
+			continue
+		}
+		for _, i := range o.forward.seriesIdx {
+			total[i]++
+			if o.ok {
+				succeeded[i]++
+			}
+		}
+	}
+
+	for i := range total {
+		if total[i] == 0 {
+			// The pool of the series has no upstreams, it may have some on the next try
+			writesNotAcknowledged.WithLabelValues("503").Inc()
+			return http.StatusServiceUnavailable, "no upstreams available for some series"
+		}
+		if !consistencyMet(consistency, succeeded[i], total[i]) {
+			code := http.StatusBadRequest
+			if retry {
+				code = http.StatusServiceUnavailable
+			}
+			writesNotAcknowledged.WithLabelValues(fmt.Sprint(code)).Inc()
+			return code, fmt.Sprintf("write consistency %s not met (%d of %d upstreams accepted): %s",
+				consistency, succeeded[i], total[i], reason)
+		}
+	}
+
+	return http.StatusOK, ""
+}
+
+// consistencyMet whether enough upstreams accepted a series
+func consistencyMet(consistency string, succeeded int, total int) bool {
+	if total == 0 {
+		return false
+	}
+	switch consistency {
+	case utility.WriteConsistencyAll:
+		return succeeded == total
+	case utility.WriteConsistencyQuorum:
+		return succeeded >= total/2+1
+	default:
+		return succeeded >= 1
+	}
+}
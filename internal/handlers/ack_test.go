@@ -0,0 +1,56 @@
+package vmhandlers
+
+import (
+	"net/http"
+	"testing"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestAckStatus(t *testing.T) {
+	ok := writeOutcome{ok: true}
+	down := writeOutcome{retryable: true, reason: "connection refused"}
+	rejected := writeOutcome{reason: "400 Bad Request"}
+
+	tests := []struct {
+		name        string
+		consistency string
+		outcomes    []writeOutcome
+		want        int
+	}{
+		{"any one ok", utility.WriteConsistencyAny, []writeOutcome{ok, down, down}, http.StatusOK},
+		{"any none ok", utility.WriteConsistencyAny, []writeOutcome{down, down}, http.StatusServiceUnavailable},
+		{"quorum met", utility.WriteConsistencyQuorum, []writeOutcome{ok, ok, down}, http.StatusOK},
+		{"quorum missed", utility.WriteConsistencyQuorum, []writeOutcome{ok, down, down}, http.StatusServiceUnavailable},
+		{"all met", utility.WriteConsistencyAll, []writeOutcome{ok, ok}, http.StatusOK},
+		{"all missed", utility.WriteConsistencyAll, []writeOutcome{ok, down}, http.StatusServiceUnavailable},
+		{"bad payload", utility.WriteConsistencyAll, []writeOutcome{ok, rejected}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		if got, reason := ackStatus(tt.consistency, 2, len(tt.outcomes), tt.outcomes); got != tt.want {
+			t.Errorf("%s: expected %d, got %d (%s)", tt.name, tt.want, got, reason)
+		}
+	}
+
+	if got, _ := ackStatus(utility.WriteConsistencyAny, 2, 0, nil); got != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without upstreams, got %d", got)
+	}
+}
+
+func TestAckStatusSharded(t *testing.T) {
+	// Series 0 lives on a and b, series 1 on b and c
+	a := writeOutcome{ok: true, forward: HTTPForward{seriesIdx: []int{0}}}
+	b := writeOutcome{retryable: true, forward: HTTPForward{seriesIdx: []int{0, 1}}}
+	c := writeOutcome{ok: true, forward: HTTPForward{seriesIdx: []int{1}}}
+
+	if got, _ := ackStatus(utility.WriteConsistencyAny, 2, 3, []writeOutcome{a, b, c}); got != http.StatusOK {
+		t.Errorf("every series has a copy, expected 200 got %d", got)
+	}
+
+	c.ok = false
+	c.retryable = true
+	if got, _ := ackStatus(utility.WriteConsistencyAny, 2, 3, []writeOutcome{a, b, c}); got != http.StatusServiceUnavailable {
+		t.Errorf("series 1 has no copy, expected 503 got %d", got)
+	}
+}
@@ -0,0 +1,170 @@
+package vmhandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+)
+
+const admin = "admin"
+
+//DrainStatus drain progress of the upstreams on a host
+type DrainStatus struct {
+	Host       string              `json:"host"`
+	SafeToStop bool                `json:"safe_to_stop"` // SafeToStop drained with nothing left to deliver
+	Upstreams  []UpstreamDrainInfo `json:"upstreams"`
+}
+
+//UpstreamDrainInfo drain progress of a single upstream
+type UpstreamDrainInfo struct {
+	URL          string `json:"url"`
+	Draining     bool   `json:"draining"`
+	AdminDrained bool   `json:"admin_drained"`
+	InFlight     int    `json:"in_flight"`
+	QueuedWrites int    `json:"queued_writes"`
+	QueuedBytes  int64  `json:"queued_bytes"`
+}
+
+//DrainHandler drains every upstream on a host at POST /admin/upstreams/{host}/drain
+func (ctx *PromHTTPHandlerContext) DrainHandler(w http.ResponseWriter, r *http.Request) {
+	host := mux.Vars(r)["host"]
+
+	upstreams, err := ctx.setAdminDrain(host, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Deliver what is queued now rather than after the current backoff
+	if ctx.pQueues != nil {
+		for _, u := range upstreams {
+			for upstream := range ctx.pQueues.QueuesWithPrefix(u.BaseURL() + "/") {
+				ctx.pQueues.Flush(upstream)
+			}
+		}
+	}
+
+	log.Info().Str("service", admin).Msgf("Drain of %s requested by %s", host, r.RemoteAddr)
+	ctx.writeDrainStatus(w, host, upstreams, http.StatusAccepted)
+}
+
+//UndrainHandler puts every upstream on a host back in service at DELETE /admin/upstreams/{host}/drain
+func (ctx *PromHTTPHandlerContext) UndrainHandler(w http.ResponseWriter, r *http.Request) {
+	host := mux.Vars(r)["host"]
+
+	upstreams, err := ctx.setAdminDrain(host, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Info().Str("service", admin).Msgf("Undrain of %s requested by %s", host, r.RemoteAddr)
+	ctx.writeDrainStatus(w, host, upstreams, http.StatusOK)
+}
+
+//DrainStatusHandler reports whether a host is safe to stop at GET /admin/upstreams/{host}/drain
+func (ctx *PromHTTPHandlerContext) DrainStatusHandler(w http.ResponseWriter, r *http.Request) {
+	host := mux.Vars(r)["host"]
+
+	var upstreams []vmupstreams.VMUpstream
+	for _, pool := range ctx.allPools() {
+		upstreams = append(upstreams, pool.UpstreamsByHost(host)...)
+	}
+	if len(upstreams) == 0 {
+		http.Error(w, "upstream "+host+" not found", http.StatusNotFound)
+		return
+	}
+
+	ctx.writeDrainStatus(w, host, upstreams, http.StatusOK)
+}
+
+// setAdminDrain drains or undrains the host in every pool it is in
+func (ctx *PromHTTPHandlerContext) setAdminDrain(host string, drain bool) ([]vmupstreams.VMUpstream, error) {
+	var upstreams []vmupstreams.VMUpstream
+	for _, pool := range ctx.allPools() {
+		found, err := pool.SetAdminDrain(host, drain)
+		if err == nil {
+			upstreams = append(upstreams, found...)
+		}
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("upstream %s not found", host)
+	}
+	return upstreams, nil
+}
+
+// writeDrainStatus reports the drain progress of the upstreams as json
+func (ctx *PromHTTPHandlerContext) writeDrainStatus(w http.ResponseWriter, host string, upstreams []vmupstreams.VMUpstream, code int) {
+	status := ctx.drainStatus(host, upstreams)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Error().Err(err).Str("service", admin).Msg("Error writing drain status")
+	}
+}
+
+// drainStatus a host is safe to stop once all its upstreams are drained, no writes are
+// being sent to them and their retry queues are empty
+func (ctx *PromHTTPHandlerContext) drainStatus(host string, upstreams []vmupstreams.VMUpstream) DrainStatus {
+	status := DrainStatus{Host: host, SafeToStop: true}
+
+	for _, u := range upstreams {
+		info := UpstreamDrainInfo{
+			URL:          u.URL(),
+			Draining:     u.IsDraining(),
+			AdminDrained: u.AdminDrained,
+			InFlight:     ctx.inflightCount(u.URL()),
+		}
+		if ctx.pQueues != nil {
+			// Writes queued for every tenant of the upstream count
+			for _, q := range ctx.pQueues.QueuesWithPrefix(u.BaseURL() + "/") {
+				info.QueuedWrites += q.Len()
+				info.QueuedBytes += q.Bytes()
+			}
+		}
+
+		if !info.Draining || info.InFlight > 0 || info.QueuedWrites > 0 {
+			status.SafeToStop = false
+		}
+		status.Upstreams = append(status.Upstreams, info)
+	}
+
+	return status
+}
+
+// trackInflight counts the forwards as in flight until the returned func is called
+func (ctx *PromHTTPHandlerContext) trackInflight(forwards []HTTPForward) func() {
+	ctx.inflightMu.Lock()
+	defer ctx.inflightMu.Unlock()
+
+	if ctx.inflight == nil {
+		ctx.inflight = make(map[string]int)
+	}
+	for _, f := range forwards {
+		ctx.inflight[f.URL]++
+	}
+
+	return func() {
+		ctx.inflightMu.Lock()
+		defer ctx.inflightMu.Unlock()
+		for _, f := range forwards {
+			ctx.inflight[f.URL]--
+			if ctx.inflight[f.URL] == 0 {
+				delete(ctx.inflight, f.URL)
+			}
+		}
+	}
+}
+
+// inflightCount writes currently being sent or queued for the upstream
+func (ctx *PromHTTPHandlerContext) inflightCount(upstream string) int {
+	ctx.inflightMu.Lock()
+	defer ctx.inflightMu.Unlock()
+	return ctx.inflight[upstream]
+}
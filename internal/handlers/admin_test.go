@@ -0,0 +1,128 @@
+package vmhandlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestDrainHandler(t *testing.T) {
+	config := staticConfig()
+	config.StaticUpstreams = append(config.StaticUpstreams, utility.StaticUpstream{Host: "127.0.0.2", Port: 8428, URI: "/api/v1/write"})
+	var upstreams vmupstreams.VMUpstreams
+	if err := upstreams.VMUpstreamsInitialize(&config); err != nil {
+		t.Fatal(err)
+	}
+	ctx := PCTXHandlerContext(&upstreams, &config)
+	if err := ctx.EnableRetryQueue(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/upstreams/{host}/drain", ctx.DrainHandler).Methods("POST")
+	r.HandleFunc("/admin/upstreams/{host}/drain", ctx.UndrainHandler).Methods("DELETE")
+	r.HandleFunc("/admin/upstreams/{host}/drain", ctx.DrainStatusHandler).Methods("GET")
+
+	call := func(method string, host string, code int) DrainStatus {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/admin/upstreams/"+host+"/drain", nil))
+		if w.Code != code {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, host, code, w.Code, w.Body)
+		}
+		var status DrainStatus
+		if code != http.StatusNotFound {
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return status
+	}
+
+	call("POST", "10.9.9.9", http.StatusNotFound)
+	if status := call("GET", "127.0.0.1", http.StatusOK); status.SafeToStop {
+		t.Error("an upstream in service is not safe to stop")
+	}
+
+	// A write already routed to the upstream holds up the drain
+	url := upstreams.UpstreamsByHost("127.0.0.1")[0].URL()
+	done := ctx.trackInflight([]HTTPForward{{URL: url}})
+	status := call("POST", "127.0.0.1", http.StatusAccepted)
+	if status.SafeToStop || len(status.Upstreams) != 1 || status.Upstreams[0].InFlight != 1 {
+		t.Fatalf("expected the in flight write to be reported, got %+v", status)
+	}
+	if hosts, _ := upstreams.GetActiveHostList(); len(hosts) != 1 || hosts[0] == url {
+		t.Fatalf("expected the drained upstream to get no new writes, got %v", hosts)
+	}
+	done()
+	if status := call("GET", "127.0.0.1", http.StatusOK); !status.SafeToStop {
+		t.Errorf("expected the drained upstream to be safe to stop, got %+v", status)
+	}
+
+	// Rediscovery keeps the drain, undraining puts it back in service
+	if err := upstreams.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+	if upstreams.GetRing().Len() != 1 {
+		t.Fatalf("expected the drain to survive a discovery refresh, ring has %d nodes", upstreams.GetRing().Len())
+	}
+	call("DELETE", "127.0.0.1", http.StatusOK)
+	if upstreams.GetRing().Len() != 2 {
+		t.Errorf("expected both upstreams in the ring, got %d", upstreams.GetRing().Len())
+	}
+}
+
+func TestAdminHandlerNeedsAdminClient(t *testing.T) {
+	config := staticConfig()
+	var upstreams vmupstreams.VMUpstreams
+	if err := upstreams.VMUpstreamsInitialize(&config); err != nil {
+		t.Fatal(err)
+	}
+	ctx := PCTXHandlerContext(&upstreams, &config)
+
+	r := mux.NewRouter()
+	r.Handle("/admin/upstreams/{host}/drain", ctx.AdminHandler(http.HandlerFunc(ctx.DrainHandler))).Methods("POST")
+
+	drain := func(username string, password string) int {
+		req := httptest.NewRequest("POST", "/admin/upstreams/127.0.0.1/drain", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Without admin clients the admin api is off, also for writers that can authenticate
+	if code := drain("", ""); code != http.StatusForbidden {
+		t.Errorf("expected a drain without admin clients to be refused, got %d", code)
+	}
+	config.Clients = []utility.AuthClient{{Name: "prometheus", Username: "prometheus", Password: "write"}}
+	ctx.pConfigs.Store(&config)
+	if code := drain("prometheus", "write"); code != http.StatusForbidden {
+		t.Errorf("expected a drain without admin clients to be refused, got %d", code)
+	}
+
+	config.Clients = append(config.Clients, utility.AuthClient{Name: "ops", Username: "ops", Password: "secret", Admin: true})
+	ctx.pConfigs.Store(&config)
+	for _, creds := range [][2]string{{"", ""}, {"ops", "wrong"}, {"prometheus", "write"}} {
+		if code := drain(creds[0], creds[1]); code != http.StatusUnauthorized {
+			t.Errorf("expected a drain as %q to be refused, got %d", creds[0], code)
+		}
+	}
+	if upstreams.GetRing().Len() != 1 {
+		t.Fatal("expected a refused drain to leave the upstream in service")
+	}
+	if code := drain("ops", "secret"); code != http.StatusAccepted {
+		t.Errorf("expected a drain by the admin client to be accepted, got %d", code)
+	}
+	if upstreams.GetRing().Len() != 0 {
+		t.Error("expected the upstream to be drained")
+	}
+}
@@ -0,0 +1,80 @@
+package vmhandlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	authFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmwriter_auth_failed_total",
+		Help: "The total number of remote write requests rejected because the client could not be authenticated",
+	})
+)
+
+// authenticate returns the client sending the request, nil when no clients are configured, ok is
+// false when clients are configured and the request does not carry valid credentials for one of them
+func authenticate(clients []utility.AuthClient, r *http.Request) (*utility.AuthClient, bool) {
+	if len(clients) == 0 {
+		return nil, true
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		for i, c := range clients {
+			if c.Username != "" && secureEqual(c.Username, username) && secureEqual(c.Password, password) {
+				return &clients[i], true
+			}
+		}
+		return nil, false
+	}
+
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		for i, c := range clients {
+			if c.BearerToken != "" && secureEqual(c.BearerToken, token) {
+				return &clients[i], true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// secureEqual compares credentials in constant time
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+//AdminHandler serves next only to requests authenticated as one of the clients marked admin, the
+//admin endpoints are refused when no client is
+func (ctx *PromHTTPHandlerContext) AdminHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var admins []utility.AuthClient
+		for _, c := range ctx.pConfigs.Load().Clients {
+			if c.Admin {
+				admins = append(admins, c)
+			}
+		}
+		if len(admins) == 0 {
+			log.Warn().Str("service", admin).Msgf("Refusing %s %s from %s, no admin clients are configured", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "admin api disabled, no admin clients are configured", http.StatusForbidden)
+			return
+		}
+
+		client, ok := authenticate(admins, r)
+		if !ok {
+			log.Warn().Str("service", admin).Msgf("Rejecting unauthenticated %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="vmwriter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		log.Info().Str("service", admin).Msgf("%s %s by client %s", r.Method, r.URL.Path, client.Name)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,144 @@
+package vmhandlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	writesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_writes_rejected_total",
+		Help: "The total number of remote write requests rejected because of what they contain, by reason",
+	}, []string{"reason"})
+)
+
+// sourceLabels the labels added to every series of the request, later ones win: the external
+// labels, the labels of the client, the name of the client and the address the write came from
+func sourceLabels(labels utility.LabelsConfig, client *utility.AuthClient, r *http.Request) map[string]string {
+	out := make(map[string]string, len(labels.ExternalLabels))
+	for name, value := range labels.ExternalLabels {
+		out[name] = value
+	}
+	if client != nil {
+		for name, value := range client.Labels {
+			out[name] = value
+		}
+		if labels.ClientLabel != "" {
+			out[labels.ClientLabel] = client.Name
+		}
+	}
+	if labels.SourceIPLabel != "" {
+		out[labels.SourceIPLabel] = sourceIP(labels.SourceIPHeader, r)
+	}
+	return out
+}
+
+// sourceIP address the write came from, the first address in header when it is set so
+// proxies can pass on the address of the client
+func sourceIP(header string, r *http.Request) string {
+	if header != "" {
+		if first := strings.TrimSpace(strings.Split(r.Header.Get(header), ",")[0]); first != "" {
+			return first
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// injectLabels sets the labels on every series, replacing the values that were sent
+func injectLabels(wr *prompb.WriteRequest, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	for i := range wr.Timeseries {
+		ts := &wr.Timeseries[i]
+	next:
+		for name, value := range labels {
+			for j := range ts.Labels {
+				if ts.Labels[j].Name == name {
+					ts.Labels[j].Value = value
+					continue next
+				}
+			}
+			ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: value})
+		}
+		sort.Slice(ts.Labels, func(a, b int) bool { return ts.Labels[a].Name < ts.Labels[b].Name })
+	}
+}
+
+// checkRequiredLabels returns an error naming a series that lacks one of the required labels,
+// a label with an empty value is missing as well
+func checkRequiredLabels(wr *prompb.WriteRequest, required []string) error {
+	if len(required) == 0 {
+		return nil
+	}
+
+	count := 0
+	var example string
+	var exampleMissing []string
+	for i := range wr.Timeseries {
+		ts := &wr.Timeseries[i]
+		var missing []string
+		for _, name := range required {
+			if labelValue(ts, name) == "" {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if count == 0 {
+			example = seriesString(ts)
+			exampleMissing = missing
+		}
+		count++
+	}
+
+	if count == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d series are missing required labels, for example %s is missing %s",
+		count, len(wr.Timeseries), example, strings.Join(exampleMissing, ", "))
+}
+
+func labelValue(ts *prompb.TimeSeries, name string) string {
+	for _, l := range ts.Labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// seriesString formats the series the way Prometheus does, metric{label="value"}
+func seriesString(ts *prompb.TimeSeries) string {
+	var b strings.Builder
+	b.WriteString(labelValue(ts, "__name__"))
+	b.WriteByte('{')
+	first := true
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			continue
+		}
+		if !first {
+			b.WriteString(", ")
+		}
+		first = false
+		fmt.Fprintf(&b, "%s=%q", l.Name, l.Value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
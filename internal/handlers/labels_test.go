@@ -0,0 +1,59 @@
+package vmhandlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestInjectLabels(t *testing.T) {
+	labels := utility.LabelsConfig{
+		ExternalLabels: map[string]string{"env": "prod", "region": "us-west-2"},
+		ClientLabel:    "client",
+		SourceIPLabel:  "source_ip",
+		SourceIPHeader: "X-Forwarded-For",
+	}
+	client := &utility.AuthClient{Name: "team-a", Labels: map[string]string{"env": "staging"}}
+
+	r := httptest.NewRequest("POST", "/api/v1/write", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+
+	wr := tenantSeries("")
+	wr.Timeseries[0].Labels = append(wr.Timeseries[0].Labels, prompb.Label{Name: "client", Value: "spoofed"})
+	injectLabels(wr, sourceLabels(labels, client, r))
+
+	want := `up{client="team-a", env="staging", instance="a", region="us-west-2", source_ip="10.1.2.3"}`
+	if got := seriesString(&wr.Timeseries[0]); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	// Behind a proxy the first address in the header is the client
+	r.Header.Set("X-Forwarded-For", "192.168.0.9, 10.0.0.1")
+	if got := sourceLabels(labels, nil, r); got["source_ip"] != "192.168.0.9" || got["client"] != "" || got["env"] != "prod" {
+		t.Errorf("unexpected labels without a client %v", got)
+	}
+}
+
+func TestCheckRequiredLabels(t *testing.T) {
+	wr := tenantSeries("1", "", "2")
+	if err := checkRequiredLabels(wr, nil); err != nil {
+		t.Errorf("expected no error without required labels, got %v", err)
+	}
+
+	err := checkRequiredLabels(wr, []string{"instance", "vm_account_id"})
+	if err == nil {
+		t.Fatal("expected the series without vm_account_id to be rejected")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "1 of 3 series") || !strings.Contains(msg, `up{instance="b"} is missing vm_account_id`) {
+		t.Errorf("unexpected error %q", msg)
+	}
+
+	// An empty value is the same as no label at all
+	wr.Timeseries[1].Labels = append(wr.Timeseries[1].Labels, prompb.Label{Name: "vm_account_id"})
+	if err := checkRequiredLabels(wr, []string{"vm_account_id"}); err == nil {
+		t.Error("expected the empty label to be rejected")
+	}
+}
@@ -0,0 +1,75 @@
+package vmhandlers
+
+import (
+	"net/http"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// limitKey the tenant, client or address whose limits apply to the group
+func limitKey(config *utility.VConfig, g *writeGroup, client *utility.AuthClient, r *http.Request) string {
+	switch config.LimitsBy {
+	case utility.LimitByClient:
+		if client == nil {
+			return ""
+		}
+		return client.Name
+	case utility.LimitBySourceIP:
+		return sourceIP(config.SourceIPHeader, r)
+	}
+	return g.tenant
+}
+
+// limit checks every group against the limits of its tenant
+//
+// With the drop action the series over a limit are removed from the groups and their indexes in
+// the received request are returned.  With the reject action the first tenant over a limit and the
+// limit it hit are returned, and nothing of the write may be sent.
+func (ctx *PromHTTPHandlerContext) limit(config *utility.VConfig, client *utility.AuthClient, r *http.Request, groups []writeGroup) (kept []writeGroup, dropped []int, key string, rejected string) {
+	if config.LimitsBy == "" {
+		return groups, nil, "", ""
+	}
+	if config.LimitsAction == utility.LimitActionReject {
+		key, rejected = ctx.limitAll(config, client, r, groups)
+		if rejected != "" {
+			return nil, nil, key, rejected
+		}
+		return groups, nil, "", ""
+	}
+
+	kept = groups[:0]
+	for i := range groups {
+		g := groups[i]
+		keep, _ := ctx.pLimits.Admit(&config.LimitsConfig, limitKey(config, &g, client, r), g.request)
+		if keep != nil {
+			wr := &prompb.WriteRequest{Unknown: g.request.Unknown, Timeseries: make([]prompb.TimeSeries, 0, len(keep))}
+			for _, j := range keep {
+				wr.Timeseries = append(wr.Timeseries, g.request.Timeseries[j])
+			}
+			dropped = append(dropped, g.retain(wr, keep)...)
+			if len(wr.Timeseries) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, g)
+	}
+	return kept, dropped, "", ""
+}
+
+// limitAll checks the series of every tenant in the write and only records them when no tenant
+// is over a limit, so a rejected write is not counted against the tenants that were within theirs
+func (ctx *PromHTTPHandlerContext) limitAll(config *utility.VConfig, client *utility.AuthClient, r *http.Request, groups []writeGroup) (key string, rejected string) {
+	// Groups can share a tenant, when limiting by client or address they all do
+	writes := make(map[string]*prompb.WriteRequest)
+	for i := range groups {
+		k := limitKey(config, &groups[i], client, r)
+		wr, ok := writes[k]
+		if !ok {
+			wr = &prompb.WriteRequest{}
+			writes[k] = wr
+		}
+		wr.Timeseries = append(wr.Timeseries, groups[i].request.Timeseries...)
+	}
+	return ctx.pLimits.AdmitAll(&config.LimitsConfig, writes)
+}
@@ -0,0 +1,84 @@
+package vmhandlers
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	vmlimits "github.dev.pages/infrastructure/vmwriter/internal/limits"
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestLimitGroups(t *testing.T) {
+	config := utility.DefaultConfig()
+	config.TenantSources = []string{utility.TenantSourceLabel}
+	config.LimitsBy = utility.LimitByTenant
+	config.LimitsAction = utility.LimitActionDrop
+	config.MaxActiveSeries = 1
+
+	ctx := &PromHTTPHandlerContext{pLimits: vmlimits.New()}
+	r := httptest.NewRequest("POST", "/api/v1/write", nil)
+
+	groups, err := splitTenants(config.TenantConfig, r, tenantSeries("1", "2", "1", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tenant 1 may only write its first series, tenant 2 is within its limit
+	groups, dropped, _, rejected := ctx.limit(&config, nil, r, groups)
+	if rejected != "" || fmt.Sprint(dropped) != "[2 3]" {
+		t.Fatalf("expected series 2 and 3 to be dropped, got %v %s", dropped, rejected)
+	}
+	for _, g := range groups {
+		if len(g.request.Timeseries) != 1 || len(g.seriesIdx) != 1 {
+			t.Errorf("tenant %s kept %d series %v, expected one", g.tenant, len(g.request.Timeseries), g.seriesIdx)
+		}
+	}
+
+	// Rejecting stops at the first tenant over its limit
+	config.LimitsAction = utility.LimitActionReject
+	groups, _ = splitTenants(config.TenantConfig, r, tenantSeries("1", "2", "1"))
+	if _, _, key, rejected := ctx.limit(&config, nil, r, groups); key != "1" || rejected != vmlimits.ReasonActiveSeries {
+		t.Errorf("expected tenant 1 to be rejected, got %s %s", key, rejected)
+	}
+}
+
+func TestLimitRejectChargesNoTenant(t *testing.T) {
+	config := utility.DefaultConfig()
+	config.TenantSources = []string{utility.TenantSourceLabel}
+	config.LimitsBy = utility.LimitByTenant
+	config.LimitsAction = utility.LimitActionReject
+	config.MaxActiveSeries = 2
+	config.MaxSamplesPerSecond = 1
+	config.RateBurstSeconds = 2
+	config.LimitOverrides = map[string]utility.Limit{"2": {MaxActiveSeries: 1, MaxSamplesPerSecond: 1}}
+
+	ctx := &PromHTTPHandlerContext{pLimits: vmlimits.New()}
+	r := httptest.NewRequest("POST", "/api/v1/write", nil)
+
+	// Tenant 1 is within its limits, tenant 2 writes two new series where it may have one
+	wr := tenantSeries("1", "2", "2")
+	wr.Timeseries[0].Samples = make([]prompb.Sample, 3)
+	groups, err := splitTenants(config.TenantConfig, r, wr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, key, rejected := ctx.limit(&config, nil, r, groups); key != "2" || rejected != vmlimits.ReasonActiveSeries {
+		t.Fatalf("expected tenant 2 to be rejected, got %q %q", key, rejected)
+	}
+
+	// The rejected write is sent again as a whole, tenant 1 was not charged for the first try
+	if got := ctx.pLimits.ActiveSeries("1"); got != 0 {
+		t.Errorf("expected no active series for tenant 1, got %d", got)
+	}
+	wr = tenantSeries("1")
+	wr.Timeseries[0].Samples = make([]prompb.Sample, 3)
+	groups, _ = splitTenants(config.TenantConfig, r, wr)
+	if _, _, key, rejected := ctx.limit(&config, nil, r, groups); rejected != "" {
+		t.Errorf("expected tenant 1 to still have its tokens, got %s %s", key, rejected)
+	}
+	if got := ctx.pLimits.ActiveSeries("1"); got != 1 {
+		t.Errorf("expected 1 active series for tenant 1, got %d", got)
+	}
+}
@@ -0,0 +1,116 @@
+package vmhandlers
+
+import (
+	"fmt"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+//SetPools sets the named upstream pools the routing rules send series to, must be called before serving writes
+func (ctx *PromHTTPHandlerContext) SetPools(pools map[string]*vmupstreams.VMUpstreams) {
+	ctx.pPools = pools
+}
+
+// pool returns the upstreams of the named pool, nil when there is no such pool
+func (ctx *PromHTTPHandlerContext) pool(name string) *vmupstreams.VMUpstreams {
+	if name == utility.DefaultPool {
+		return ctx.pUpstream
+	}
+	return ctx.pPools[name]
+}
+
+// allPools the default pool followed by the named pools
+func (ctx *PromHTTPHandlerContext) allPools() []*vmupstreams.VMUpstreams {
+	all := []*vmupstreams.VMUpstreams{ctx.pUpstream}
+	for _, p := range ctx.pPools {
+		all = append(all, p)
+	}
+	return all
+}
+
+// checkPools makes sure the configuration only routes to the pools that are running, adding or
+// removing pools needs a restart
+func (ctx *PromHTTPHandlerContext) checkPools(config *utility.VConfig) error {
+	if len(config.Pools) != len(ctx.pPools) {
+		return fmt.Errorf("adding or removing pools requires a restart")
+	}
+	for _, p := range config.Pools {
+		if _, ok := ctx.pPools[p.Name]; !ok {
+			return fmt.Errorf("adding pool %s requires a restart", p.Name)
+		}
+	}
+	return nil
+}
+
+// routeGroups splits every group further by the pools its series are routed to
+//
+// The first rule matching a series decides its pools, series no rule matches go to the default
+// pool.  A series sent to several pools is in the group of each of them.
+func routeGroups(rules []utility.RoutingRule, groups []writeGroup) []writeGroup {
+	if len(rules) == 0 {
+		for i := range groups {
+			groups[i].pool = utility.DefaultPool
+		}
+		return groups
+	}
+
+	var out []writeGroup
+	for _, g := range groups {
+		pools := make(map[string]*writeGroup)
+		var order []string
+		for i := range g.request.Timeseries {
+			ts := &g.request.Timeseries[i]
+			for _, pool := range seriesPools(rules, ts) {
+				p, ok := pools[pool]
+				if !ok {
+					p = &writeGroup{tenant: g.tenant, pool: pool, request: &prompb.WriteRequest{Unknown: g.request.Unknown}}
+					pools[pool] = p
+					order = append(order, pool)
+				}
+				p.request.Timeseries = append(p.request.Timeseries, *ts)
+				idx := i
+				if g.seriesIdx != nil {
+					idx = g.seriesIdx[i]
+				}
+				p.seriesIdx = append(p.seriesIdx, idx)
+			}
+		}
+
+		// Every series of the group goes to the same single pool, keep the group as it is
+		if len(order) == 1 && len(pools[order[0]].seriesIdx) == len(g.request.Timeseries) {
+			g.pool = order[0]
+			out = append(out, g)
+			continue
+		}
+		if len(order) == 0 {
+			// Metadata only
+			g.pool = utility.DefaultPool
+			out = append(out, g)
+			continue
+		}
+		for _, pool := range order {
+			out = append(out, *pools[pool])
+		}
+	}
+	return out
+}
+
+// seriesPools the pools of the first rule matching the series, the default pool when none does
+func seriesPools(rules []utility.RoutingRule, ts *prompb.TimeSeries) []string {
+	label := func(name string) string {
+		for _, l := range ts.Labels {
+			if l.Name == name {
+				return l.Value
+			}
+		}
+		return ""
+	}
+	for i := range rules {
+		if rules[i].Matches(label) {
+			return rules[i].Pools
+		}
+	}
+	return []string{utility.DefaultPool}
+}
@@ -0,0 +1,105 @@
+package vmhandlers
+
+import (
+	"testing"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmrelabel "github.dev.pages/infrastructure/vmwriter/internal/relabel"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestRouteGroups(t *testing.T) {
+	config := staticConfig()
+	config.Pools = []utility.PoolConfig{{Name: "dev"}, {Name: "ltr"}}
+	for i := range config.Pools {
+		config.Pools[i].DiscoveryConfig = staticConfig().DiscoveryConfig
+	}
+	config.Rules = []utility.RoutingRule{
+		{Match: map[string]string{"environment": "dev"}, Pools: []string{"dev"}},
+		{MatchRE: map[string]string{"__name__": "long_.*"}, Pools: []string{utility.DefaultPool, "ltr"}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	series := func(name string, env string) prompb.TimeSeries {
+		return prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: name}, {Name: "environment", Value: env}}}
+	}
+	wr := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		series("up", "prod"),
+		series("up", "dev"),
+		series("long_term", "prod"),
+		series("long_term", "dev"),
+		series("not_long_term", "prod"),
+	}}
+
+	// The tenant split already picked out series 1 to 4
+	groups := []writeGroup{{tenant: "1", request: &prompb.WriteRequest{Timeseries: wr.Timeseries[1:]}, seriesIdx: []int{1, 2, 3, 4}}}
+	got := make(map[string][]int)
+	for _, g := range routeGroups(config.Rules, groups) {
+		if g.tenant != "1" || len(g.seriesIdx) != len(g.request.Timeseries) {
+			t.Fatalf("unexpected group %+v", g)
+		}
+		got[g.pool] = g.seriesIdx
+	}
+	want := map[string][]int{"dev": {1, 3}, utility.DefaultPool: {2, 4}, "ltr": {2}}
+	for pool, idx := range want {
+		if len(got[pool]) != len(idx) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+		for i := range idx {
+			if got[pool][i] != idx[i] {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		}
+	}
+
+	// A write that only goes to one pool is left alone
+	groups = routeGroups(config.Rules, []writeGroup{{request: &prompb.WriteRequest{Timeseries: wr.Timeseries[:1]}}})
+	if len(groups) != 1 || groups[0].pool != utility.DefaultPool || groups[0].seriesIdx != nil {
+		t.Errorf("expected the write to stay whole, got %+v", groups)
+	}
+}
+
+func TestRoutingRulesValidate(t *testing.T) {
+	for _, rule := range []utility.RoutingRule{
+		{Pools: []string{"missing"}},
+		{Match: map[string]string{"team": "a"}},
+		{MatchRE: map[string]string{"__name__": "("}, Pools: []string{utility.DefaultPool}},
+	} {
+		config := staticConfig()
+		config.Rules = []utility.RoutingRule{rule}
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected rule %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestWriteGroupRelabel(t *testing.T) {
+	configs := []utility.RelabelConfig{utility.DefaultRelabelConfig()}
+	configs[0].SourceLabels = []string{"environment"}
+	configs[0].Regex = "dev"
+	configs[0].Action = utility.RelabelDrop
+	r, err := vmrelabel.New(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wr := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "environment", Value: "dev"}}},
+		{Labels: []prompb.Label{{Name: "environment", Value: "prod"}}},
+		{Labels: []prompb.Label{{Name: "environment", Value: "dev"}}},
+	}}
+	g := writeGroup{pool: "ltr", request: wr, seriesIdx: []int{3, 5, 7}}
+
+	dropped := g.relabel(r)
+	if len(dropped) != 2 || dropped[0] != 3 || dropped[1] != 7 {
+		t.Errorf("expected series 3 and 7 of the received request to be dropped, got %v", dropped)
+	}
+	if len(g.request.Timeseries) != 1 || len(g.seriesIdx) != 1 || g.seriesIdx[0] != 5 {
+		t.Errorf("expected only series 5 to be left, got %v", g.seriesIdx)
+	}
+	if len(wr.Timeseries) != 3 {
+		t.Error("the request shared with other pools must not change")
+	}
+}
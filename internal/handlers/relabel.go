@@ -0,0 +1,144 @@
+package vmhandlers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmrelabel "github.dev.pages/infrastructure/vmwriter/internal/relabel"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	relabelDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_relabel_dropped_series_total",
+		Help: "The total number of series dropped by relabeling, rules is global or the pool or upstream whose write relabeling dropped them",
+	}, []string{"rules"})
+)
+
+// relabelers compiled relabel configs of one configuration
+type relabelers struct {
+	config *utility.VConfig
+	global *vmrelabel.Relabeler
+	pools  map[string]*vmrelabel.Relabeler // pools write relabeling by pool name
+
+	upstreams map[string]map[string]*vmrelabel.Relabeler // upstreams write relabeling of static upstreams by pool name and upstream url
+}
+
+// relabelersFor returns the compiled relabel configs of config, compiling them once per configuration
+func (ctx *PromHTTPHandlerContext) relabelersFor(config *utility.VConfig) (*relabelers, error) {
+	if r, ok := ctx.pRelabel.Load().(*relabelers); ok && r.config == config {
+		return r, nil
+	}
+
+	r := &relabelers{
+		config:    config,
+		pools:     make(map[string]*vmrelabel.Relabeler),
+		upstreams: make(map[string]map[string]*vmrelabel.Relabeler),
+	}
+	var err error
+	if r.global, err = vmrelabel.New(config.RelabelConfigs); err != nil {
+		return nil, err
+	}
+	if r.pools[utility.DefaultPool], err = vmrelabel.New(config.WriteRelabelConfigs); err != nil {
+		return nil, err
+	}
+	if r.upstreams[utility.DefaultPool], err = upstreamRelabelers(config.StaticUpstreams); err != nil {
+		return nil, err
+	}
+	for _, p := range config.Pools {
+		if r.pools[p.Name], err = vmrelabel.New(p.WriteRelabelConfigs); err != nil {
+			return nil, err
+		}
+		if r.upstreams[p.Name], err = upstreamRelabelers(p.DiscoveryConfig.StaticUpstreams); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx.pRelabel.Store(r)
+	return r, nil
+}
+
+// upstreamRelabelers compiles the write relabeling of the static upstreams that have any by upstream url
+func upstreamRelabelers(static []utility.StaticUpstream) (map[string]*vmrelabel.Relabeler, error) {
+	rules := make(map[string]*vmrelabel.Relabeler)
+	for _, u := range static {
+		r, err := vmrelabel.New(u.WriteRelabelConfigs)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			upstream := vmupstreams.VMUpstream{Host: u.Host, Port: u.Port, URI: u.URI}
+			rules[upstream.URL()] = r
+		}
+	}
+	return rules, nil
+}
+
+// relabel applies the write relabeling of the group's pool and returns the indexes of the
+// dropped series in the received request
+func (g *writeGroup) relabel(r *vmrelabel.Relabeler) []int {
+	wr, kept := r.Apply(g.request)
+	if kept == nil {
+		g.request = wr
+		return nil
+	}
+
+	dropped := g.retain(wr, kept)
+	relabelDropped.WithLabelValues(g.pool).Add(float64(len(dropped)))
+	return dropped
+}
+
+// relabelForwards applies the write relabeling of each upstream to the forward for it, returns the
+// forwards left with series to send and outcomes for the series the upstreams dropped
+func relabelForwards(forwards []HTTPForward, rules map[string]*vmrelabel.Relabeler) ([]HTTPForward, []writeOutcome) {
+	if len(rules) == 0 {
+		return forwards, nil
+	}
+
+	var dropped []writeOutcome
+	kept := forwards[:0]
+	for _, f := range forwards {
+		r := rules[f.URL]
+		if r == nil {
+			kept = append(kept, f)
+			continue
+		}
+
+		wr, keptSeries := r.Apply(f.WriteRequest)
+		if keptSeries != nil {
+			orig := func(i int) int {
+				if f.seriesIdx == nil {
+					return i
+				}
+				return f.seriesIdx[i]
+			}
+
+			// Series the upstream drops count as written to it
+			seriesIdx := make([]int, 0, len(keptSeries))
+			var droppedIdx []int
+			next := 0
+			for i := range f.WriteRequest.Timeseries {
+				if next < len(keptSeries) && keptSeries[next] == i {
+					seriesIdx = append(seriesIdx, orig(i))
+					next++
+					continue
+				}
+				droppedIdx = append(droppedIdx, orig(i))
+			}
+			relabelDropped.WithLabelValues(f.URL).Add(float64(len(droppedIdx)))
+			dropped = append(dropped, writeOutcome{forward: HTTPForward{URL: f.URL, seriesIdx: droppedIdx}, ok: true})
+
+			if len(seriesIdx) == 0 {
+				continue
+			}
+			f.seriesIdx = seriesIdx
+		}
+
+		f.WriteRequest = wr
+		f.ReqBody = prompb.EncodeWriteRequest(wr)
+		kept = append(kept, f)
+	}
+	return kept, dropped
+}
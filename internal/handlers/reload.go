@@ -0,0 +1,133 @@
+package vmhandlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_config_reloads_total",
+		Help: "The total number of configuration reloads by result",
+	}, []string{"result"})
+
+	configLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vmwriter_config_last_reload_successful",
+		Help: "Whether the last configuration reload succeeded",
+	})
+
+	configLastReloadSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vmwriter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+)
+
+const reloader = "reloader"
+
+//SetConfigLoader sets the function used to read the configuration again on reload
+func (ctx *PromHTTPHandlerContext) SetConfigLoader(loader func() (utility.VConfig, error)) {
+	ctx.reloadMu.Lock()
+	defer ctx.reloadMu.Unlock()
+	ctx.configLoader = loader
+}
+
+//Reload reads the configuration again and swaps it in without touching the listener,
+//an invalid configuration is rejected and the one in use is kept
+func (ctx *PromHTTPHandlerContext) Reload() error {
+	ctx.reloadMu.Lock()
+	defer ctx.reloadMu.Unlock()
+
+	if ctx.configLoader == nil {
+		return errors.New("reloading is not configured")
+	}
+
+	config, err := ctx.configLoader()
+	if err != nil {
+		log.Error().Err(err).Str("service", reloader).Msg("Rejected new configuration, keeping the current one")
+		configReloads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+
+	// Discovery of every pool is set up first, if any of them fails nothing changes
+	var pending []*vmupstreams.PendingConfig
+	err = ctx.checkPools(&config)
+	if err == nil {
+		var p *vmupstreams.PendingConfig
+		p, err = ctx.pUpstream.PrepareConfig(&config)
+		pending = append(pending, p)
+	}
+	for name, pool := range ctx.pPools {
+		if err != nil {
+			break
+		}
+		poolConfig, _ := config.PoolConfig(name)
+		var p *vmupstreams.PendingConfig
+		if p, err = pool.PrepareConfig(&poolConfig); err != nil {
+			err = fmt.Errorf("pool %s: %v", name, err)
+		}
+		pending = append(pending, p)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("service", reloader).Msg("Rejected new configuration, keeping the current one")
+		configReloads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+
+	for _, p := range pending {
+		p.Apply()
+	}
+
+	old := ctx.pConfigs.Load()
+	warnRestartRequired(old, &config)
+
+	ctx.pConfigs.Store(&config)
+	ctx.setClient(&config)
+
+	// Discovery settings may have changed, pick up the new upstreams now instead of on the next poll
+	go func() {
+		for _, pool := range ctx.allPools() {
+			if err := pool.LoadUpstreams(); err != nil {
+				log.Error().Err(err).Str("service", reloader).Msg("Error loading upstreams after reload")
+			}
+		}
+	}()
+
+	log.Info().Str("service", reloader).Msg("Configuration reloaded")
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+
+	return nil
+}
+
+//ReloadHandler reloads the configuration at POST /-/reload
+func (ctx *PromHTTPHandlerContext) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ctx.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("configuration reloaded\n"))
+}
+
+// warnRestartRequired logs settings that changed but only take effect after a restart
+func warnRestartRequired(old *utility.VConfig, config *utility.VConfig) {
+	if old.ListenerConfig != config.ListenerConfig {
+		log.Warn().Str("service", reloader).Msg("Listener changes require a restart")
+	}
+	if old.QueueConfig != config.QueueConfig {
+		log.Warn().Str("service", reloader).Msg("Queue changes require a restart")
+	}
+	if old.ServerReadTimeoutSeconds != config.ServerReadTimeoutSeconds || old.ServerWriteTimeoutSeconds != config.ServerWriteTimeoutSeconds {
+		log.Warn().Str("service", reloader).Msg("Timeout changes require a restart")
+	}
+}
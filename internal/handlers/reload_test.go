@@ -0,0 +1,140 @@
+package vmhandlers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// staticConfig default configuration discovering a single static upstream instead of EC2
+func staticConfig() utility.VConfig {
+	c := utility.DefaultConfig()
+	c.AWSDiscoveryEnabled = false
+	c.StaticUpstreams = []utility.StaticUpstream{{Host: "127.0.0.1", Port: 8428, URI: "/api/v1/write"}}
+	return c
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	config := staticConfig()
+	var upstreams vmupstreams.VMUpstreams
+	if err := upstreams.SetConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	ctx := PCTXHandlerContext(&upstreams, &config)
+
+	if err := ctx.Reload(); err == nil {
+		t.Fatal("expected an error reloading without a loader")
+	}
+
+	ctx.SetConfigLoader(func() (utility.VConfig, error) {
+		return utility.VConfig{}, errors.New("bad config")
+	})
+	if err := ctx.Reload(); err == nil {
+		t.Fatal("expected the bad config to be rejected")
+	}
+	if ctx.pConfigs.Load().RoutingMode != utility.RoutingReplicate {
+		t.Fatal("the old configuration should be kept")
+	}
+
+	// No discovery at all can not be set up either
+	ctx.SetConfigLoader(func() (utility.VConfig, error) {
+		c := staticConfig()
+		c.StaticUpstreams = nil
+		c.RoutingMode = utility.RoutingShard
+		return c, nil
+	})
+	if err := ctx.Reload(); err == nil {
+		t.Fatal("expected a configuration without discovery to be rejected")
+	}
+	if ctx.pConfigs.Load().RoutingMode != utility.RoutingReplicate {
+		t.Fatal("the old configuration should be kept")
+	}
+
+	ctx.SetConfigLoader(func() (utility.VConfig, error) {
+		c := staticConfig()
+		c.RoutingMode = utility.RoutingShard
+		c.ReplicationFactor = 2
+		return c, nil
+	})
+	if err := ctx.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.pConfigs.Load().RoutingMode != utility.RoutingShard {
+		t.Error("the new configuration should be in use")
+	}
+	if upstreams.GetRing().ReplicationFactor() != 2 {
+		t.Error("the upstreams should use the new replication factor")
+	}
+}
+
+func TestReloadKeepsEveryPoolWhenOnePoolFails(t *testing.T) {
+	config := staticConfig()
+	config.Pools = []utility.PoolConfig{{Name: "dev", DiscoveryConfig: config.DiscoveryConfig}}
+
+	var upstreams, dev vmupstreams.VMUpstreams
+	if err := upstreams.SetConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	devConfig, _ := config.PoolConfig("dev")
+	if err := dev.SetConfig(&devConfig); err != nil {
+		t.Fatal(err)
+	}
+	ctx := PCTXHandlerContext(&upstreams, &config)
+	ctx.SetPools(map[string]*vmupstreams.VMUpstreams{"dev": &dev})
+
+	// The default pool is fine, the dev pool can not reach its cluster
+	ctx.SetConfigLoader(func() (utility.VConfig, error) {
+		c := staticConfig()
+		c.StaticUpstreams = []utility.StaticUpstream{{Host: "127.0.0.2", Port: 8428, URI: "/api/v1/write"}}
+		c.RoutingMode = utility.RoutingShard
+		broken := c.DiscoveryConfig
+		broken.KubeSelector = "app=victoriametrics"
+		broken.KubeConfig = "/nonexistent/kubeconfig"
+		c.Pools = []utility.PoolConfig{{Name: "dev", DiscoveryConfig: broken}}
+		return c, nil
+	})
+	if err := ctx.Reload(); err == nil {
+		t.Fatal("expected the broken pool to be rejected")
+	}
+
+	if ctx.pConfigs.Load().RoutingMode != utility.RoutingReplicate {
+		t.Error("the old configuration should be kept")
+	}
+	current := upstreams.CurrentConfig()
+	if current.RoutingMode != utility.RoutingReplicate || current.StaticUpstreams[0].Host != "127.0.0.1" {
+		t.Errorf("the default pool switched to the rejected configuration: %+v", current.StaticUpstreams)
+	}
+	if err := upstreams.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+	if hosts, _ := upstreams.GetActiveHostList(); len(hosts) != 1 || hosts[0] != "http://127.0.0.1:8428/api/v1/write" {
+		t.Errorf("the default pool discovers %v, expected the old upstream", hosts)
+	}
+}
+
+func TestReloadAppliesUpstreamTimeout(t *testing.T) {
+	config := staticConfig()
+	var upstreams vmupstreams.VMUpstreams
+	if err := upstreams.SetConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	ctx := PCTXHandlerContext(&upstreams, &config)
+	if ctx.client().Timeout != 3*time.Second {
+		t.Fatalf("expected the configured timeout, got %v", ctx.client().Timeout)
+	}
+
+	ctx.SetConfigLoader(func() (utility.VConfig, error) {
+		c := staticConfig()
+		c.HTTPTimeOut = 10
+		return c, nil
+	})
+	if err := ctx.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.client().Timeout != 10*time.Second {
+		t.Errorf("expected forwards to use the reloaded timeout, got %v", ctx.client().Timeout)
+	}
+}
@@ -0,0 +1,139 @@
+package vmhandlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	vmqueue "github.dev.pages/infrastructure/vmwriter/internal/queue"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+)
+
+var (
+	eventsQueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmwriter_events_queued_total",
+		Help: "The total number of writes stored in the retry queue",
+	})
+
+	eventsQueueFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmwriter_events_queue_failed_total",
+		Help: "The total number of writes that could not be stored in the retry queue",
+	})
+)
+
+//EnableRetryQueue stores failed writes on disk under dir and replays them when the upstream recovers
+func (ctx *PromHTTPHandlerContext) EnableRetryQueue(dir string, maxBytes int64) error {
+	maxAge := time.Duration(ctx.pConfigs.Load().QueueMaxAgeSeconds) * time.Second
+	m, err := vmqueue.NewManager(dir, maxBytes, maxAge, ctx.sendQueued)
+	if err != nil {
+		return err
+	}
+	ctx.pQueues = m
+	return nil
+}
+
+// queueBehindPending queues the forwards of upstreams that are still replaying and
+// returns the forwards that can be sent straight away along with the outcome of the queued ones
+func (ctx *PromHTTPHandlerContext) queueBehindPending(forwards []HTTPForward) ([]HTTPForward, []writeOutcome) {
+	if ctx.pQueues == nil {
+		return forwards, nil
+	}
+
+	direct := forwards[:0:0]
+	var outcomes []writeOutcome
+	for _, forward := range forwards {
+		if ctx.pQueues.Pending(forward.target()) {
+			ok := ctx.enqueue(forward)
+			outcomes = append(outcomes, writeOutcome{forward: forward, ok: ok, retryable: true, reason: "retry queue full"})
+			continue
+		}
+		direct = append(direct, forward)
+	}
+	return direct, outcomes
+}
+
+// enqueue stores a forward in its upstream's retry queue, returns whether it was stored
+func (ctx *PromHTTPHandlerContext) enqueue(forward HTTPForward) bool {
+	if ctx.pQueues == nil {
+		return false
+	}
+
+	// Queued by the url it is posted to so the replay reaches the same tenant
+	if err := ctx.pQueues.Enqueue(forward.target(), forward.ReqBody); err != nil {
+		log.Error().Err(err).Str("service", publisher).Msgf("Error queueing write for %s", forward.target())
+		eventsQueueFailed.Inc()
+		return false
+	}
+	eventsQueued.Inc()
+	return true
+}
+
+// retryable whether a failed forward is worth trying again, timeouts, connection
+// errors, 5xx and 429 are, other 4xx mean the upstream will never take the payload
+func retryable(r *HTTPResponse) bool {
+	if r.err != nil {
+		return true
+	}
+	if r.response == nil {
+		return false
+	}
+	return r.response.StatusCode >= 500 || r.response.StatusCode == http.StatusTooManyRequests
+}
+
+// sendQueued replays a queued write to its upstream, through the upstream's circuit breaker
+func (ctx *PromHTTPHandlerContext) sendQueued(upstream string, body []byte) error {
+	req, err := newUpstreamRequest(upstream, body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", vmqueue.ErrRejected, err)
+	}
+
+	breaker := ctx.queueBreaker(upstream)
+	if !breaker.Allow() {
+		return errBreakerOpen
+	}
+
+	resp, err := ctx.client().Do(req)
+	if err != nil {
+		breaker.Failure()
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		breaker.Failure()
+	} else {
+		breaker.Success()
+	}
+
+	r := &HTTPResponse{url: upstream, response: resp}
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	if !retryable(r) {
+		return fmt.Errorf("%w: %s", vmqueue.ErrRejected, resp.Status)
+	}
+	return fmt.Errorf("upstream returned %s", resp.Status)
+}
+
+// queueBreaker the circuit breaker of the upstream a queue is for, queues are kept by the url
+// written to so they may be for a tenant of the upstream.  nil, which allows every write, when
+// no pool has the upstream any more.
+func (ctx *PromHTTPHandlerContext) queueBreaker(target string) *vmupstreams.Breaker {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil
+	}
+	for _, pool := range ctx.allPools() {
+		for _, upstream := range pool.UpstreamsByHost(u.Hostname()) {
+			if target == upstream.URL() || strings.HasPrefix(target, upstream.BaseURL()+"/") {
+				return pool.Breaker(upstream.URL())
+			}
+		}
+	}
+	return nil
+}
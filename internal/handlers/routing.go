@@ -0,0 +1,116 @@
+package vmhandlers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	forwardedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_forwarded_bytes_total",
+		Help: "Bytes of writes forwarded by availability zone of the upstream, cross_zone tells whether they left our own zone",
+	}, []string{"zone", "cross_zone"})
+)
+
+//buildForwards splits a write request into the forwards for each upstream based on the routing mode
+//
+// With zone aware routing the series are placed per zone instead, see routingZone.
+func buildForwards(routing utility.RoutingConfig, ring *vmupstreams.Ring, hostList []string, wr *prompb.WriteRequest) []HTTPForward {
+
+	var httpforwards []HTTPForward
+
+	if len(hostList) == 0 {
+		return httpforwards
+	}
+
+	zone := routingZone(routing)
+
+	var place func(seriesHash uint64) []string
+	switch {
+	case routing.RoutingMode == utility.RoutingShard:
+		place = func(h uint64) []string { return ring.LookupZone(h, zone) }
+	case zone != "":
+		place = func(h uint64) []string { return ring.ReplicateZone(h, zone) }
+	}
+
+	if place == nil {
+		// Every upstream receives the same request so only encode it once
+		encodedBody := prompb.EncodeWriteRequest(wr)
+
+		for _, host := range hostList {
+
+			// Forwards to use for upstreams
+			var httpforward HTTPForward
+			httpforward.URL = host
+			httpforward.WriteRequest = wr
+			httpforward.ReqBody = encodedBody
+			httpforwards = append(httpforwards, httpforward)
+		}
+		return httpforwards
+	}
+
+	// Place every series on its nodes in the hash ring
+	shards := make(map[string]*prompb.WriteRequest)
+	shardSeries := make(map[string][]int)
+	for i, ts := range wr.Timeseries {
+		for _, node := range place(ts.LabelsHash()) {
+			shard, ok := shards[node]
+			if !ok {
+				// Metadata is small and not tied to a series, every shard gets a copy
+				shard = &prompb.WriteRequest{Unknown: wr.Unknown}
+				shards[node] = shard
+			}
+			shard.Timeseries = append(shard.Timeseries, ts)
+			shardSeries[node] = append(shardSeries[node], i)
+		}
+	}
+
+	for _, node := range ring.Nodes() {
+		shard, ok := shards[node]
+		if !ok {
+			continue
+		}
+		var httpforward HTTPForward
+		httpforward.URL = node
+		httpforward.WriteRequest = shard
+		httpforward.seriesIdx = shardSeries[node]
+		httpforward.ReqBody = prompb.EncodeWriteRequest(shard)
+		httpforwards = append(httpforwards, httpforward)
+	}
+
+	return httpforwards
+}
+
+// routingZone the zone to keep writes in, empty when zone aware routing does not apply
+//
+// Sharding keeps the first copy of each series in the zone.  Replicating can only skip upstreams
+// when a single acknowledgement is enough, then every upstream in the zone and one upstream in
+// each other zone receive each series.
+func routingZone(routing utility.RoutingConfig) string {
+	if !routing.ZoneAware {
+		return ""
+	}
+	if routing.RoutingMode != utility.RoutingShard && routing.WriteConsistency != utility.WriteConsistencyAny {
+		return ""
+	}
+	return routing.Zone
+}
+
+// countForwardedBytes adds the size of every forward to the bytes of the zone of its upstream
+func countForwardedBytes(routing utility.RoutingConfig, ring *vmupstreams.Ring, httpforwards []HTTPForward) {
+	for _, f := range httpforwards {
+		zone := ring.Zone(f.URL)
+		cross := "unknown"
+		if routing.Zone != "" && zone != "" {
+			cross = "false"
+			if zone != routing.Zone {
+				cross = "true"
+			}
+		}
+		forwardedBytes.WithLabelValues(zone, cross).Add(float64(len(f.ReqBody)))
+	}
+}
@@ -0,0 +1,113 @@
+package vmhandlers
+
+import (
+	"fmt"
+	"testing"
+
+	vmdiscovery "github.dev.pages/infrastructure/vmwriter/internal/discovery"
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestBuildForwardsZoneAware(t *testing.T) {
+	var list []vmupstreams.VMUpstream
+	for i, zone := range []string{"zone-a", "zone-a", "zone-b", "zone-b"} {
+		list = append(list, vmupstreams.VMUpstream{Host: fmt.Sprintf("10.0.0.%d", i+1), Port: 8428, URI: "/api/v1/write", Status: true,
+			Meta: map[string]string{vmdiscovery.MetaZone: zone}})
+	}
+	ring := vmupstreams.NewRing(list, 1)
+
+	wr := &prompb.WriteRequest{}
+	for i := 0; i < 100; i++ {
+		wr.Timeseries = append(wr.Timeseries, prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: fmt.Sprintf("m%d", i)}}})
+	}
+
+	// copies counts the copies of the series sent to each zone
+	copies := func(routing utility.RoutingConfig) map[string]int {
+		out := make(map[string]int)
+		for _, f := range buildForwards(routing, ring, ring.Nodes(), wr) {
+			out[ring.Zone(f.URL)] += len(f.WriteRequest.Timeseries)
+		}
+		return out
+	}
+
+	routing := utility.RoutingConfig{RoutingMode: utility.RoutingReplicate, WriteConsistency: utility.WriteConsistencyAny, ZoneAware: true, Zone: "zone-a"}
+	if got := copies(routing); got["zone-a"] != 200 || got["zone-b"] != 100 {
+		t.Errorf("expected every zone-a upstream and one zone-b upstream per series, got %v", got)
+	}
+
+	routing.WriteConsistency = utility.WriteConsistencyAll
+	if got := copies(routing); got["zone-a"] != 200 || got["zone-b"] != 200 {
+		t.Errorf("expected every upstream to get every series when all must acknowledge, got %v", got)
+	}
+
+	routing = utility.RoutingConfig{RoutingMode: utility.RoutingShard, ReplicationFactor: 1, ZoneAware: true, Zone: "zone-b"}
+	if got := copies(routing); got["zone-b"] != 100 || got["zone-a"] != 0 {
+		t.Errorf("expected every series to stay in zone-b, got %v", got)
+	}
+}
+
+func TestBuildForwardsShard(t *testing.T) {
+	var list []vmupstreams.VMUpstream
+	for i := 0; i < 4; i++ {
+		list = append(list, vmupstreams.VMUpstream{Host: fmt.Sprintf("10.0.0.%d", i+1), Port: 8428, URI: "/api/v1/write", Status: true})
+	}
+	ring := vmupstreams.NewRing(list, 1)
+	routing := utility.RoutingConfig{RoutingMode: utility.RoutingShard, ReplicationFactor: 1}
+
+	series := func(i int, value float64) prompb.TimeSeries {
+		return prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: fmt.Sprintf("m%d", i)}, {Name: "job", Value: "node"}},
+			Samples: []prompb.Sample{{Value: value, Timestamp: int64(i)}},
+		}
+	}
+
+	// placement maps the name of every series to the upstreams it was sent to
+	placement := func(wr *prompb.WriteRequest) map[string][]string {
+		out := make(map[string][]string)
+		for _, f := range buildForwards(routing, ring, ring.Nodes(), wr) {
+			for _, ts := range f.WriteRequest.Timeseries {
+				out[ts.Labels[0].Value] = append(out[ts.Labels[0].Value], f.URL)
+			}
+		}
+		return out
+	}
+
+	first := &prompb.WriteRequest{}
+	for i := 0; i < 200; i++ {
+		first.Timeseries = append(first.Timeseries, series(i, 1))
+	}
+	// A later write carries new samples of the same series in another order
+	second := &prompb.WriteRequest{}
+	for i := 199; i >= 0; i-- {
+		second.Timeseries = append(second.Timeseries, series(i, 2))
+	}
+
+	before, after := placement(first), placement(second)
+	perUpstream := make(map[string]int)
+	for name, urls := range before {
+		if len(urls) != 1 {
+			t.Fatalf("expected %s on exactly one upstream, got %v", name, urls)
+		}
+		if len(after[name]) != 1 || after[name][0] != urls[0] {
+			t.Errorf("expected %s to stay on %s, got %v", name, urls[0], after[name])
+		}
+		perUpstream[urls[0]]++
+	}
+	if len(before) != 200 {
+		t.Errorf("expected every series to be sent, got %d", len(before))
+	}
+	if len(perUpstream) != len(list) {
+		t.Errorf("expected the series to be split across every upstream, got %v", perUpstream)
+	}
+
+	// With a replication factor every copy of a series lands on a different upstream
+	ring = vmupstreams.NewRing(list, 2)
+	routing.ReplicationFactor = 2
+	for name, urls := range placement(first) {
+		if len(urls) != 2 || urls[0] == urls[1] {
+			t.Errorf("expected %s on two different upstreams, got %v", name, urls)
+		}
+	}
+}
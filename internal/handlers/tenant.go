@@ -0,0 +1,193 @@
+package vmhandlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	tenantSeriesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_tenant_series_received_total",
+		Help: "The total number of time series received by tenant, none for series sent without a tenant",
+	}, []string{"tenant"})
+)
+
+// writeGroup the series of a write request that go to the same tenant on the same pool
+type writeGroup struct {
+	tenant    string               // tenant empty when the series go to the upstream URI unchanged
+	pool      string               // pool the series are routed to, see routeGroups
+	request   *prompb.WriteRequest // request the series of the group
+	seriesIdx []int                // seriesIdx indexes of the series in the received request, nil means all of them
+}
+
+// splitTenants groups the series of a write by tenant
+//
+// The sources are tried in order for every series and the first one that names a tenant wins,
+// series no source resolves get the default tenant.  The tenant label is removed from every
+// series so it does not end up stored in VictoriaMetrics.
+func splitTenants(tenants utility.TenantConfig, r *http.Request, wr *prompb.WriteRequest) ([]writeGroup, error) {
+	// Everything but the label is the same for the whole request
+	user, _, _ := r.BasicAuth()
+	values := map[string]string{
+		utility.TenantSourcePath:   mux.Vars(r)["tenant"],
+		utility.TenantSourceHeader: r.Header.Get(tenants.TenantHeader),
+		utility.TenantSourceUser:   user,
+	}
+	resolve := func(label string) (string, error) {
+		tenant := tenants.TenantDefault
+		for _, source := range tenants.TenantSources {
+			v := values[source]
+			if source == utility.TenantSourceLabel {
+				v = label
+			}
+			if v != "" {
+				tenant = v
+				break
+			}
+		}
+		if tenant != "" && !utility.ValidTenant(tenant) {
+			return "", fmt.Errorf("invalid tenant %q, expected accountID or accountID:projectID", tenant)
+		}
+		return tenant, nil
+	}
+
+	if !hasTenantSource(tenants, utility.TenantSourceLabel) || len(wr.Timeseries) == 0 {
+		tenant, err := resolve("")
+		if err != nil {
+			return nil, err
+		}
+		countTenantSeries(tenant, len(wr.Timeseries))
+		return []writeGroup{{tenant: tenant, request: wr}}, nil
+	}
+
+	groups := make(map[string]*writeGroup)
+	var order []string
+	for i := range wr.Timeseries {
+		tenant, err := resolve(removeLabel(&wr.Timeseries[i], tenants.TenantLabel))
+		if err != nil {
+			return nil, err
+		}
+
+		g, ok := groups[tenant]
+		if !ok {
+			// Metadata is small and not tied to a series, every tenant gets a copy
+			g = &writeGroup{tenant: tenant, request: &prompb.WriteRequest{Unknown: wr.Unknown}}
+			groups[tenant] = g
+			order = append(order, tenant)
+		}
+		g.request.Timeseries = append(g.request.Timeseries, wr.Timeseries[i])
+		g.seriesIdx = append(g.seriesIdx, i)
+	}
+
+	// A single tenant keeps the request as it is
+	if len(order) == 1 {
+		countTenantSeries(order[0], len(wr.Timeseries))
+		return []writeGroup{{tenant: order[0], request: wr}}, nil
+	}
+
+	out := make([]writeGroup, 0, len(order))
+	for _, tenant := range order {
+		countTenantSeries(tenant, len(groups[tenant].seriesIdx))
+		out = append(out, *groups[tenant])
+	}
+	return out, nil
+}
+
+// hasTenantSource whether the tenant may come from source
+func hasTenantSource(tenants utility.TenantConfig, source string) bool {
+	for _, s := range tenants.TenantSources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// removeLabel removes the label from the series and returns its value
+func removeLabel(ts *prompb.TimeSeries, name string) string {
+	for i, l := range ts.Labels {
+		if l.Name == name {
+			labels := make([]prompb.Label, 0, len(ts.Labels)-1)
+			labels = append(labels, ts.Labels[:i]...)
+			ts.Labels = append(labels, ts.Labels[i+1:]...)
+			return l.Value
+		}
+	}
+	return ""
+}
+
+func countTenantSeries(tenant string, n int) {
+	if tenant == "" {
+		tenant = "none"
+	}
+	tenantSeriesReceived.WithLabelValues(tenant).Add(float64(n))
+}
+
+// tenantURL the write url of the tenant on the upstream
+func tenantURL(upstream string, uri string, tenant string) string {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return upstream
+	}
+	u.Path = strings.Replace(uri, "{tenant}", tenant, -1)
+	return u.String()
+}
+
+// adopt points the forwards built for the group at the tenant's write url and back at the
+// series of the received request for the acknowledgement
+func (g *writeGroup) adopt(forwards []HTTPForward, tenantURI string) {
+	for i := range forwards {
+		f := &forwards[i]
+		if g.tenant != "" {
+			f.Target = tenantURL(f.URL, tenantURI, g.tenant)
+		}
+		if g.seriesIdx == nil {
+			continue
+		}
+		if f.seriesIdx == nil {
+			f.seriesIdx = g.seriesIdx
+			continue
+		}
+		idx := make([]int, len(f.seriesIdx))
+		for j, k := range f.seriesIdx {
+			idx[j] = g.seriesIdx[k]
+		}
+		f.seriesIdx = idx
+	}
+}
+
+// retain replaces the request of the group with wr, which holds the series at the kept indexes
+// of the current request, and returns the indexes of the other series in the received request
+func (g *writeGroup) retain(wr *prompb.WriteRequest, kept []int) []int {
+	orig := func(i int) int {
+		if g.seriesIdx == nil {
+			return i
+		}
+		return g.seriesIdx[i]
+	}
+
+	var dropped []int
+	seriesIdx := make([]int, 0, len(kept))
+	k := 0
+	for i := range g.request.Timeseries {
+		if k < len(kept) && kept[k] == i {
+			seriesIdx = append(seriesIdx, orig(i))
+			k++
+			continue
+		}
+		dropped = append(dropped, orig(i))
+	}
+
+	g.request = wr
+	g.seriesIdx = seriesIdx
+	return dropped
+}
@@ -0,0 +1,146 @@
+package vmhandlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func tenantSeries(tenants ...string) *prompb.WriteRequest {
+	wr := &prompb.WriteRequest{}
+	for i, tenant := range tenants {
+		labels := []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: string(rune('a' + i))}}
+		if tenant != "" {
+			labels = append(labels, prompb.Label{Name: "vm_account_id", Value: tenant})
+		}
+		wr.Timeseries = append(wr.Timeseries, prompb.TimeSeries{Labels: labels})
+	}
+	return wr
+}
+
+func TestSplitTenantsFromRequest(t *testing.T) {
+	tenants := utility.DefaultConfig().TenantConfig
+	tenants.TenantSources = []string{utility.TenantSourcePath, utility.TenantSourceHeader, utility.TenantSourceUser}
+
+	req := httptest.NewRequest("POST", "/insert/7/prometheus/api/v1/write", nil)
+	req.Header.Set("X-Scope-OrgID", "8")
+	req.SetBasicAuth("9", "secret")
+
+	cases := []struct {
+		vars   map[string]string
+		header bool
+		want   string
+	}{
+		{vars: map[string]string{"tenant": "7"}, header: true, want: "7"},
+		{header: true, want: "8"},
+		{want: "9"},
+	}
+	for _, c := range cases {
+		r := mux.SetURLVars(req.Clone(req.Context()), c.vars)
+		if !c.header {
+			r.Header.Del("X-Scope-OrgID")
+		}
+		writes, err := splitTenants(tenants, r, tenantSeries("", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(writes) != 1 || writes[0].tenant != c.want || writes[0].seriesIdx != nil {
+			t.Errorf("expected the whole write for tenant %s, got %+v", c.want, writes)
+		}
+	}
+
+	r := mux.SetURLVars(req, map[string]string{"tenant": "team-a"})
+	if _, err := splitTenants(tenants, r, tenantSeries("")); err == nil {
+		t.Error("expected an invalid tenant to be rejected")
+	}
+}
+
+func TestSplitTenantsByLabel(t *testing.T) {
+	tenants := utility.DefaultConfig().TenantConfig
+	tenants.TenantSources = []string{utility.TenantSourceLabel, utility.TenantSourceHeader}
+	tenants.TenantDefault = "0"
+
+	r := httptest.NewRequest("POST", "/api/v1/write", nil)
+	wr := tenantSeries("1", "", "2:5", "1")
+	writes, err := splitTenants(tenants, r, wr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string][]int)
+	for _, w := range writes {
+		got[w.tenant] = w.seriesIdx
+		for _, ts := range w.request.Timeseries {
+			for _, l := range ts.Labels {
+				if l.Name == "vm_account_id" {
+					t.Errorf("expected the tenant label to be removed, got %v", ts.Labels)
+				}
+			}
+		}
+	}
+	if len(got) != 3 || len(got["1"]) != 2 || got["1"][1] != 3 || got["0"][0] != 1 || got["2:5"][0] != 2 {
+		t.Fatalf("unexpected tenants %v", got)
+	}
+
+	// Series without the label fall back to the header
+	r.Header.Set("X-Scope-OrgID", "4")
+	writes, err = splitTenants(tenants, r, tenantSeries("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 1 || writes[0].tenant != "4" {
+		t.Errorf("expected the header tenant, got %+v", writes)
+	}
+}
+
+func TestWriteGroupAdopt(t *testing.T) {
+	config := utility.DefaultConfig()
+	config.RoutingMode = utility.RoutingShard
+	list := []vmupstreams.VMUpstream{
+		{Host: "10.0.0.1", Port: 8480, URI: "/insert/0/prometheus/api/v1/write", Status: true},
+		{Host: "10.0.0.2", Port: 8480, URI: "/insert/0/prometheus/api/v1/write", Status: true},
+	}
+	ring := vmupstreams.NewRing(list, 1)
+
+	groups := []writeGroup{
+		{tenant: "1", request: tenantSeries("", "", ""), seriesIdx: []int{0, 2, 4}},
+		{tenant: "", request: tenantSeries("", ""), seriesIdx: []int{1, 3}},
+	}
+	var forwards []HTTPForward
+	for _, g := range groups {
+		f := buildForwards(config.RoutingConfig, ring, ring.Nodes(), g.request)
+		g.adopt(f, config.TenantURI)
+		forwards = append(forwards, f...)
+	}
+
+	seen := make(map[int]bool)
+	for _, f := range forwards {
+		for _, i := range f.seriesIdx {
+			seen[i] = true
+		}
+		switch f.Target {
+		case "":
+			for _, i := range f.seriesIdx {
+				if i != 1 && i != 3 {
+					t.Errorf("series %d of tenant 1 sent to the upstream uri", i)
+				}
+			}
+		case "http://10.0.0.1:8480/insert/1/prometheus/api/v1/write", "http://10.0.0.2:8480/insert/1/prometheus/api/v1/write":
+			for _, i := range f.seriesIdx {
+				if i%2 != 0 {
+					t.Errorf("series %d without a tenant sent to tenant 1", i)
+				}
+			}
+		default:
+			t.Errorf("unexpected target %s", f.Target)
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("expected all 5 series to be forwarded, got %v", seen)
+	}
+}
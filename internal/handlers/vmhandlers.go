@@ -3,28 +3,42 @@ package vmhandlers
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
 
+	vmlimits "github.dev.pages/infrastructure/vmwriter/internal/limits"
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmqueue "github.dev.pages/infrastructure/vmwriter/internal/queue"
 	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
 	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
 )
 
-// HTTP Thread pool
-var pClient *http.Client
-
 // PromHTTPHandlerContext provides context for passing global values to handlers
 // such as http thread pools or database handlers
 //
 // SEE: https://drstearns.github.io/tutorials/gohandlerctx/
 type PromHTTPHandlerContext struct {
 	pUpstream *vmupstreams.VMUpstreams
-	pConfig   *utility.VConfig
+	pConfigs  *utility.ConfigStore                // pConfigs configuration in use, swapped on reload
+	pQueues   *vmqueue.Manager                    // pQueues retry queues, nil when disabled
+	pPools    map[string]*vmupstreams.VMUpstreams // pPools named upstream pools, the default pool is pUpstream
+	pRelabel  atomic.Value                        // pRelabel compiled relabel configs of the configuration in use
+	pClient   atomic.Value                        // pClient *http.Client with the upstream timeout of the configuration in use
+	pLimits   *vmlimits.Limiter                   // pLimits active series and samples rate of every tenant
+
+	reloadMu     sync.Mutex                      // reloadMu only one reload at a time
+	configLoader func() (utility.VConfig, error) // configLoader reads the configuration again on reload
+
+	inflightMu sync.Mutex     // inflightMu protects inflight
+	inflight   map[string]int // inflight writes being sent or queued per upstream url
 }
 
 // Prometheus Metrics
@@ -54,6 +68,21 @@ var (
 		Name: "vmwriter_events_failed_timeout",
 		Help: "Total events timedout",
 	})
+
+	eventsDecodeFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmwriter_events_decode_failed_total",
+		Help: "The total number of remote write requests that could not be decoded",
+	})
+
+	seriesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmwriter_series_received_total",
+		Help: "The total number of time series received from remote write requests",
+	})
+
+	samplesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmwriter_samples_received_total",
+		Help: "The total number of samples received from remote write requests",
+	})
 )
 
 const publisher = "publisher"
@@ -67,7 +96,25 @@ func PCTXHandlerContext(upstreams *vmupstreams.VMUpstreams, config *utility.VCon
 		log.Error().Str("service", receiver).Msg("Could not find a list of upstreams to connect too")
 	}
 
-	return &PromHTTPHandlerContext{upstreams, config}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+
+	ctx := &PromHTTPHandlerContext{pUpstream: upstreams, pConfigs: utility.NewConfigStore(config), pLimits: vmlimits.New()}
+	ctx.setClient(config)
+	return ctx
+}
+
+// setClient replaces the client used for the upstreams with one using the timeout of config
+//
+// The clients share the default transport so connections to the upstreams are still reused, the
+// timeout keeps a stuck upstream from holding on to our goroutines forever.
+func (ctx *PromHTTPHandlerContext) setClient(config *utility.VConfig) {
+	ctx.pClient.Store(&http.Client{Timeout: time.Duration(config.HTTPTimeOut) * time.Second})
+}
+
+// client the client used for the upstreams
+func (ctx *PromHTTPHandlerContext) client() *http.Client {
+	return ctx.pClient.Load().(*http.Client)
 }
 
 // HomeHandler displays home page at /
@@ -79,6 +126,21 @@ func (ctx *PromHTTPHandlerContext) HomeHandler(w http.ResponseWriter, r *http.Re
 // PromHandler handles prometheus metrics at /api/v1/write
 func (ctx *PromHTTPHandlerContext) PromHandler(w http.ResponseWriter, r *http.Request) {
 
+	// One snapshot for the whole request so a reload can not change settings half way through
+	config := ctx.pConfigs.Load()
+
+	client, ok := authenticate(config.Clients, r)
+	if !ok {
+		log.Warn().Str("service", receiver).Msgf("Rejecting unauthenticated write from %s", r.RemoteAddr)
+		authFailed.Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="vmwriter"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if client != nil {
+		log.Debug().Str("service", receiver).Msgf("Write from client %s", client.Name)
+	}
+
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Error().Err(err).Str("service", receiver).Msg("Error creating request body")
@@ -87,32 +149,145 @@ func (ctx *PromHTTPHandlerContext) PromHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	//log.Debug().Str("service", receiver).Msg("Getting host list")
+	// Decode the payload so the rest of the pipeline can see the series
+	writeRequest, err := prompb.DecodeWriteRequest(reqBody)
+	if err != nil {
+		log.Error().Err(err).Str("service", receiver).Msg("Error decoding remote write request")
+		eventsDecodeFailed.Inc()
+		eventsFailedProcessed.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seriesReceived.Add(float64(len(writeRequest.Timeseries)))
+	samplesReceived.Add(float64(writeRequest.SampleCount()))
+
+	// Labels that say where the write came from, before relabeling so the rules can use them
+	injectLabels(writeRequest, sourceLabels(config.LabelsConfig, client, r))
+
+	rl, err := ctx.relabelersFor(config)
+	if err != nil {
+		log.Error().Err(err).Str("service", receiver).Msg("Error compiling relabel configs")
+		eventsFailedProcessed.Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	hostList, err := ctx.pUpstream.GetActiveHostList()
+	// Relabeling before routing so the rules, tenants and hashing see the final labels
+	received := len(writeRequest.Timeseries)
+	writeRequest, _ = rl.global.Apply(writeRequest)
+	if dropped := received - len(writeRequest.Timeseries); dropped > 0 {
+		relabelDropped.WithLabelValues("global").Add(float64(dropped))
+		if len(writeRequest.Timeseries) == 0 {
+			// Nothing left to write, the series were dropped on purpose
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	// What is stored must carry the required labels, writes that do not are refused as a whole
+	if err := checkRequiredLabels(writeRequest, config.RequiredLabels); err != nil {
+		log.Warn().Err(err).Str("service", receiver).Msgf("Rejecting write from %s", r.RemoteAddr)
+		writesRejected.WithLabelValues("missing_labels").Inc()
+		eventsFailedProcessed.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Find the VictoriaMetrics cluster tenant and the pool of every series
+	groups, err := splitTenants(config.TenantConfig, r, writeRequest)
 	if err != nil {
-		log.Error().Err(err).Str("service", receiver).Msg("Error getting host list")
+		log.Warn().Err(err).Str("service", receiver).Msgf("Rejecting write from %s", r.RemoteAddr)
+		eventsFailedProcessed.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	// Limits are checked for every tenant before anything is sent, so a rejected write can be sent again as a whole
+	var droppedOutcomes []writeOutcome
+	groups, dropped, key, rejected := ctx.limit(config, client, r, groups)
+	if rejected != "" {
+		log.Warn().Str("service", receiver).Msgf("Rejecting write from %s: %s", r.RemoteAddr, vmlimits.Error(key, rejected))
+		writesRejected.WithLabelValues(rejected).Inc()
+		eventsFailedProcessed.Inc()
+		http.Error(w, vmlimits.Error(key, rejected), http.StatusTooManyRequests)
+		return
+	}
+	if len(dropped) > 0 {
+		// Series over a limit count as written so prometheus does not send them again
+		droppedOutcomes = append(droppedOutcomes, writeOutcome{forward: HTTPForward{seriesIdx: dropped}, ok: true})
+	}
+
+	groups = routeGroups(config.Rules, groups)
+
+	// Replicate or shard the series over the upstreams of their pool
 	var httpforwards []HTTPForward
+	hostCount := 0
+	for i := range groups {
+		g := &groups[i]
+		pool := ctx.pool(g.pool)
+		if pool == nil {
+			log.Error().Str("service", receiver).Msgf("No pool %s to route series to", g.pool)
+			continue
+		}
 
-	for _, host := range hostList {
+		// Series the pool drops count as written to it
+		series := len(g.request.Timeseries)
+		if dropped := g.relabel(rl.pools[g.pool]); len(dropped) > 0 {
+			droppedOutcomes = append(droppedOutcomes, writeOutcome{forward: HTTPForward{seriesIdx: dropped}, ok: true})
+			if series > 0 && len(g.request.Timeseries) == 0 {
+				continue
+			}
+		}
 
-		// Forwards to use for upstreams
-		var httpforward HTTPForward
-		httpforward.URL = host
-		httpforward.ReqBody = reqBody
-		httpforwards = append(httpforwards, httpforward)
+		hostList, err := pool.GetActiveHostList()
+		if err != nil {
+			log.Error().Err(err).Str("service", receiver).Msg("Error getting host list")
+		}
+		hostCount += len(hostList)
+
+		ring := pool.GetRing()
+		forwards := buildForwards(config.RoutingConfig, ring, hostList, g.request)
+		g.adopt(forwards, config.TenantURI)
+		forwards, upstreamDropped := relabelForwards(forwards, rl.upstreams[g.pool])
+		droppedOutcomes = append(droppedOutcomes, upstreamDropped...)
+		countForwardedBytes(config.RoutingConfig, ring, forwards)
+		for j := range forwards {
+			forwards[j].upstreams = pool
+		}
+		httpforwards = append(httpforwards, forwards...)
 	}
 
+	// Drained upstreams are only safe to stop once writes already routed to them are done
+	done := ctx.trackInflight(httpforwards)
+	defer done()
+
+	// Upstreams that still have queued writes get new writes appended to the
+	// queue so they are delivered in order
+	httpforwards, outcomes := ctx.queueBehindPending(httpforwards)
+	outcomes = append(outcomes, droppedOutcomes...)
+
 	// Asyncronously send the requests to the upstreams and then
 	// wait for the results
-	results := asyncHTTPPost(httpforwards)
+	results := asyncHTTPPost(ctx.client(), httpforwards, ctx.pUpstream, time.Duration(config.SlowForwardMilliseconds)*time.Millisecond)
 
 	for _, result := range results {
 		if result != nil && result.response != nil {
 			log.Debug().Msgf("Received the following status: %s", result.response.Status)
 		}
+		outcome := resultOutcome(result)
+		if !outcome.ok && outcome.retryable && ctx.enqueue(result.forward) {
+			// Durably queued, the upstream gets it once it recovers
+			outcome.ok = true
+		}
+		outcomes = append(outcomes, outcome)
+	}
+
+	// Tell prometheus whether to retry based on the write consistency
+	status, reason := ackStatus(config.WriteConsistency, len(writeRequest.Timeseries), hostCount, outcomes)
+	if status != http.StatusOK {
+		log.Warn().Str("service", receiver).Msgf("Write not acknowledged with %d: %s", status, reason)
+		http.Error(w, reason, status)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -124,30 +299,86 @@ type HTTPResponse struct {
 	url      string
 	response *http.Response
 	err      error
+	forward  HTTPForward
 }
 
 //HTTPForward forwarding http type
 type HTTPForward struct {
-	URL     string
-	ReqBody []byte
+	URL          string                   // Upstream the forward is for
+	Target       string                   // Url the write is posted to when it is not URL, such as the write path of a tenant
+	WriteRequest *prompb.WriteRequest     // Decoded series carried by this forward
+	ReqBody      []byte                   // Snappy encoded WriteRequest sent upstream
+	seriesIdx    []int                    // Indexes of the series in the received request, nil means all of them
+	upstreams    *vmupstreams.VMUpstreams // Pool the upstream belongs to, the default pool when nil
+}
+
+// target the url the write is posted to
+func (f *HTTPForward) target() string {
+	if f.Target != "" {
+		return f.Target
+	}
+	return f.URL
+}
+
+// errBreakerOpen returned for forwards skipped because the upstream's circuit breaker is open
+var errBreakerOpen = errors.New("circuit breaker open")
+
+//newUpstreamRequest creates a remote write request for an upstream
+func newUpstreamRequest(url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return req, nil
 }
 
 // asyncHttpPost
 // SEE: https://matt.aimonetti.net/posts/2012-11-real-life-concurrency-in-go/
-func asyncHTTPPost(forwards []HTTPForward) []*HTTPResponse {
+func asyncHTTPPost(client *http.Client, forwards []HTTPForward, upstreams *vmupstreams.VMUpstreams, slowAfter time.Duration) []*HTTPResponse {
 	eventsTotalProcessed.Inc()
 	ch := make(chan *HTTPResponse)
 	responses := []*HTTPResponse{}
-	client := http.Client{}
+	if len(forwards) == 0 {
+		return responses
+	}
 	for _, forward := range forwards {
 		go func(forward HTTPForward) {
+			// Do not wait on an upstream that keeps failing, the write goes
+			// to the retry queue instead
+			pool := upstreams
+			if forward.upstreams != nil {
+				pool = forward.upstreams
+			}
+			// Built before asking the breaker so a bad request can not hold on to its trial write
+			req, err := newUpstreamRequest(forward.target(), forward.ReqBody)
+			if err != nil {
+				log.Error().Err(err).Msg("Error creating upstream request")
+				eventsFailedProcessed.Inc()
+				ch <- &HTTPResponse{url: forward.URL, err: err, forward: forward}
+				return
+			}
+
+			breaker := pool.Breaker(forward.URL)
+			if !breaker.Allow() {
+				log.Debug().Msgf("Circuit breaker open, skipping %s", forward.URL)
+				eventsFailedProcessed.Inc()
+				ch <- &HTTPResponse{url: forward.URL, err: errBreakerOpen, forward: forward}
+				return
+			}
+
 			requestDurationTimer := prometheus.NewTimer(requestDurationTimer)
-			requestDurationTimer.ObserveDuration()
-			log.Debug().Msgf("Fetching %s", forward.URL)
-			req, err := http.NewRequest(http.MethodGet, forward.URL, bytes.NewBuffer(forward.ReqBody))
+			log.Debug().Msgf("Fetching %s", forward.target())
 			resp, err := client.Do(req)
 			requestDurationTimer.ObserveDuration()
-			ch <- &HTTPResponse{forward.URL, resp, err}
+			if err != nil || resp.StatusCode >= 500 {
+				breaker.Failure()
+			} else {
+				breaker.Success()
+			}
+			ch <- &HTTPResponse{url: forward.URL, response: resp, err: err, forward: forward}
 
 			if err != nil {
 				log.Error().Err(err).Msg("Error processing http client event")
@@ -160,11 +391,9 @@ func asyncHTTPPost(forwards []HTTPForward) []*HTTPResponse {
 					} else {
 						eventsFailedProcessed.Inc()
 					}
-					if resp.StatusCode == http.StatusOK {
-						err := resp.Body.Close()
-						if err != nil {
-							log.Error().Err(err).Msg("Error closing response body")
-						}
+					err := resp.Body.Close()
+					if err != nil {
+						log.Error().Err(err).Msg("Error closing response body")
 					}
 				} else {
 					log.Error().Msg("Empty response returned for request")
@@ -177,17 +406,16 @@ func asyncHTTPPost(forwards []HTTPForward) []*HTTPResponse {
 		select {
 		case r := <-ch:
 			log.Debug().Msgf("%s was fetched", r.url)
-			if r.err != nil {
+			if r.err != nil && r.err != errBreakerOpen {
 				log.Error().Err(r.err).Msgf("Error with request %s failed", r.url)
 			}
 			responses = append(responses, r)
 			if len(responses) == len(forwards) {
 				return responses
 			}
-		case <-time.After(500 * time.Millisecond):
+		case <-time.After(slowAfter):
 			log.Info().Msg("forwards are taking too long, please check the upstream systems to ensure they are accepting requests")
 			eventsFailedTimeouts.Inc()
 		}
 	}
-	return responses
 }
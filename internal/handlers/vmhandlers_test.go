@@ -0,0 +1,255 @@
+package vmhandlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestAsyncHTTPPostBadRequestKeepsTrialWrite(t *testing.T) {
+	var pool vmupstreams.VMUpstreams
+	pool.Config.BreakerFailures = 1
+
+	url := "http://10.0.0.1:8428/api/v1/write"
+	pool.Breaker(url).Failure()
+
+	// The cool down is over, the next forward would be the trial write
+	results := asyncHTTPPost(http.DefaultClient, []HTTPForward{{URL: url, Target: "http://bad\x7fhost/"}}, &pool, time.Second)
+	if len(results) != 1 || results[0].err == nil || results[0].err == errBreakerOpen {
+		t.Fatalf("expected the request to fail to build, got %+v", results)
+	}
+	if !pool.Breaker(url).Allow() {
+		t.Error("a request that was never sent took the trial write of the breaker")
+	}
+}
+
+// ackTestContext a handler writing to one upstream per status, each answering every write with its status
+func ackTestContext(t *testing.T, consistency string, statuses ...int) *PromHTTPHandlerContext {
+	config := staticConfig()
+	config.WriteConsistency = consistency
+
+	var pool vmupstreams.VMUpstreams
+	pool.Config = config
+	for _, status := range statuses {
+		status := status
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(srv.Close)
+
+		host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		port, _ := strconv.Atoi(portStr)
+		pool.AddUpstream(vmupstreams.VMUpstream{Host: host, Port: port, URI: "/api/v1/write", Status: true})
+	}
+
+	return PCTXHandlerContext(&pool, &config)
+}
+
+// postWrite sends a remote write of two series to the handler and returns the status it answered with
+func postWrite(ctx *PromHTTPHandlerContext) int {
+	body := prompb.EncodeWriteRequest(tenantSeries("", ""))
+	w := httptest.NewRecorder()
+	ctx.PromHandler(w, httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body)))
+	return w.Code
+}
+
+func TestPromHandlerWriteConsistency(t *testing.T) {
+	cases := []struct {
+		consistency string
+		statuses    []int
+		want        int
+	}{
+		{utility.WriteConsistencyAny, []int{204, 204}, http.StatusOK},
+		{utility.WriteConsistencyAny, []int{204, 503}, http.StatusOK},
+		{utility.WriteConsistencyAny, []int{503, 503}, http.StatusServiceUnavailable},
+		{utility.WriteConsistencyAny, []int{400, 400}, http.StatusBadRequest},
+		{utility.WriteConsistencyQuorum, []int{204, 204, 503}, http.StatusOK},
+		{utility.WriteConsistencyQuorum, []int{204, 503, 503}, http.StatusServiceUnavailable},
+		{utility.WriteConsistencyAll, []int{204, 503}, http.StatusServiceUnavailable},
+		{utility.WriteConsistencyAll, []int{204, 400}, http.StatusBadRequest},
+		{utility.WriteConsistencyAll, nil, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		ctx := ackTestContext(t, c.consistency, c.statuses...)
+		if got := postWrite(ctx); got != c.want {
+			t.Errorf("%s with upstreams answering %v: expected %d, got %d", c.consistency, c.statuses, c.want, got)
+		}
+	}
+}
+
+func TestPromHandlerQueuedWriteIsAcknowledged(t *testing.T) {
+	ctx := ackTestContext(t, utility.WriteConsistencyAll, 204, 503)
+	if err := ctx.EnableRetryQueue(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed forward is durably queued, so the write counts as accepted by every upstream
+	if got := postWrite(ctx); got != http.StatusOK {
+		t.Fatalf("expected the queued write to be acknowledged, got %d", got)
+	}
+
+	// A write the upstream refused is not worth queueing
+	ctx = ackTestContext(t, utility.WriteConsistencyAll, 204, 400)
+	if err := ctx.EnableRetryQueue(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if got := postWrite(ctx); got != http.StatusBadRequest {
+		t.Errorf("expected the refused write to be answered with a 400, got %d", got)
+	}
+}
+
+func TestPromHandlerUpstreamWriteRelabel(t *testing.T) {
+	config := staticConfig()
+	config.WriteConsistency = utility.WriteConsistencyAll
+	config.StaticUpstreams = nil
+
+	received := make([]chan *prompb.WriteRequest, 2)
+	for i := range received {
+		ch := make(chan *prompb.WriteRequest, 1)
+		received[i] = ch
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			wr, err := prompb.DecodeWriteRequest(body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ch <- wr
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		t.Cleanup(srv.Close)
+
+		host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		port, _ := strconv.Atoi(portStr)
+		config.StaticUpstreams = append(config.StaticUpstreams, utility.StaticUpstream{Host: host, Port: port, URI: "/api/v1/write"})
+	}
+
+	// The second upstream does not want the series of instance a
+	drop := utility.DefaultRelabelConfig()
+	drop.SourceLabels = []string{"instance"}
+	drop.Regex = "a"
+	drop.Action = utility.RelabelDrop
+	config.StaticUpstreams[1].WriteRelabelConfigs = []utility.RelabelConfig{drop}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var pool vmupstreams.VMUpstreams
+	if err := pool.VMUpstreamsInitialize(&config); err != nil {
+		t.Fatal(err)
+	}
+	ctx := PCTXHandlerContext(&pool, &config)
+
+	// The series the upstream dropped count as written to it
+	if got := postWrite(ctx); got != http.StatusOK {
+		t.Fatalf("expected the write to be acknowledged, got %d", got)
+	}
+	if wr := <-received[0]; len(wr.Timeseries) != 2 {
+		t.Errorf("expected the first upstream to get both series, got %d", len(wr.Timeseries))
+	}
+	if wr := <-received[1]; len(wr.Timeseries) != 1 || labelValue(&wr.Timeseries[0], "instance") != "b" {
+		t.Errorf("expected the second upstream to only get instance b, got %+v", wr.Timeseries)
+	}
+
+	// Rules of an upstream are checked like the global ones
+	drop.Regex = "("
+	config.StaticUpstreams[1].WriteRelabelConfigs = []utility.RelabelConfig{drop}
+	if err := config.Validate(); err == nil {
+		t.Error("expected an invalid upstream relabel config to be rejected")
+	}
+}
+
+// countingUpstream an upstream answering its writes with statuses in turn, 204 once they run out
+func countingUpstream(t *testing.T, statuses ...int) (vmupstreams.VMUpstream, chan int) {
+	received := make(chan int, 10)
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusNoContent
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		received <- status
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return vmupstreams.VMUpstream{Host: host, Port: port, URI: "/api/v1/write", Status: true}, received
+}
+
+func TestPromHandlerReplaysQueuedWrite(t *testing.T) {
+	config := staticConfig()
+	config.WriteConsistency = utility.WriteConsistencyAll
+	upstream, received := countingUpstream(t, http.StatusServiceUnavailable)
+
+	var pool vmupstreams.VMUpstreams
+	pool.Config = config
+	pool.AddUpstream(upstream)
+	ctx := PCTXHandlerContext(&pool, &config)
+	if err := ctx.EnableRetryQueue(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed forward is queued and acknowledged, then replayed once the upstream takes writes
+	if got := postWrite(ctx); got != http.StatusOK {
+		t.Fatalf("expected the queued write to be acknowledged, got %d", got)
+	}
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusNoContent} {
+		select {
+		case status := <-received:
+			if status != want {
+				t.Fatalf("expected the upstream to answer %d, got %d", want, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a write answered with %d", want)
+		}
+	}
+	q, _ := ctx.pQueues.Queue(upstream.URL())
+	for deadline := time.Now().Add(5 * time.Second); q.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the replayed write to leave the queue")
+		}
+	}
+}
+
+func TestSendQueuedUsesBreaker(t *testing.T) {
+	config := staticConfig()
+	upstream, received := countingUpstream(t)
+
+	var pool vmupstreams.VMUpstreams
+	pool.Config = config
+	pool.AddUpstream(upstream)
+	ctx := PCTXHandlerContext(&pool, &config)
+
+	for i := 0; i < config.BreakerFailures; i++ {
+		pool.Breaker(upstream.URL()).Failure()
+	}
+
+	// Queues of a tenant of the upstream go through the same breaker
+	body := prompb.EncodeWriteRequest(tenantSeries(""))
+	for _, target := range []string{upstream.URL(), tenantURL(upstream.URL(), config.TenantURI, "7")} {
+		if err := ctx.sendQueued(target, body); err != errBreakerOpen {
+			t.Errorf("expected the replay to %s to wait for the breaker, got %v", target, err)
+		}
+	}
+	if len(received) != 0 {
+		t.Errorf("expected nothing sent while the breaker is open, got %d writes", len(received))
+	}
+
+	// Once the breaker closes the replay is sent
+	pool.Breaker(upstream.URL()).Success()
+	if err := ctx.sendQueued(upstream.URL(), body); err != nil || len(received) != 1 {
+		t.Errorf("expected the replay to be sent once the breaker closed, got %v", err)
+	}
+}
@@ -0,0 +1,384 @@
+//Package vmlimits tracks the active series and samples rate of each tenant and enforces limits on them
+//
+// Active series are tracked exactly, by the hash of their labels and the last time they were
+// written, so memory grows with the number of active series at roughly 40 bytes each.  The
+// samples rate is a token bucket that may go into debt, so a single write larger than the burst
+// still gets through and the tenant then has to wait until its rate has paid for it.
+package vmlimits
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+var (
+	tenantActiveSeries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_tenant_active_series",
+		Help: "Series each tenant wrote within the active series window",
+	}, []string{"tenant"})
+
+	tenantSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_tenant_samples_total",
+		Help: "Samples each tenant wrote within its limits",
+	}, []string{"tenant"})
+
+	tenantLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_tenant_limit",
+		Help: "Limits of each tenant, 0 is unlimited",
+	}, []string{"tenant", "limit"})
+
+	tenantLimitedSeries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_tenant_limited_series_total",
+		Help: "Series of each tenant dropped or rejected because a limit was hit",
+	}, []string{"tenant", "limit", "action"})
+)
+
+const (
+	//ReasonActiveSeries the write has new series over the active series limit
+	ReasonActiveSeries = "active_series"
+	//ReasonSamplesRate the write has samples over the samples rate limit
+	ReasonSamplesRate = "samples_rate"
+)
+
+// noKey metric label of writes without a tenant
+const noKey = "none"
+
+//Limiter active series and samples rate of every tenant
+type Limiter struct {
+	mu        sync.Mutex
+	tenants   map[string]*tenant
+	nextSweep time.Time
+
+	now func() time.Time // now replaced in tests
+}
+
+type tenant struct {
+	mu        sync.Mutex
+	series    map[uint64]int64 // series last write in unix nanoseconds by labels hash
+	nextSweep time.Time
+	lastWrite time.Time
+	tokens    float64 // tokens samples the tenant may still write, negative when in debt
+	refilled  time.Time
+
+	users int // users writes holding the tenant so it is not forgotten, guarded by the Limiter lock
+}
+
+//New creates an empty Limiter
+func New() *Limiter {
+	return &Limiter{tenants: make(map[string]*tenant), now: time.Now}
+}
+
+// admission what check decided about a write, commit records it
+type admission struct {
+	kept   []int    // kept indexes of the series that may be written, nil when all of them may
+	reason string   // reason the limit that was hit, empty when the write is within its limits
+	hashes []uint64 // hashes labels hashes of the series to record as active
+	spend  float64  // spend tokens the write takes from the samples rate
+	count  int      // count samples written
+}
+
+//Admit checks a write of the tenant key against its limits and records the series it may write
+//
+// kept lists the indexes of the series that may be written, nil when all of them may.  reason
+// names the limit that was hit, with the reject action a write over a limit keeps no series.
+func (l *Limiter) Admit(config *utility.LimitsConfig, key string, wr *prompb.WriteRequest) (kept []int, reason string) {
+	key = tenantKey(key)
+	now := l.now()
+	window := time.Duration(config.ActiveSeriesWindowSeconds) * time.Second
+
+	tenants := l.acquire([]string{key}, now, window)
+	defer l.release(tenants)
+	t := tenants[0]
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.check(config, key, wr, now, window)
+	t.commit(key, a, now)
+	return a.kept, a.reason
+}
+
+//AdmitAll checks the writes of several tenants, by key, and only records them when all of them are within their limits
+//
+// Every tenant is locked, in key order, from the first check until the writes are recorded so
+// writes sent at the same time can not go over a limit together.  The key of the first write
+// over a limit and the limit it hit are returned.
+func (l *Limiter) AdmitAll(config *utility.LimitsConfig, writes map[string]*prompb.WriteRequest) (key string, reason string) {
+	// Writes without a key and of the tenant noKey are the same tenant, each tenant is locked once
+	byKey := make(map[string]*prompb.WriteRequest, len(writes))
+	keys := make([]string, 0, len(writes))
+	for k, wr := range writes {
+		k = tenantKey(k)
+		if other, ok := byKey[k]; ok {
+			wr = &prompb.WriteRequest{Timeseries: append(append([]prompb.TimeSeries{}, other.Timeseries...), wr.Timeseries...)}
+		} else {
+			keys = append(keys, k)
+		}
+		byKey[k] = wr
+	}
+	sort.Strings(keys)
+	now := l.now()
+	window := time.Duration(config.ActiveSeriesWindowSeconds) * time.Second
+
+	tenants := l.acquire(keys, now, window)
+	defer l.release(tenants)
+	for _, t := range tenants {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+	}
+
+	admissions := make([]*admission, len(keys))
+	for i, k := range keys {
+		admissions[i] = tenants[i].check(config, k, byKey[k], now, window)
+		if admissions[i].reason != "" {
+			return k, admissions[i].reason
+		}
+	}
+	for i, k := range keys {
+		tenants[i].commit(k, admissions[i], now)
+	}
+	return "", ""
+}
+
+// check decides which series of a write the tenant may write, callers must hold the lock
+func (t *tenant) check(config *utility.LimitsConfig, key string, wr *prompb.WriteRequest, now time.Time, window time.Duration) *admission {
+	limit := config.LimitFor(key)
+	reject := config.LimitsAction == utility.LimitActionReject
+
+	t.lastWrite = now
+	if !now.Before(t.nextSweep) {
+		t.sweep(now.Add(-window).UnixNano())
+		t.nextSweep = now.Add(sweepInterval(window))
+	}
+
+	tenantLimit.WithLabelValues(key, "active_series").Set(float64(limit.MaxActiveSeries))
+	tenantLimit.WithLabelValues(key, "samples_per_second").Set(limit.MaxSamplesPerSecond)
+
+	// New series are allowed until the tenant has as many active series as it may
+	hashes := make([]uint64, len(wr.Timeseries))
+	allowed := make([]bool, len(wr.Timeseries))
+	var added map[uint64]bool
+	active := len(t.series)
+	overSeries := 0
+	for i := range wr.Timeseries {
+		h := wr.Timeseries[i].LabelsHash()
+		hashes[i] = h
+		if _, ok := t.series[h]; !ok && !added[h] {
+			if limit.MaxActiveSeries > 0 && active >= limit.MaxActiveSeries {
+				overSeries++
+				continue
+			}
+			if added == nil {
+				added = make(map[uint64]bool)
+			}
+			added[h] = true
+			active++
+		}
+		allowed[i] = true
+	}
+
+	// Samples are allowed while the tenant has tokens left
+	overRate := 0
+	if limit.MaxSamplesPerSecond > 0 {
+		t.refill(now, limit.MaxSamplesPerSecond, float64(config.RateBurstSeconds))
+		if reject {
+			if overSeries == 0 && t.tokens <= 0 {
+				overRate = len(wr.Timeseries)
+			}
+		} else {
+			tokens := t.tokens
+			for i := range wr.Timeseries {
+				if !allowed[i] {
+					continue
+				}
+				if tokens <= 0 {
+					allowed[i] = false
+					overRate++
+					continue
+				}
+				tokens -= float64(len(wr.Timeseries[i].Samples))
+			}
+		}
+	}
+
+	a := &admission{}
+	switch {
+	case overSeries > 0:
+		a.reason = ReasonActiveSeries
+	case overRate > 0:
+		a.reason = ReasonSamplesRate
+	}
+
+	if reject && a.reason != "" {
+		tenantLimitedSeries.WithLabelValues(key, a.reason, config.LimitsAction).Add(float64(len(wr.Timeseries)))
+		a.kept = []int{}
+		return a
+	}
+	if overSeries > 0 {
+		tenantLimitedSeries.WithLabelValues(key, ReasonActiveSeries, config.LimitsAction).Add(float64(overSeries))
+	}
+	if overRate > 0 {
+		tenantLimitedSeries.WithLabelValues(key, ReasonSamplesRate, config.LimitsAction).Add(float64(overRate))
+	}
+
+	// What commit records
+	for i := range wr.Timeseries {
+		if !allowed[i] {
+			continue
+		}
+		a.hashes = append(a.hashes, hashes[i])
+		a.count += len(wr.Timeseries[i].Samples)
+		if a.reason != "" {
+			a.kept = append(a.kept, i)
+		}
+	}
+	if limit.MaxSamplesPerSecond > 0 {
+		a.spend = float64(a.count)
+	}
+	if a.reason != "" && a.kept == nil {
+		a.kept = []int{}
+	}
+	return a
+}
+
+// commit records the series of a checked write as active and takes its samples from the samples
+// rate, callers must hold the lock they checked it under
+func (t *tenant) commit(key string, a *admission, now time.Time) {
+	stamp := now.UnixNano()
+	for _, h := range a.hashes {
+		t.series[h] = stamp
+	}
+	t.tokens -= a.spend
+
+	tenantActiveSeries.WithLabelValues(key).Set(float64(len(t.series)))
+	tenantSamples.WithLabelValues(key).Add(float64(a.count))
+}
+
+//ActiveSeries number of active series of the tenant key
+func (l *Limiter) ActiveSeries(key string) int {
+	l.mu.Lock()
+	t, ok := l.tenants[tenantKey(key)]
+	l.mu.Unlock()
+	if !ok {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.series)
+}
+
+// acquire returns the state of every key, forgetting tenants that wrote nothing for a whole window
+//
+// The tenants are held until release so they are not forgotten while they are being written to,
+// their locks must only be taken after acquire returns.
+func (l *Limiter) acquire(keys []string, now time.Time, window time.Duration) []*tenant {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !now.Before(l.nextSweep) {
+		wanted := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			wanted[tenantKey(key)] = true
+		}
+		for k, t := range l.tenants {
+			if t.users > 0 || wanted[k] {
+				continue
+			}
+			t.mu.Lock()
+			idle := now.Sub(t.lastWrite) > window
+			t.mu.Unlock()
+			if idle {
+				delete(l.tenants, k)
+				tenantActiveSeries.DeleteLabelValues(k)
+				tenantLimit.DeleteLabelValues(k, "active_series")
+				tenantLimit.DeleteLabelValues(k, "samples_per_second")
+			}
+		}
+		l.nextSweep = now.Add(sweepInterval(window))
+	}
+
+	tenants := make([]*tenant, len(keys))
+	for i, key := range keys {
+		key = tenantKey(key)
+		t, ok := l.tenants[key]
+		if !ok {
+			t = &tenant{series: make(map[uint64]int64), lastWrite: now}
+			l.tenants[key] = t
+		}
+		t.users++
+		tenants[i] = t
+	}
+	return tenants
+}
+
+// release lets tenants taken by acquire be forgotten again, callers must not hold their locks
+func (l *Limiter) release(tenants []*tenant) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, t := range tenants {
+		t.users--
+	}
+}
+
+// tenantKey the key tenants without a key are tracked under
+func tenantKey(key string) string {
+	if key == "" {
+		return noKey
+	}
+	return key
+}
+
+// sweep forgets the series last written before cutoff, callers must hold the lock
+func (t *tenant) sweep(cutoff int64) {
+	for h, last := range t.series {
+		if last < cutoff {
+			delete(t.series, h)
+		}
+	}
+}
+
+// refill adds the tokens earned since the last refill, a new tenant starts with a full bucket
+func (t *tenant) refill(now time.Time, rate float64, burstSeconds float64) {
+	burst := rate * burstSeconds
+	if t.refilled.IsZero() {
+		t.tokens = burst
+	} else {
+		t.tokens += now.Sub(t.refilled).Seconds() * rate
+	}
+	if t.tokens > burst {
+		t.tokens = burst
+	}
+	t.refilled = now
+}
+
+// sweepInterval how often expired series are looked for, the active series count may be
+// up to this much behind
+func sweepInterval(window time.Duration) time.Duration {
+	interval := window / 60
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+//Error message for a write rejected because of reason
+func Error(key string, reason string) string {
+	if key == "" {
+		key = noKey
+	}
+	switch reason {
+	case ReasonActiveSeries:
+		return fmt.Sprintf("tenant %s is over its active series limit", key)
+	case ReasonSamplesRate:
+		return fmt.Sprintf("tenant %s is over its samples per second limit", key)
+	}
+	return fmt.Sprintf("tenant %s is over its limits", key)
+}
@@ -0,0 +1,206 @@
+package vmlimits
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// writeOf a write of the series up{instance="<n>"} for n in from..to-1, each with samples samples
+func writeOf(from, to, samples int) *prompb.WriteRequest {
+	wr := &prompb.WriteRequest{}
+	for n := from; n < to; n++ {
+		wr.Timeseries = append(wr.Timeseries, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: fmt.Sprint(n)}},
+			Samples: make([]prompb.Sample, samples),
+		})
+	}
+	return wr
+}
+
+// testLimiter a limiter whose clock only moves when the test moves it
+func testLimiter() (*Limiter, *time.Time) {
+	now := time.Unix(1600000000, 0)
+	l := New()
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func testConfig(action string) *utility.LimitsConfig {
+	config := utility.DefaultConfig().LimitsConfig
+	config.LimitsBy = utility.LimitByTenant
+	config.LimitsAction = action
+	return &config
+}
+
+func TestActiveSeriesLimit(t *testing.T) {
+	l, now := testLimiter()
+	config := testConfig(utility.LimitActionDrop)
+	config.MaxActiveSeries = 10
+	config.LimitOverrides = map[string]utility.Limit{"2": {MaxActiveSeries: 100}}
+
+	if kept, reason := l.Admit(config, "1", writeOf(0, 8, 1)); kept != nil || reason != "" {
+		t.Fatalf("expected every series to be kept, got %v %s", kept, reason)
+	}
+
+	// Known series are always kept, new ones only while there is room
+	kept, reason := l.Admit(config, "1", writeOf(4, 12, 1))
+	if reason != ReasonActiveSeries || fmt.Sprint(kept) != "[0 1 2 3 4 5]" {
+		t.Fatalf("expected the last two new series to be dropped, got %v %s", kept, reason)
+	}
+	if got := l.ActiveSeries("1"); got != 10 {
+		t.Errorf("expected 10 active series, got %d", got)
+	}
+
+	// Other tenants have their own limits
+	if kept, _ := l.Admit(config, "2", writeOf(0, 50, 1)); kept != nil {
+		t.Errorf("expected the override to allow 50 series, kept %v", kept)
+	}
+
+	// Series not written for a whole window are no longer active
+	*now = now.Add(time.Duration(config.ActiveSeriesWindowSeconds+60) * time.Second)
+	if kept, _ := l.Admit(config, "1", writeOf(100, 110, 1)); kept != nil {
+		t.Errorf("expected room for new series after the window, kept %v", kept)
+	}
+	if got := l.ActiveSeries("1"); got != 10 {
+		t.Errorf("expected 10 active series, got %d", got)
+	}
+}
+
+func TestActiveSeriesLimitReject(t *testing.T) {
+	l, _ := testLimiter()
+	config := testConfig(utility.LimitActionReject)
+	config.MaxActiveSeries = 10
+
+	l.Admit(config, "1", writeOf(0, 8, 1))
+	kept, reason := l.Admit(config, "1", writeOf(4, 12, 1))
+	if reason != ReasonActiveSeries || kept == nil || len(kept) != 0 {
+		t.Fatalf("expected the write to be rejected, got %v %s", kept, reason)
+	}
+
+	// Nothing of a rejected write is recorded
+	if got := l.ActiveSeries("1"); got != 8 {
+		t.Errorf("expected 8 active series, got %d", got)
+	}
+}
+
+func TestSamplesRateLimit(t *testing.T) {
+	l, now := testLimiter()
+	config := testConfig(utility.LimitActionReject)
+	config.MaxSamplesPerSecond = 100
+	config.RateBurstSeconds = 10
+
+	// The bucket starts full, a write bigger than what is left still gets through once
+	for i := 0; i < 2; i++ {
+		if _, reason := l.Admit(config, "1", writeOf(0, 10, 60)); reason != "" {
+			t.Fatalf("write %d rejected: %s", i, reason)
+		}
+	}
+	if _, reason := l.Admit(config, "1", writeOf(0, 10, 60)); reason != ReasonSamplesRate {
+		t.Fatalf("expected the write to be over the rate, got %q", reason)
+	}
+
+	// 200 samples in debt, after three seconds there is room again
+	*now = now.Add(2 * time.Second)
+	if _, reason := l.Admit(config, "1", writeOf(0, 1, 1)); reason == "" {
+		t.Error("expected the tenant to still be in debt")
+	}
+	*now = now.Add(time.Second + time.Millisecond)
+	if _, reason := l.Admit(config, "1", writeOf(0, 1, 1)); reason != "" {
+		t.Errorf("expected the debt to be paid, got %s", reason)
+	}
+
+	// Dropping keeps the series that fit
+	config.LimitsAction = utility.LimitActionDrop
+	*now = now.Add(time.Minute)
+	kept, reason := l.Admit(config, "1", writeOf(0, 10, 300))
+	if reason != ReasonSamplesRate || fmt.Sprint(kept) != "[0 1 2 3]" {
+		t.Errorf("expected four series to fit, got %v %s", kept, reason)
+	}
+}
+
+func TestAdmitAllRecordsNothingOfRejectedWrite(t *testing.T) {
+	l, _ := testLimiter()
+	config := testConfig(utility.LimitActionReject)
+	config.MaxActiveSeries = 10
+	config.MaxSamplesPerSecond = 10
+	config.RateBurstSeconds = 1
+	config.LimitOverrides = map[string]utility.Limit{"2": {MaxActiveSeries: 1}}
+
+	key, reason := l.AdmitAll(config, map[string]*prompb.WriteRequest{"1": writeOf(0, 5, 20), "2": writeOf(0, 2, 1)})
+	if key != "2" || reason != ReasonActiveSeries {
+		t.Fatalf("expected tenant 2 to be over its limit, got %q %q", key, reason)
+	}
+	if got := l.ActiveSeries("1"); got != 0 {
+		t.Fatalf("expected nothing recorded for tenant 1, got %d active series", got)
+	}
+
+	// Tenant 1 kept its tokens, once written they are used up
+	if key, reason := l.AdmitAll(config, map[string]*prompb.WriteRequest{"1": writeOf(0, 5, 20)}); reason != "" {
+		t.Fatalf("expected tenant 1 to still have its tokens, got %q %q", key, reason)
+	}
+	if got := l.ActiveSeries("1"); got != 5 {
+		t.Errorf("expected 5 active series, got %d", got)
+	}
+	if _, reason := l.AdmitAll(config, map[string]*prompb.WriteRequest{"1": writeOf(0, 1, 1)}); reason != ReasonSamplesRate {
+		t.Errorf("expected the written samples to use the tokens, got %q", reason)
+	}
+}
+
+func TestConcurrentWritesStayWithinLimits(t *testing.T) {
+	l, _ := testLimiter()
+	config := testConfig(utility.LimitActionReject)
+	config.MaxActiveSeries = 10
+	config.MaxSamplesPerSecond = 100
+	config.RateBurstSeconds = 1
+
+	// Writes of 5 new series each, only two fit in the active series limit
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reason string
+			if i%2 == 0 {
+				_, reason = l.AdmitAll(config, map[string]*prompb.WriteRequest{"1": writeOf(i*5, i*5+5, 1)})
+			} else {
+				_, reason = l.Admit(config, "1", writeOf(i*5, i*5+5, 1))
+			}
+			if reason == "" {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 2 || l.ActiveSeries("1") != 10 {
+		t.Errorf("expected two writes within the limit, %d were accepted with %d active series", accepted, l.ActiveSeries("1"))
+	}
+
+	// Writes of 60 samples of known series, the bucket of 100 lets two through
+	config.MaxActiveSeries = 0
+	accepted = 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, reason := l.AdmitAll(config, map[string]*prompb.WriteRequest{"2": writeOf(0, 1, 60)}); reason == "" {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 2 {
+		t.Errorf("expected two writes within the samples rate, %d were accepted", accepted)
+	}
+}
@@ -0,0 +1,274 @@
+//Package prompb contains the subset of the Prometheus remote write protobuf messages used by vmwriter
+//
+// The messages are encoded by hand with protowire so we do not have to pull in the
+// whole prometheus module for four structs.
+// SEE: https://github.com/prometheus/prometheus/blob/master/prompb/remote.proto
+package prompb
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//WriteRequest remote write request sent by prometheus
+type WriteRequest struct {
+	Timeseries []TimeSeries
+	Unknown    []byte // Unknown raw fields (metadata etc.) passed through untouched
+}
+
+//TimeSeries a set of labels and the samples that belong to it
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+	Unknown []byte // Unknown raw fields (exemplars etc.) passed through untouched
+}
+
+//Label a label name/value pair
+type Label struct {
+	Name  string
+	Value string
+}
+
+//Sample a single sample
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+//Unmarshal decodes a protobuf encoded WriteRequest
+func (m *WriteRequest) Unmarshal(b []byte) error {
+	m.Timeseries = m.Timeseries[:0]
+	m.Unknown = m.Unknown[:0]
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if num == 1 && typ == protowire.BytesType {
+			v, vn := protowire.ConsumeBytes(b[n:])
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			var ts TimeSeries
+			if err := ts.Unmarshal(v); err != nil {
+				return fmt.Errorf("timeseries %d: %v", len(m.Timeseries), err)
+			}
+			m.Timeseries = append(m.Timeseries, ts)
+			b = b[n+vn:]
+			continue
+		}
+		vn := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if vn < 0 {
+			return protowire.ParseError(vn)
+		}
+		m.Unknown = append(m.Unknown, b[:n+vn]...)
+		b = b[n+vn:]
+	}
+	return nil
+}
+
+//Marshal encodes the WriteRequest
+func (m *WriteRequest) Marshal() []byte {
+	b := make([]byte, 0, m.Size())
+	for i := range m.Timeseries {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(m.Timeseries[i].Size()))
+		b = m.Timeseries[i].appendTo(b)
+	}
+	return append(b, m.Unknown...)
+}
+
+//Size returns the encoded size of the WriteRequest
+func (m *WriteRequest) Size() int {
+	n := len(m.Unknown)
+	for i := range m.Timeseries {
+		n += protowire.SizeTag(1) + protowire.SizeBytes(m.Timeseries[i].Size())
+	}
+	return n
+}
+
+//Unmarshal decodes a protobuf encoded TimeSeries
+func (m *TimeSeries) Unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, vn := protowire.ConsumeBytes(b[n:])
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			var l Label
+			if err := l.Unmarshal(v); err != nil {
+				return err
+			}
+			m.Labels = append(m.Labels, l)
+			b = b[n+vn:]
+		case num == 2 && typ == protowire.BytesType:
+			v, vn := protowire.ConsumeBytes(b[n:])
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			var s Sample
+			if err := s.Unmarshal(v); err != nil {
+				return err
+			}
+			m.Samples = append(m.Samples, s)
+			b = b[n+vn:]
+		default:
+			vn := protowire.ConsumeFieldValue(num, typ, b[n:])
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			m.Unknown = append(m.Unknown, b[:n+vn]...)
+			b = b[n+vn:]
+		}
+	}
+	return nil
+}
+
+func (m *TimeSeries) appendTo(b []byte) []byte {
+	for i := range m.Labels {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(m.Labels[i].Size()))
+		b = m.Labels[i].appendTo(b)
+	}
+	for i := range m.Samples {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(m.Samples[i].Size()))
+		b = m.Samples[i].appendTo(b)
+	}
+	return append(b, m.Unknown...)
+}
+
+//Size returns the encoded size of the TimeSeries
+func (m *TimeSeries) Size() int {
+	n := len(m.Unknown)
+	for i := range m.Labels {
+		n += protowire.SizeTag(1) + protowire.SizeBytes(m.Labels[i].Size())
+	}
+	for i := range m.Samples {
+		n += protowire.SizeTag(2) + protowire.SizeBytes(m.Samples[i].Size())
+	}
+	return n
+}
+
+//Unmarshal decodes a protobuf encoded Label
+func (m *Label) Unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, vn := protowire.ConsumeString(b)
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			m.Name = v
+			b = b[vn:]
+		case num == 2 && typ == protowire.BytesType:
+			v, vn := protowire.ConsumeString(b)
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			m.Value = v
+			b = b[vn:]
+		default:
+			vn := protowire.ConsumeFieldValue(num, typ, b)
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			b = b[vn:]
+		}
+	}
+	return nil
+}
+
+func (m *Label) appendTo(b []byte) []byte {
+	if m.Name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.Value != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.Value)
+	}
+	return b
+}
+
+//Size returns the encoded size of the Label
+func (m *Label) Size() int {
+	n := 0
+	if m.Name != "" {
+		n += protowire.SizeTag(1) + protowire.SizeBytes(len(m.Name))
+	}
+	if m.Value != "" {
+		n += protowire.SizeTag(2) + protowire.SizeBytes(len(m.Value))
+	}
+	return n
+}
+
+//Unmarshal decodes a protobuf encoded Sample
+func (m *Sample) Unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, vn := protowire.ConsumeFixed64(b)
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			m.Value = math.Float64frombits(v)
+			b = b[vn:]
+		case num == 2 && typ == protowire.VarintType:
+			v, vn := protowire.ConsumeVarint(b)
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			m.Timestamp = int64(v)
+			b = b[vn:]
+		default:
+			vn := protowire.ConsumeFieldValue(num, typ, b)
+			if vn < 0 {
+				return protowire.ParseError(vn)
+			}
+			b = b[vn:]
+		}
+	}
+	return nil
+}
+
+func (m *Sample) appendTo(b []byte) []byte {
+	if m.Value != 0 || math.Signbit(m.Value) {
+		b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(m.Value))
+	}
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Timestamp))
+	}
+	return b
+}
+
+//Size returns the encoded size of the Sample
+func (m *Sample) Size() int {
+	n := 0
+	if m.Value != 0 || math.Signbit(m.Value) {
+		n += protowire.SizeTag(1) + protowire.SizeFixed64()
+	}
+	if m.Timestamp != 0 {
+		n += protowire.SizeTag(2) + protowire.SizeVarint(uint64(m.Timestamp))
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package prompb
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWriteRequestRoundTrip(t *testing.T) {
+	wr := &WriteRequest{
+		Timeseries: []TimeSeries{
+			{
+				Labels: []Label{
+					{Name: "__name__", Value: "up"},
+					{Name: "job", Value: "node"},
+				},
+				Samples: []Sample{
+					{Value: 1, Timestamp: 1600000000000},
+					{Value: math.Inf(-1), Timestamp: 1600000015000},
+				},
+			},
+			{
+				Labels:  []Label{{Name: "__name__", Value: "empty"}},
+				Samples: []Sample{{Value: 0, Timestamp: 0}},
+			},
+		},
+	}
+
+	decoded, err := DecodeWriteRequest(EncodeWriteRequest(wr))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(wr.Timeseries, decoded.Timeseries) {
+		t.Errorf("round trip mismatch\nwant %+v\ngot  %+v", wr.Timeseries, decoded.Timeseries)
+	}
+
+	if decoded.SampleCount() != 3 {
+		t.Errorf("expected 3 samples, got %d", decoded.SampleCount())
+	}
+}
+
+func TestWriteRequestUnknownFields(t *testing.T) {
+	// Field 3 is metadata in remote.proto, we do not interpret it but must keep it
+	metadata := []byte{0x1a, 0x02, 0x08, 0x01}
+
+	wr := &WriteRequest{
+		Timeseries: []TimeSeries{{Labels: []Label{{Name: "a", Value: "b"}}}},
+		Unknown:    metadata,
+	}
+
+	var decoded WriteRequest
+	if err := decoded.Unmarshal(wr.Marshal()); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded.Unknown, metadata) {
+		t.Errorf("unknown fields not preserved, got %v", decoded.Unknown)
+	}
+}
+
+func TestDecodeWriteRequestInvalid(t *testing.T) {
+	if _, err := DecodeWriteRequest([]byte("not snappy")); err == nil {
+		t.Error("expected error decoding garbage")
+	}
+}
@@ -0,0 +1,59 @@
+package prompb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/golang/snappy"
+)
+
+//DecodeWriteRequest snappy decompresses and unmarshals a remote write body
+func DecodeWriteRequest(body []byte) (*WriteRequest, error) {
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decode: %v", err)
+	}
+
+	var wr WriteRequest
+	if err := wr.Unmarshal(raw); err != nil {
+		return nil, fmt.Errorf("unmarshal write request: %v", err)
+	}
+
+	return &wr, nil
+}
+
+//EncodeWriteRequest marshals and snappy compresses a remote write body
+func EncodeWriteRequest(wr *WriteRequest) []byte {
+	return snappy.Encode(nil, wr.Marshal())
+}
+
+//SampleCount total number of samples across all series in the request
+func (m *WriteRequest) SampleCount() int {
+	n := 0
+	for i := range m.Timeseries {
+		n += len(m.Timeseries[i].Samples)
+	}
+	return n
+}
+
+//LabelsHash hash of the series label set, independent of the order the labels were sent in
+func (m *TimeSeries) LabelsHash() uint64 {
+	labels := m.Labels
+	if !sort.SliceIsSorted(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name }) {
+		labels = append([]Label(nil), m.Labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	}
+
+	// Separator can not appear in valid utf-8 so name/value pairs can not collide
+	d := xxhash.New()
+	for _, l := range labels {
+		d.WriteString(l.Name)
+		d.Write(seps)
+		d.WriteString(l.Value)
+		d.Write(seps)
+	}
+	return d.Sum64()
+}
+
+var seps = []byte{'\xff'}
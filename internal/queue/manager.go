@@ -0,0 +1,242 @@
+package vmqueue
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//ErrRejected returned (wrapped) by a Sender when the upstream refused the write for good,
+//the entry is dropped instead of being retried
+var ErrRejected = errors.New("write rejected by upstream")
+
+//Sender delivers a queued write to its upstream
+type Sender func(upstream string, body []byte) error
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+//Manager owns the queue and replay loop of every upstream
+type Manager struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration // maxAge writes queued for longer are dropped, 0 keeps them until delivered
+	send     Sender
+	queues   map[string]*replayer
+}
+
+type replayer struct {
+	queue  *Queue
+	notify chan struct{}
+	flush  chan struct{} // flush cuts the current backoff short
+}
+
+//NewManager creates a manager storing queues under dir and reopens any queues left from
+//a previous run so they are replayed straight away
+//
+// Writes older than maxAge are dropped instead of being replayed, so the queue of an upstream
+// that went away for good empties on its own.
+func NewManager(dir string, maxBytes int64, maxAge time.Duration, send Sender) (*Manager, error) {
+	m := &Manager{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		send:     send,
+		queues:   make(map[string]*replayer),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		upstream, err := url.QueryUnescape(f.Name())
+		if err != nil {
+			log.Error().Err(err).Str("service", queueservice).Msgf("Ignoring unknown queue directory %s", f.Name())
+			continue
+		}
+		if _, err := m.get(upstream); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+//Enqueue adds a write to the upstream's queue
+func (m *Manager) Enqueue(upstream string, body []byte) error {
+	r, err := m.get(upstream)
+	if err != nil {
+		return err
+	}
+
+	if err := r.queue.Push(body); err != nil {
+		return err
+	}
+
+	// Wake the replay loop without blocking if it is already awake
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+//Pending whether the upstream has queued writes, new writes should be queued
+//behind them so the upstream receives them in order
+func (m *Manager) Pending(upstream string) bool {
+	m.mu.Lock()
+	r, ok := m.queues[upstream]
+	m.mu.Unlock()
+
+	return ok && r.queue.Len() > 0
+}
+
+//Flush retries the upstream's queued writes straight away instead of waiting out the backoff,
+//used when the upstream is drained so its queue empties as soon as possible
+func (m *Manager) Flush(upstream string) {
+	m.mu.Lock()
+	r, ok := m.queues[upstream]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case r.flush <- struct{}{}:
+	default:
+	}
+}
+
+//QueuesWithPrefix returns the queues of every upstream url starting with prefix, such as the
+//queues of all the tenants of one upstream
+func (m *Manager) QueuesWithPrefix(prefix string) map[string]*Queue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := make(map[string]*Queue)
+	for upstream, r := range m.queues {
+		if strings.HasPrefix(upstream, prefix) {
+			found[upstream] = r.queue
+		}
+	}
+	return found
+}
+
+//Queue returns the queue of an upstream if one exists
+func (m *Manager) Queue(upstream string) (*Queue, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.queues[upstream]
+	if !ok {
+		return nil, false
+	}
+	return r.queue, true
+}
+
+// get returns the replayer for the upstream, opening the queue and starting the loop on first use
+func (m *Manager) get(upstream string) (*replayer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.queues[upstream]; ok {
+		return r, nil
+	}
+
+	q, err := Open(filepath.Join(m.dir, url.QueryEscape(upstream)), upstream, m.maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replayer{queue: q, notify: make(chan struct{}, 1), flush: make(chan struct{}, 1)}
+	m.queues[upstream] = r
+
+	go m.replay(upstream, r)
+
+	return r, nil
+}
+
+// replay sends queued writes to the upstream in order, backing off while it is failing
+func (m *Manager) replay(upstream string, r *replayer) {
+	backoff := minBackoff
+
+	// Keeps the oldest entry age metric moving while we wait
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		entry, ok, err := r.queue.Peek()
+		if err != nil {
+			// The disk may be failing, do not spin on it
+			log.Error().Err(err).Str("service", queueservice).Msgf("Dropped unreadable queue entry for %s, retrying in %s", upstream, backoff)
+			backoff = r.wait(backoff)
+			continue
+		}
+
+		if !ok {
+			select {
+			case <-r.notify:
+			case <-ticker.C:
+				r.queue.refreshMetrics()
+			}
+			continue
+		}
+
+		if m.maxAge > 0 && time.Since(entry.Enqueued) > m.maxAge {
+			log.Warn().Str("service", queueservice).Msgf("Dropping write queued for %s since %s, it is older than %s", upstream, entry.Enqueued, m.maxAge)
+			queueExpired.WithLabelValues(upstream).Inc()
+			if err := r.queue.Remove(entry.Seq); err != nil {
+				log.Error().Err(err).Str("service", queueservice).Msgf("Error removing expired write for %s", upstream)
+			}
+			continue
+		}
+
+		err = m.send(upstream, entry.Body)
+		if err != nil && !errors.Is(err, ErrRejected) {
+			log.Debug().Err(err).Str("service", queueservice).Msgf("Replay to %s failed, retrying in %s", upstream, backoff)
+			r.queue.refreshMetrics()
+			backoff = r.wait(backoff)
+			continue
+		}
+
+		if err != nil {
+			log.Error().Err(err).Str("service", queueservice).Msgf("Upstream %s rejected queued write, dropping it", upstream)
+		} else {
+			queueReplayed.WithLabelValues(upstream).Inc()
+		}
+
+		backoff = minBackoff
+		if err := r.queue.Remove(entry.Seq); err != nil {
+			log.Error().Err(err).Str("service", queueservice).Msgf("Error removing replayed write for %s", upstream)
+		}
+	}
+}
+
+// wait sleeps for backoff or until the queue is flushed, returns the backoff to use next
+func (r *replayer) wait(backoff time.Duration) time.Duration {
+	select {
+	case <-time.After(backoff):
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		return backoff
+	case <-r.flush:
+		return minBackoff
+	}
+}
@@ -0,0 +1,309 @@
+//Package vmqueue provides a durable on disk retry queue for each upstream
+//
+// Every entry is stored in its own file named after an increasing sequence number, so
+// the queue survives restarts and replays in order by simply listing the directory.
+package vmqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_queue_depth",
+		Help: "Number of writes waiting in the retry queue",
+	}, []string{"upstream"})
+
+	queueBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_queue_bytes",
+		Help: "Bytes of writes waiting in the retry queue",
+	}, []string{"upstream"})
+
+	queueOldestAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_queue_oldest_entry_age_seconds",
+		Help: "Age of the oldest write waiting in the retry queue",
+	}, []string{"upstream"})
+
+	queueDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_queue_dropped_total",
+		Help: "Writes dropped from the retry queue because it was full",
+	}, []string{"upstream"})
+
+	queueExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_queue_expired_total",
+		Help: "Writes dropped from the retry queue because they were queued for longer than the maximum age",
+	}, []string{"upstream"})
+
+	queueReplayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_queue_replayed_total",
+		Help: "Writes successfully replayed from the retry queue",
+	}, []string{"upstream"})
+)
+
+const queueservice = "queue"
+
+const entrySuffix = ".blk"
+
+// headerSize every entry starts with the enqueue time in unix nanoseconds
+const headerSize = 8
+
+//Entry a single queued write
+type Entry struct {
+	Seq      uint64
+	Body     []byte
+	Enqueued time.Time
+}
+
+type entryMeta struct {
+	seq      uint64
+	size     int64
+	enqueued time.Time
+}
+
+//Queue durable, size capped FIFO of writes for one upstream
+type Queue struct {
+	mu       sync.Mutex
+	name     string // name upstream url, used for metric labels
+	dir      string
+	maxBytes int64
+	entries  []entryMeta
+	bytes    int64
+	nextSeq  uint64
+}
+
+//Open opens or creates the queue stored in dir
+func Open(dir string, name string, maxBytes int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{name: name, dir: dir, maxBytes: maxBytes, nextSeq: 1}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), entrySuffix) {
+			// Leftover temp file from a crash in the middle of a push
+			if strings.HasSuffix(f.Name(), ".tmp") {
+				os.Remove(filepath.Join(dir, f.Name()))
+			}
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), entrySuffix), 10, 64)
+		if err != nil {
+			log.Error().Err(err).Str("service", queueservice).Msgf("Ignoring unknown file %s in queue", f.Name())
+			continue
+		}
+		enqueued, err := readEnqueued(filepath.Join(dir, f.Name()))
+		if err != nil {
+			log.Error().Err(err).Str("service", queueservice).Msgf("Dropping unreadable queue entry %s", f.Name())
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		q.entries = append(q.entries, entryMeta{seq: seq, size: f.Size(), enqueued: enqueued})
+		q.bytes += f.Size()
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].seq < q.entries[j].seq })
+
+	if len(q.entries) > 0 {
+		log.Info().Str("service", queueservice).Msgf("Loaded %d queued writes (%d bytes) for %s", len(q.entries), q.bytes, name)
+	}
+	q.updateMetrics()
+
+	return q, nil
+}
+
+//Push appends a write to the end of the queue, dropping the oldest entries when full
+func (q *Queue) Push(body []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := int64(len(body) + headerSize)
+	if q.maxBytes > 0 && size > q.maxBytes {
+		queueDropped.WithLabelValues(q.name).Inc()
+		return fmt.Errorf("write of %d bytes is larger than the queue", len(body))
+	}
+
+	// Make room by dropping the oldest data, fresh samples are worth more
+	for q.maxBytes > 0 && q.bytes+size > q.maxBytes && len(q.entries) > 0 {
+		if err := q.removeHead(); err != nil {
+			return err
+		}
+		queueDropped.WithLabelValues(q.name).Inc()
+	}
+
+	now := time.Now()
+	buf := make([]byte, headerSize, size)
+	binary.BigEndian.PutUint64(buf, uint64(now.UnixNano()))
+	buf = append(buf, body...)
+
+	seq := q.nextSeq
+	if err := writeFileSync(q.entryPath(seq), buf); err != nil {
+		return err
+	}
+	q.nextSeq++
+
+	q.entries = append(q.entries, entryMeta{seq: seq, size: size, enqueued: now})
+	q.bytes += size
+	q.updateMetrics()
+
+	return nil
+}
+
+//Peek returns the oldest entry without removing it
+func (q *Queue) Peek() (Entry, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) == 0 {
+		return Entry{}, false, nil
+	}
+
+	head := q.entries[0]
+	buf, err := ioutil.ReadFile(q.entryPath(head.seq))
+	if err == nil && len(buf) < headerSize {
+		err = fmt.Errorf("queue entry %d is truncated", head.seq)
+	}
+	if err != nil {
+		// Drop the broken entry so it can not block the rest of the queue
+		q.removeHead()
+		return Entry{}, false, err
+	}
+
+	return Entry{Seq: head.seq, Body: buf[headerSize:], Enqueued: head.enqueued}, true, nil
+}
+
+//Remove removes the entry with seq if it is still at the head of the queue
+func (q *Queue) Remove(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The entry may already be gone if it was dropped on overflow while being replayed
+	if len(q.entries) == 0 || q.entries[0].seq != seq {
+		return nil
+	}
+
+	return q.removeHead()
+}
+
+//Len number of queued writes
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+//Bytes bytes used by queued writes
+func (q *Queue) Bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+//OldestAge age of the oldest queued write, zero when empty
+func (q *Queue) OldestAge() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return 0
+	}
+	return time.Since(q.entries[0].enqueued)
+}
+
+// removeHead deletes the oldest entry, callers must hold the lock
+//
+// The entry leaves the queue even when its file can not be deleted, so a file that is stuck on
+// disk can not block the writes behind it.
+func (q *Queue) removeHead() error {
+	head := q.entries[0]
+	q.entries = q.entries[1:]
+	q.bytes -= head.size
+	q.updateMetrics()
+
+	if err := os.Remove(q.entryPath(head.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// refreshMetrics refreshes the gauges, the oldest entry age keeps growing while nothing changes
+func (q *Queue) refreshMetrics() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.updateMetrics()
+}
+
+// updateMetrics refreshes the gauges, callers must hold the lock
+func (q *Queue) updateMetrics() {
+	queueDepth.WithLabelValues(q.name).Set(float64(len(q.entries)))
+	queueBytes.WithLabelValues(q.name).Set(float64(q.bytes))
+	if len(q.entries) == 0 {
+		queueOldestAge.WithLabelValues(q.name).Set(0)
+	} else {
+		queueOldestAge.WithLabelValues(q.name).Set(time.Since(q.entries[0].enqueued).Seconds())
+	}
+}
+
+func (q *Queue) entryPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, entrySuffix))
+}
+
+// writeFileSync writes the file through a temp file and rename so a crash
+// never leaves a half written entry behind
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readEnqueued(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	var header [headerSize]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header[:]))), nil
+}
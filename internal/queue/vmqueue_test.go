@@ -0,0 +1,159 @@
+package vmqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempQueueDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "vmqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestQueueOrderAndRestart(t *testing.T) {
+	dir := tempQueueDir(t)
+
+	q, err := Open(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"one", "two", "three"} {
+		if err := q.Push([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, ok, err := q.Peek()
+	if err != nil || !ok || string(e.Body) != "one" {
+		t.Fatalf("expected head one, got %q %v %v", e.Body, ok, err)
+	}
+	if err := q.Remove(e.Seq); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new process must see the remaining entries in the same order
+	q, err = Open(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 entries after reopen, got %d", q.Len())
+	}
+	if err := q.Push([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for {
+		e, ok, err := q.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, string(e.Body))
+		q.Remove(e.Seq)
+	}
+
+	want := []string{"two", "three", "four"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if q.Bytes() != 0 || q.OldestAge() != 0 {
+		t.Errorf("expected empty queue, got %d bytes", q.Bytes())
+	}
+}
+
+func TestQueueOverflowDropsOldest(t *testing.T) {
+	// Room for two ten byte entries including their headers
+	q, err := Open(tempQueueDir(t), "test", 2*(10+headerSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc"} {
+		if err := q.Push([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", q.Len())
+	}
+	e, _, _ := q.Peek()
+	if string(e.Body) != "bbbbbbbbbb" {
+		t.Errorf("expected oldest entry to be dropped, head is %q", e.Body)
+	}
+
+	if err := q.Push(make([]byte, 100)); err == nil {
+		t.Error("expected an error pushing an entry larger than the queue")
+	}
+}
+
+func TestQueueSkipsEntryStuckOnDisk(t *testing.T) {
+	q, err := Open(tempQueueDir(t), "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"one", "two"} {
+		if err := q.Push([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A head that can neither be read nor deleted
+	head := q.entryPath(q.entries[0].seq)
+	if err := os.Remove(head); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(head, "stuck"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := q.Peek(); err == nil {
+		t.Fatal("expected the unreadable head to be reported")
+	}
+	e, ok, err := q.Peek()
+	if err != nil || !ok || string(e.Body) != "two" {
+		t.Errorf("expected the next entry after the stuck one, got %q %v %v", e.Body, ok, err)
+	}
+}
+
+func TestManagerDropsExpiredWrites(t *testing.T) {
+	sent := make(chan string, 1)
+	m, err := NewManager(tempQueueDir(t), 0, time.Nanosecond, func(upstream string, body []byte) error {
+		sent <- string(body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Enqueue("http://10.0.0.1:8428/api/v1/write", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	q, _ := m.Queue("http://10.0.0.1:8428/api/v1/write")
+	for deadline := time.Now().Add(5 * time.Second); q.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the expired write to be dropped")
+		}
+	}
+	select {
+	case body := <-sent:
+		t.Errorf("expected the expired write not to be replayed, got %q", body)
+	default:
+	}
+}
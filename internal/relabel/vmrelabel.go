@@ -0,0 +1,225 @@
+//Package vmrelabel applies Prometheus relabel configs to remote write series
+//
+// The semantics follow Prometheus so rules can be copied from scrape and remote write configs.
+// SEE: https://github.com/prometheus/prometheus/blob/main/pkg/relabel/relabel.go
+package vmrelabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+//Relabeler a compiled list of relabel configs, a nil Relabeler keeps every series unchanged
+type Relabeler struct {
+	rules []rule
+}
+
+type rule struct {
+	utility.RelabelConfig
+	re *regexp.Regexp
+}
+
+// labelNameRE valid Prometheus label names, targets expanding to anything else are skipped
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+//New compiles the relabel configs, returns nil when there are none
+func New(configs []utility.RelabelConfig) (*Relabeler, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	r := &Relabeler{}
+	for i, c := range configs {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("relabel config %d: %v", i, err)
+		}
+		re, err := regexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: %v", i, err)
+		}
+		r.rules = append(r.rules, rule{RelabelConfig: c, re: re})
+	}
+	return r, nil
+}
+
+//Process relabels a label set, keep is false when the series should be dropped
+//
+// The labels passed in are never modified, a new slice sorted by name is returned when anything changed.
+func (r *Relabeler) Process(labels []prompb.Label) ([]prompb.Label, bool) {
+	if r == nil {
+		return labels, true
+	}
+
+	b := newBuilder(labels)
+	for _, rl := range r.rules {
+		if !rl.apply(b) {
+			return nil, false
+		}
+	}
+	if !b.changed {
+		return labels, true
+	}
+
+	out := b.labels()
+	return out, len(out) > 0
+}
+
+//Apply relabels every series of the request, dropped series are removed
+//
+// Returns the request with the kept series and their indexes in wr, kept is nil when every
+// series was kept and wr is returned as it is.  wr is never modified.
+func (r *Relabeler) Apply(wr *prompb.WriteRequest) (*prompb.WriteRequest, []int) {
+	if r == nil {
+		return wr, nil
+	}
+
+	out := &prompb.WriteRequest{Unknown: wr.Unknown, Timeseries: make([]prompb.TimeSeries, 0, len(wr.Timeseries))}
+	kept := make([]int, 0, len(wr.Timeseries))
+	for i, ts := range wr.Timeseries {
+		labels, keep := r.Process(ts.Labels)
+		if !keep {
+			continue
+		}
+		ts.Labels = labels
+		out.Timeseries = append(out.Timeseries, ts)
+		kept = append(kept, i)
+	}
+
+	if len(kept) == len(wr.Timeseries) {
+		kept = nil
+	}
+	return out, kept
+}
+
+// apply runs the rule on the labels, returns false when the series is dropped
+func (rl *rule) apply(b *builder) bool {
+	values := make([]string, len(rl.SourceLabels))
+	for i, name := range rl.SourceLabels {
+		values[i] = b.get(name)
+	}
+	val := strings.Join(values, rl.Separator)
+
+	switch rl.Action {
+	case utility.RelabelDrop:
+		if rl.re.MatchString(val) {
+			return false
+		}
+	case utility.RelabelKeep:
+		if !rl.re.MatchString(val) {
+			return false
+		}
+	case utility.RelabelReplace:
+		indexes := rl.re.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			break
+		}
+		target := string(rl.re.ExpandString(nil, rl.TargetLabel, val, indexes))
+		if !labelNameRE.MatchString(target) {
+			break
+		}
+		res := rl.re.ExpandString(nil, rl.Replacement, val, indexes)
+		if len(res) == 0 {
+			b.del(target)
+			break
+		}
+		b.set(target, string(res))
+	case utility.RelabelLowercase:
+		b.set(rl.TargetLabel, strings.ToLower(val))
+	case utility.RelabelHashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % rl.Modulus
+		b.set(rl.TargetLabel, fmt.Sprintf("%d", mod))
+	case utility.RelabelLabelMap:
+		for _, l := range b.snapshot() {
+			if rl.re.MatchString(l.Name) {
+				b.set(rl.re.ReplaceAllString(l.Name, rl.Replacement), l.Value)
+			}
+		}
+	case utility.RelabelLabelDrop:
+		for _, l := range b.snapshot() {
+			if rl.re.MatchString(l.Name) {
+				b.del(l.Name)
+			}
+		}
+	case utility.RelabelLabelKeep:
+		for _, l := range b.snapshot() {
+			if !rl.re.MatchString(l.Name) {
+				b.del(l.Name)
+			}
+		}
+	}
+	return true
+}
+
+// builder label set being relabeled, copies the labels on the first change
+type builder struct {
+	ls      []prompb.Label
+	changed bool
+}
+
+func newBuilder(labels []prompb.Label) *builder {
+	return &builder{ls: labels}
+}
+
+func (b *builder) get(name string) string {
+	for _, l := range b.ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// snapshot the current labels, safe to range over while changing the builder
+func (b *builder) snapshot() []prompb.Label {
+	return append([]prompb.Label(nil), b.ls...)
+}
+
+func (b *builder) copyOnWrite() {
+	if !b.changed {
+		b.ls = append([]prompb.Label(nil), b.ls...)
+		b.changed = true
+	}
+}
+
+// set sets a label, an empty value removes it like in Prometheus
+func (b *builder) set(name string, value string) {
+	if value == "" {
+		b.del(name)
+		return
+	}
+	for i, l := range b.ls {
+		if l.Name == name {
+			if l.Value != value {
+				b.copyOnWrite()
+				b.ls[i].Value = value
+			}
+			return
+		}
+	}
+	b.copyOnWrite()
+	b.ls = append(b.ls, prompb.Label{Name: name, Value: value})
+}
+
+func (b *builder) del(name string) {
+	for i, l := range b.ls {
+		if l.Name == name {
+			b.copyOnWrite()
+			b.ls = append(b.ls[:i], b.ls[i+1:]...)
+			return
+		}
+	}
+}
+
+// labels the final label set sorted by name
+func (b *builder) labels() []prompb.Label {
+	sort.Slice(b.ls, func(i, j int) bool { return b.ls[i].Name < b.ls[j].Name })
+	return b.ls
+}
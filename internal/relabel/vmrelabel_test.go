@@ -0,0 +1,175 @@
+package vmrelabel
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	prompb "github.dev.pages/infrastructure/vmwriter/internal/prompb"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func mustNew(t *testing.T, config string) *Relabeler {
+	t.Helper()
+	var configs []utility.RelabelConfig
+	if err := yaml.UnmarshalStrict([]byte(config), &configs); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func labels(pairs ...string) []prompb.Label {
+	var ls []prompb.Label
+	for i := 0; i < len(pairs); i += 2 {
+		ls = append(ls, prompb.Label{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return ls
+}
+
+func TestProcess(t *testing.T) {
+	input := labels("__name__", "http_requests_total", "instance", "web-1:9090", "Job", "API", "pod_uid", "1234")
+
+	cases := []struct {
+		name   string
+		config string
+		want   []prompb.Label // nil means dropped
+	}{
+		{"replace", `
+- source_labels: [instance]
+  regex: '([^:]+):\d+'
+  target_label: host`,
+			labels("Job", "API", "__name__", "http_requests_total", "host", "web-1", "instance", "web-1:9090", "pod_uid", "1234")},
+		{"replace no match", `
+- source_labels: [instance]
+  regex: 'db-.*'
+  target_label: host`,
+			input},
+		{"replace empty deletes", `
+- source_labels: [missing]
+  target_label: pod_uid`,
+			labels("Job", "API", "__name__", "http_requests_total", "instance", "web-1:9090")},
+		{"keep", `
+- source_labels: [__name__]
+  regex: 'http_.*'
+  action: keep`,
+			input},
+		{"keep drops", `
+- source_labels: [__name__]
+  regex: 'node_.*'
+  action: keep`,
+			nil},
+		{"drop joined", `
+- source_labels: [__name__, Job]
+  separator: '@'
+  regex: 'http_requests_total@API'
+  action: drop`,
+			nil},
+		{"labeldrop", `
+- regex: 'pod_.*'
+  action: labeldrop`,
+			labels("Job", "API", "__name__", "http_requests_total", "instance", "web-1:9090")},
+		{"labelkeep", `
+- regex: '__name__|instance'
+  action: labelkeep`,
+			labels("__name__", "http_requests_total", "instance", "web-1:9090")},
+		{"labelmap", `
+- regex: 'pod_(.*)'
+  replacement: 'k8s_$1'
+  action: labelmap`,
+			labels("Job", "API", "__name__", "http_requests_total", "instance", "web-1:9090", "k8s_uid", "1234", "pod_uid", "1234")},
+		{"lowercase", `
+- source_labels: [Job]
+  target_label: job
+  action: lowercase
+- regex: Job
+  action: labeldrop`,
+			labels("__name__", "http_requests_total", "instance", "web-1:9090", "job", "api", "pod_uid", "1234")},
+	}
+
+	for _, c := range cases {
+		got, keep := mustNew(t, c.config).Process(input)
+		if c.want == nil {
+			if keep {
+				t.Errorf("%s: expected the series to be dropped, got %v", c.name, got)
+			}
+			continue
+		}
+		if !keep || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	if fmt.Sprint(input) != fmt.Sprint(labels("__name__", "http_requests_total", "instance", "web-1:9090", "Job", "API", "pod_uid", "1234")) {
+		t.Errorf("the input labels were modified: %v", input)
+	}
+}
+
+func TestHashMod(t *testing.T) {
+	r := mustNew(t, `
+- source_labels: [instance]
+  modulus: 4
+  target_label: __tmp_shard
+  action: hashmod
+- source_labels: [__tmp_shard]
+  regex: '1'
+  action: keep`)
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		if _, keep := r.Process(labels("instance", fmt.Sprintf("web-%d", i))); keep {
+			kept++
+		}
+	}
+	if kept < 200 || kept > 300 {
+		t.Errorf("expected about a quarter of the series to be kept, got %d", kept)
+	}
+
+	// The shard only depends on the label values so it is stable across restarts
+	got, _ := mustNew(t, `
+- source_labels: [instance]
+  modulus: 4
+  target_label: shard
+  action: hashmod`).Process(labels("instance", "localhost:9090"))
+	if fmt.Sprint(got) != fmt.Sprint(labels("instance", "localhost:9090", "shard", "2")) {
+		t.Errorf("unexpected hashmod result %v", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	r := mustNew(t, `
+- source_labels: [env]
+  regex: dev
+  action: drop`)
+
+	wr := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: labels("env", "prod")},
+		{Labels: labels("env", "dev")},
+		{Labels: labels("env", "prod")},
+	}}
+	out, kept := r.Apply(wr)
+	if len(out.Timeseries) != 2 || fmt.Sprint(kept) != "[0 2]" || len(wr.Timeseries) != 3 {
+		t.Errorf("expected series 0 and 2 to be kept, got %v", kept)
+	}
+
+	if out, kept := (*Relabeler)(nil).Apply(wr); out != wr || kept != nil {
+		t.Error("a nil relabeler should keep the request as it is")
+	}
+}
+
+func TestNewRejectsInvalidConfigs(t *testing.T) {
+	for _, c := range []utility.RelabelConfig{
+		{Action: "rename"},
+		{Action: utility.RelabelReplace, Regex: "(.*)"},
+		{Action: utility.RelabelHashMod, TargetLabel: "shard"},
+		{Action: utility.RelabelKeep, Regex: "("},
+	} {
+		if _, err := New([]utility.RelabelConfig{c}); err == nil {
+			t.Errorf("expected %+v to be rejected", c)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package vmupstreams
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_upstream_circuit_state",
+		Help: "Circuit breaker state per upstream, 0 closed, 1 open, 2 half-open",
+	}, []string{"pool", "upstream"})
+
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_upstream_circuit_transitions_total",
+		Help: "The total number of circuit breaker state changes per upstream",
+	}, []string{"pool", "upstream", "state"})
+
+	breakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_upstream_circuit_rejected_total",
+		Help: "The total number of writes not sent because the circuit breaker was open",
+	}, []string{"pool", "upstream"})
+)
+
+const breakerservice = "breaker"
+
+//BreakerState state of a circuit breaker
+type BreakerState int
+
+const (
+	//BreakerClosed writes flow normally
+	BreakerClosed BreakerState = iota
+	//BreakerOpen writes are rejected until the cool down has passed
+	BreakerOpen
+	//BreakerHalfOpen a single trial write is let through to see if the upstream recovered
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//Breaker passive circuit breaker for one upstream, opened by consecutive failed writes
+//
+// A nil Breaker is valid and always lets writes through.
+type Breaker struct {
+	mu        sync.Mutex
+	pool      string // pool the upstream belongs to, an upstream can be in several pools
+	name      string
+	threshold int
+	coolDown  time.Duration
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	trial     bool // trial whether the half-open trial write is in flight
+}
+
+//NewBreaker creates a closed breaker for the upstream name in pool that opens after threshold consecutive failures
+func NewBreaker(pool string, name string, threshold int, coolDown time.Duration) *Breaker {
+	b := &Breaker{pool: pool, name: name, threshold: threshold, coolDown: coolDown}
+	breakerState.WithLabelValues(pool, name).Set(float64(BreakerClosed))
+	return b
+}
+
+//Allow whether a write may be sent to the upstream
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.coolDown {
+			breakerRejected.WithLabelValues(b.pool, b.name).Inc()
+			return false
+		}
+		b.transition(BreakerHalfOpen)
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			breakerRejected.WithLabelValues(b.pool, b.name).Inc()
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+//Success records a successful write
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	if b.state != BreakerClosed {
+		b.transition(BreakerClosed)
+	}
+}
+
+//Failure records a failed write, a 5xx, timeout or refused connection
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.transition(BreakerOpen)
+	}
+}
+
+//State current state of the breaker
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// transition changes state, callers must hold the lock
+func (b *Breaker) transition(state BreakerState) {
+	log.Warn().Str("service", breakerservice).Msgf("Circuit breaker for %s changed from %s to %s after %d consecutive failures",
+		b.name, b.state, state, b.failures)
+	b.state = state
+	breakerState.WithLabelValues(b.pool, b.name).Set(float64(state))
+	breakerTransitions.WithLabelValues(b.pool, b.name, state.String()).Inc()
+}
+
+//Breaker returns the circuit breaker for the upstream url, nil when breakers are disabled
+func (v *VMUpstreams) Breaker(url string) *Breaker {
+	config := v.CurrentConfig()
+	if config.BreakerFailures <= 0 {
+		return nil
+	}
+
+	v.breakerMu.Lock()
+	defer v.breakerMu.Unlock()
+
+	if v.breakers == nil {
+		v.breakers = make(map[string]*Breaker)
+	}
+	b, ok := v.breakers[url]
+	if !ok {
+		b = NewBreaker(v.poolName(), url, config.BreakerFailures, time.Duration(config.BreakerCoolDownSeconds)*time.Second)
+		v.breakers[url] = b
+	}
+	return b
+}
+
+// resetBreakers drops every breaker so they are recreated with new thresholds
+func (v *VMUpstreams) resetBreakers() {
+	v.breakerMu.Lock()
+	defer v.breakerMu.Unlock()
+	for url := range v.breakers {
+		breakerState.DeleteLabelValues(v.poolName(), url)
+	}
+	v.breakers = nil
+}
+
+// forgetBreaker drops the breaker of an upstream that is no longer discovered
+func (v *VMUpstreams) forgetBreaker(url string) {
+	v.breakerMu.Lock()
+	defer v.breakerMu.Unlock()
+	if _, ok := v.breakers[url]; ok {
+		delete(v.breakers, url)
+		breakerState.DeleteLabelValues(v.poolName(), url)
+	}
+}
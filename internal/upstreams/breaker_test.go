@@ -0,0 +1,62 @@
+package vmupstreams
+
+import (
+	"testing"
+	"time"
+
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestBreakerStates(t *testing.T) {
+	b := NewBreaker(utility.DefaultPool, "http://10.0.0.1:8428/api/v1/write", 3, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		b.Failure()
+	}
+	if b.State() != BreakerClosed || !b.Allow() {
+		t.Fatal("breaker should stay closed below the threshold")
+	}
+
+	// A success resets the consecutive failure count
+	b.Success()
+	for i := 0; i < 3; i++ {
+		b.Failure()
+	}
+	if b.State() != BreakerOpen || b.Allow() {
+		t.Fatal("breaker should open after 3 consecutive failures")
+	}
+
+	// After the cool down a single trial is let through
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() || b.State() != BreakerHalfOpen {
+		t.Fatal("breaker should let a trial through after the cool down")
+	}
+	if b.Allow() {
+		t.Fatal("only one trial should be in flight")
+	}
+
+	// A failed trial opens the breaker again
+	b.Failure()
+	if b.State() != BreakerOpen {
+		t.Fatal("failed trial should reopen the breaker")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.Allow()
+	b.Success()
+	if b.State() != BreakerClosed || !b.Allow() {
+		t.Fatal("successful trial should close the breaker")
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	var v VMUpstreams
+	b := v.Breaker("http://10.0.0.1:8428/api/v1/write")
+	if b != nil {
+		t.Fatal("breakers should be disabled without a threshold")
+	}
+	b.Failure()
+	if !b.Allow() {
+		t.Error("a disabled breaker should always allow writes")
+	}
+}
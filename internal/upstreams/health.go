@@ -0,0 +1,176 @@
+package vmupstreams
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	upstreamUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_upstream_up",
+		Help: "Whether the upstream passed its health checks (1) or not (0)",
+	}, []string{"pool", "upstream"})
+
+	upstreamHealthChecksFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmwriter_upstream_health_checks_failed_total",
+		Help: "The total number of failed health checks per upstream",
+	}, []string{"pool", "upstream"})
+
+	upstreamHealthCheckDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_upstream_health_check_duration_seconds",
+		Help: "Duration of the last health check per upstream",
+	}, []string{"pool", "upstream"})
+)
+
+const healthservice = "health"
+
+// healthState consecutive probe results for one upstream
+type healthState struct {
+	successes int
+	failures  int
+}
+
+//HealthURL url probed to check the upstream is healthy
+func (v *VMUpstream) HealthURL(path string) string {
+	return v.BaseURL() + path
+}
+
+//HealthServiceWorker Continuously probes the upstreams and marks them up or down
+func (v *VMUpstreams) HealthServiceWorker() error {
+
+	config := v.CurrentConfig()
+	if config.ServicePollingSeconds <= 0 {
+		return fmt.Errorf("health checks need a positive polling interval, got %d", config.ServicePollingSeconds)
+	}
+
+	client := &http.Client{Timeout: time.Duration(config.HTTPTimeOut) * time.Second}
+
+	for {
+		// Reread every round so a reloaded interval and timeout take effect
+		current := v.CurrentConfig()
+		interval := current.ServicePollingSeconds
+		if interval <= 0 {
+			interval = config.ServicePollingSeconds
+		}
+		if timeout := time.Duration(current.HTTPTimeOut) * time.Second; timeout > 0 && timeout != client.Timeout {
+			client = &http.Client{Timeout: timeout}
+		}
+		time.Sleep(time.Second * time.Duration(interval))
+		v.CheckHealth(client)
+	}
+}
+
+//CheckHealth probes every upstream once and flips its status once it passes the rise or fall threshold
+func (v *VMUpstreams) CheckHealth(client *http.Client) {
+
+	uslist, err := v.UpstreamList()
+	if err != nil {
+		log.Error().Err(err).Str("service", healthservice).Msg("Error getting upstream list")
+		return
+	}
+
+	config := v.CurrentConfig()
+	results := make([]bool, len(uslist))
+
+	var wg sync.WaitGroup
+	for i, u := range uslist {
+		wg.Add(1)
+		go func(i int, u VMUpstream) {
+			defer wg.Done()
+			results[i] = probe(client, v.poolName(), u, config.HealthCheckPath)
+		}(i, u)
+	}
+	wg.Wait()
+
+	v.healthMu.Lock()
+	if v.health == nil {
+		v.health = make(map[string]*healthState)
+	}
+
+	seen := make(map[string]bool)
+	changed := false
+	for i, u := range uslist {
+		// Upstreams on the same host with other ports are checked on their own
+		seen[u.URL()] = true
+		state, ok := v.health[u.URL()]
+		if !ok {
+			state = &healthState{}
+			v.health[u.URL()] = state
+		}
+
+		if results[i] {
+			state.successes++
+			state.failures = 0
+		} else {
+			state.failures++
+			state.successes = 0
+			upstreamHealthChecksFailed.WithLabelValues(v.poolName(), u.URL()).Inc()
+		}
+
+		status := u.Status
+		if !u.Status && state.successes >= config.HealthRise {
+			status = true
+			log.Info().Str("service", healthservice).Msgf("Upstream %s passed %d health checks, marking up", u.URL(), state.successes)
+		}
+		if u.Status && state.failures >= config.HealthFall {
+			status = false
+			log.Warn().Str("service", healthservice).Msgf("Upstream %s failed %d health checks, marking down", u.URL(), state.failures)
+		}
+
+		if status != u.Status {
+			u.Status = status
+			if err := v.SetUpstreamStatus(u, status); err != nil {
+				log.Error().Err(err).Str("service", healthservice).Msgf("Error updating upstream %s", u.URL())
+			}
+			changed = true
+		}
+
+		if u.Status {
+			upstreamUp.WithLabelValues(v.poolName(), u.URL()).Set(1)
+		} else {
+			upstreamUp.WithLabelValues(v.poolName(), u.URL()).Set(0)
+		}
+	}
+
+	// Forget upstreams that are no longer discovered
+	for url := range v.health {
+		if !seen[url] {
+			delete(v.health, url)
+		}
+	}
+	v.healthMu.Unlock()
+
+	if changed {
+		activeHostList, err := v.GetActiveHostList()
+		if err == nil {
+			currentUpstreams.Set(float64(len(activeHostList)))
+		}
+	}
+}
+
+// probe runs a single health check against the upstream
+func probe(client *http.Client, pool string, u VMUpstream, path string) bool {
+	start := time.Now()
+	defer func() {
+		upstreamHealthCheckDuration.WithLabelValues(pool, u.URL()).Set(time.Since(start).Seconds())
+	}()
+
+	resp, err := client.Get(u.HealthURL(path))
+	if err != nil {
+		log.Debug().Err(err).Str("service", healthservice).Msgf("Health check failed for %s", u.Host)
+		return false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Debug().Str("service", healthservice).Msgf("Health check for %s returned %s", u.Host, resp.Status)
+		return false
+	}
+	return true
+}
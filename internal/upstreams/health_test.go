@@ -0,0 +1,93 @@
+package vmupstreams
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckHealthRiseFall(t *testing.T) {
+	var healthy int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	var v VMUpstreams
+	v.Config.HealthCheckPath = "/health"
+	v.Config.HealthRise = 2
+	v.Config.HealthFall = 3
+	v.AddUpstream(VMUpstream{Host: host, Port: port, URI: "/api/v1/write", Status: true})
+
+	status := func() bool {
+		list, _ := v.UpstreamList()
+		return list[0].Status
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	for i := 1; i <= 3; i++ {
+		v.CheckHealth(srv.Client())
+		if want := i < 3; status() != want {
+			t.Fatalf("after %d failed checks expected status %v", i, want)
+		}
+	}
+	if v.GetRing().Len() != 0 {
+		t.Error("down upstream should be removed from the ring")
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	for i := 1; i <= 2; i++ {
+		v.CheckHealth(srv.Client())
+		if want := i == 2; status() != want {
+			t.Fatalf("after %d passing checks expected status %v", i, want)
+		}
+	}
+
+	hosts, _ := v.GetActiveHostList()
+	if len(hosts) != 1 {
+		t.Errorf("expected the upstream to be active again, got %v", hosts)
+	}
+}
+
+func TestCheckHealthSameHostOtherPort(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	var v VMUpstreams
+	v.Config.HealthCheckPath = "/health"
+	v.Config.HealthRise = 2
+	v.Config.HealthFall = 3
+	for _, srv := range []*httptest.Server{ok, failing} {
+		host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		port, _ := strconv.Atoi(portStr)
+		v.AddUpstream(VMUpstream{Host: host, Port: port, URI: "/api/v1/write", Status: true})
+	}
+
+	for i := 0; i < 6; i++ {
+		v.CheckHealth(ok.Client())
+	}
+
+	list, _ := v.UpstreamList()
+	if !list[0].Status || list[1].Status {
+		t.Errorf("expected only the failing upstream to be down, got %v and %v", list[0].Status, list[1].Status)
+	}
+	if list[0].Port == list[1].Port {
+		t.Errorf("status update changed the port of the other upstream on the host")
+	}
+}
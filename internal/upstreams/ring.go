@@ -0,0 +1,214 @@
+package vmupstreams
+
+import (
+	"math"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+
+	vmdiscovery "github.dev.pages/infrastructure/vmwriter/internal/discovery"
+)
+
+//Ring rendezvous (highest random weight) hash ring over a set of upstreams
+//
+// Every node scores every series and the series is placed on the R nodes with the
+// highest scores.  Scores grow with the node weight so heavier nodes win more series.
+// When a node joins it only takes the series it now outscores the others for, and
+// when a node leaves only the series it held move, so membership changes reshuffle
+// the minimum share of series.
+// SEE: https://en.wikipedia.org/wiki/Rendezvous_hashing
+type Ring struct {
+	nodes             []ringNode
+	replicationFactor int
+	zones             map[string]string // zones availability zone of each node url
+}
+
+type ringNode struct {
+	url    string
+	hash   uint64
+	zone   string
+	weight float64
+}
+
+//NewRing creates a ring from the active upstreams in the list
+func NewRing(upstreams []VMUpstream, replicationFactor int) *Ring {
+	if replicationFactor < 1 {
+		replicationFactor = 1
+	}
+
+	r := &Ring{replicationFactor: replicationFactor, zones: make(map[string]string)}
+	for _, u := range upstreams {
+		if u.Active() {
+			url := u.URL()
+			zone := u.Meta[vmdiscovery.MetaZone]
+			r.nodes = append(r.nodes, ringNode{url: url, hash: xxhash.Sum64String(url), zone: zone, weight: u.weight()})
+			r.zones[url] = zone
+		}
+	}
+
+	// Keep the node order stable so ties always resolve the same way
+	sort.Slice(r.nodes, func(i, j int) bool { return r.nodes[i].url < r.nodes[j].url })
+
+	return r
+}
+
+//Len number of nodes in the ring
+func (r *Ring) Len() int {
+	return len(r.nodes)
+}
+
+//Nodes urls of the nodes in the ring
+func (r *Ring) Nodes() []string {
+	urls := make([]string, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		urls = append(urls, n.url)
+	}
+	return urls
+}
+
+//ReplicationFactor number of distinct nodes each series is placed on
+func (r *Ring) ReplicationFactor() int {
+	return r.replicationFactor
+}
+
+//Lookup returns the urls of the nodes a series hash belongs to, best first
+func (r *Ring) Lookup(seriesHash uint64) []string {
+	return r.urls(r.top(seriesHash, r.replicationFactor, nil))
+}
+
+//LookupZone places a series like Lookup but keeps the first copy in zone to avoid cross zone traffic
+//
+// The first node is the best node in zone, the other replicas go to the best nodes in the other
+// zones so the data still survives the loss of a zone.  Zones without enough nodes are filled up
+// from the remaining nodes.  Without nodes in zone the placement is the same as Lookup.
+func (r *Ring) LookupZone(seriesHash uint64, zone string) []string {
+	if zone == "" || !r.hasZone(zone) {
+		return r.Lookup(seriesHash)
+	}
+
+	local := func(i int) bool { return r.nodes[i].zone == zone }
+	remote := func(i int) bool { return r.nodes[i].zone != zone }
+
+	placed := r.top(seriesHash, 1, local)
+	placed = append(placed, r.top(seriesHash, r.replicationFactor-1, remote)...)
+	if missing := r.replicationFactor - len(placed); missing > 0 {
+		chosen := make(map[int]bool, len(placed))
+		for _, i := range placed {
+			chosen[i] = true
+		}
+		placed = append(placed, r.top(seriesHash, missing, func(i int) bool { return local(i) && !chosen[i] })...)
+	}
+	return r.urls(placed)
+}
+
+//ReplicateZone returns every node in zone plus the best node of each other zone for a series
+//
+// Used to replicate without sending every copy across zones, each other zone still holds a copy.
+// Without nodes in zone every node is returned.
+func (r *Ring) ReplicateZone(seriesHash uint64, zone string) []string {
+	if zone == "" || !r.hasZone(zone) {
+		return r.Nodes()
+	}
+
+	var urls []string
+	others := make(map[string]bool)
+	for _, n := range r.nodes {
+		if n.zone == zone {
+			urls = append(urls, n.url)
+		} else {
+			others[n.zone] = true
+		}
+	}
+	for other := range others {
+		urls = append(urls, r.urls(r.top(seriesHash, 1, func(i int) bool { return r.nodes[i].zone == other }))...)
+	}
+	return urls
+}
+
+//Zone availability zone of the node with url, empty when unknown
+func (r *Ring) Zone(url string) string {
+	return r.zones[url]
+}
+
+// hasZone whether any node is in zone
+func (r *Ring) hasZone(zone string) bool {
+	for _, n := range r.nodes {
+		if n.zone == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// urls the urls of the nodes at the positions
+func (r *Ring) urls(idx []int) []string {
+	if len(idx) == 0 {
+		return nil
+	}
+	urls := make([]string, 0, len(idx))
+	for _, i := range idx {
+		urls = append(urls, r.nodes[i].url)
+	}
+	return urls
+}
+
+// top positions of the count nodes accepted by filter with the highest scores for a series, best first
+func (r *Ring) top(seriesHash uint64, count int, filter func(i int) bool) []int {
+	if count > len(r.nodes) {
+		count = len(r.nodes)
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	type scored struct {
+		idx   int
+		score float64
+	}
+
+	// Keep the top scores in a small sorted slice, R is tiny compared to the node count
+	top := make([]scored, 0, count+1)
+	for i, n := range r.nodes {
+		if filter != nil && !filter(i) {
+			continue
+		}
+		s := scored{i, weightedScore(mix64(seriesHash^n.hash), n.weight)}
+		if len(top) == count && s.score <= top[count-1].score {
+			continue
+		}
+		pos := sort.Search(len(top), func(j int) bool { return top[j].score < s.score })
+		top = append(top, scored{})
+		copy(top[pos+1:], top[pos:])
+		top[pos] = s
+		if len(top) > count {
+			top = top[:count]
+		}
+	}
+
+	idx := make([]int, 0, len(top))
+	for _, s := range top {
+		idx = append(idx, s.idx)
+	}
+	return idx
+}
+
+// weightedScore turns a hash into a score so a node wins a share of the series in proportion to its weight
+//
+// Uses -weight / ln(u) with u the hash mapped into (0, 1).  It is increasing in the hash, so with
+// equal weights the order is the same as comparing the hashes directly.
+// SEE: https://www.snia.org/sites/default/files/SDC15_presentations/dist_sys/Jason_Resch_New_Consistent_Hashings_Rev.pdf
+func weightedScore(hash uint64, weight float64) float64 {
+	u := (float64(hash>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// mix64 is the splitmix64 finalizer, it spreads the combined series and node hashes
+// so the scores of one series on different nodes are independent
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
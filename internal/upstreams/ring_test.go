@@ -0,0 +1,239 @@
+package vmupstreams
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+
+	vmdiscovery "github.dev.pages/infrastructure/vmwriter/internal/discovery"
+)
+
+const ringTestSeries = 20000
+
+func ringTestUpstreams(n int) []VMUpstream {
+	var list []VMUpstream
+	for i := 0; i < n; i++ {
+		list = append(list, VMUpstream{Host: fmt.Sprintf("10.0.0.%d", i+1), Port: 8428, URI: "/api/v1/write", Status: true})
+	}
+	return list
+}
+
+// placements looks up every test series and returns the set of nodes for each
+func placements(r *Ring) []map[string]bool {
+	out := make([]map[string]bool, ringTestSeries)
+	for i := 0; i < ringTestSeries; i++ {
+		set := make(map[string]bool)
+		for _, node := range r.Lookup(xxhash.Sum64String(fmt.Sprintf("series_%d", i))) {
+			set[node] = true
+		}
+		out[i] = set
+	}
+	return out
+}
+
+// moved counts how many replicas changed node between two placements
+func moved(before, after []map[string]bool) int {
+	n := 0
+	for i := range before {
+		for node := range after[i] {
+			if !before[i][node] {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestRingReplicationFactor(t *testing.T) {
+	r := NewRing(ringTestUpstreams(5), 3)
+
+	for i, set := range placements(r) {
+		if len(set) != 3 {
+			t.Fatalf("series %d placed on %d distinct nodes, expected 3", i, len(set))
+		}
+	}
+
+	// Asking for more replicas than nodes places the series everywhere
+	small := NewRing(ringTestUpstreams(2), 3)
+	if got := len(small.Lookup(42)); got != 2 {
+		t.Errorf("expected 2 nodes, got %d", got)
+	}
+
+	if got := NewRing(nil, 1).Lookup(42); len(got) != 0 {
+		t.Errorf("expected no nodes from an empty ring, got %v", got)
+	}
+}
+
+func TestRingIgnoresInactiveUpstreams(t *testing.T) {
+	list := ringTestUpstreams(3)
+	list[1].Status = false
+
+	r := NewRing(list, 1)
+	if r.Len() != 2 {
+		t.Fatalf("expected 2 nodes, got %d", r.Len())
+	}
+	for _, node := range r.Nodes() {
+		if node == list[1].URL() {
+			t.Errorf("inactive upstream %s is in the ring", node)
+		}
+	}
+}
+
+func TestRingBalance(t *testing.T) {
+	r := NewRing(ringTestUpstreams(5), 1)
+
+	counts := make(map[string]int)
+	for _, set := range placements(r) {
+		for node := range set {
+			counts[node]++
+		}
+	}
+
+	ideal := ringTestSeries / 5
+	for node, c := range counts {
+		if c < ideal*8/10 || c > ideal*12/10 {
+			t.Errorf("node %s holds %d series, expected about %d", node, c, ideal)
+		}
+	}
+}
+
+func TestRingMovementOnAdd(t *testing.T) {
+	for _, rf := range []int{1, 2, 3} {
+		list := ringTestUpstreams(5)
+		before := placements(NewRing(list, rf))
+
+		list = append(list, VMUpstream{Host: "10.0.0.100", Port: 8428, URI: "/api/v1/write", Status: true})
+		after := placements(NewRing(list, rf))
+
+		// The new node should take its fair share of replicas and nothing more
+		ideal := ringTestSeries * rf / 6
+		got := moved(before, after)
+		t.Logf("rf=%d add node: %d of %d replicas moved (ideal %d)", rf, got, ringTestSeries*rf, ideal)
+		if got > ideal*12/10 {
+			t.Errorf("rf=%d: %d replicas moved when adding a node, expected about %d", rf, got, ideal)
+		}
+
+		// Every moved replica must have moved onto the new node
+		newURL := list[5].URL()
+		for i := range before {
+			for node := range after[i] {
+				if !before[i][node] && node != newURL {
+					t.Fatalf("rf=%d: series %d moved to existing node %s", rf, i, node)
+				}
+			}
+		}
+	}
+}
+
+func TestRingMovementOnRemove(t *testing.T) {
+	for _, rf := range []int{1, 2, 3} {
+		list := ringTestUpstreams(6)
+		before := placements(NewRing(list, rf))
+
+		removed := list[2].URL()
+		list = append(list[:2], list[3:]...)
+		after := placements(NewRing(list, rf))
+
+		// Only the replicas held by the removed node may move
+		held := 0
+		for i := range before {
+			if before[i][removed] {
+				held++
+			}
+		}
+
+		got := moved(before, after)
+		t.Logf("rf=%d remove node: %d of %d replicas moved (held by removed node %d)", rf, got, ringTestSeries*rf, held)
+		if got != held {
+			t.Errorf("rf=%d: %d replicas moved when removing a node that held %d", rf, got, held)
+		}
+	}
+}
+
+func zonedUpstreams() []VMUpstream {
+	list := ringTestUpstreams(6)
+	for i := range list {
+		list[i].Meta = map[string]string{vmdiscovery.MetaZone: fmt.Sprintf("zone-%c", 'a'+i%3)}
+	}
+	return list
+}
+
+func TestRingLookupZone(t *testing.T) {
+	r := NewRing(zonedUpstreams(), 2)
+
+	first := make(map[string]int)
+	for i := 0; i < ringTestSeries; i++ {
+		nodes := r.LookupZone(xxhash.Sum64String(fmt.Sprintf("series_%d", i)), "zone-a")
+		if len(nodes) != 2 {
+			t.Fatalf("series %d placed on %v, expected 2 nodes", i, nodes)
+		}
+		if r.Zone(nodes[0]) != "zone-a" {
+			t.Fatalf("series %d first copy in %s, expected zone-a", i, r.Zone(nodes[0]))
+		}
+		if r.Zone(nodes[1]) == "zone-a" {
+			t.Fatalf("series %d has no copy outside zone-a", i)
+		}
+		first[nodes[0]]++
+	}
+
+	// Both upstreams in the zone share the first copies
+	for node, c := range first {
+		if c < ringTestSeries/2*8/10 {
+			t.Errorf("node %s holds %d first copies, expected about %d", node, c, ringTestSeries/2)
+		}
+	}
+
+	// A zone without upstreams falls back to the plain placement
+	if got, want := r.LookupZone(42, "zone-x"), r.Lookup(42); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestRingReplicateZone(t *testing.T) {
+	r := NewRing(zonedUpstreams(), 1)
+
+	for i := 0; i < 100; i++ {
+		nodes := r.ReplicateZone(xxhash.Sum64String(fmt.Sprintf("series_%d", i)), "zone-b")
+		zones := make(map[string]int)
+		for _, n := range nodes {
+			zones[r.Zone(n)]++
+		}
+		if zones["zone-b"] != 2 || zones["zone-a"] != 1 || zones["zone-c"] != 1 {
+			t.Fatalf("expected every node in zone-b and one in each other zone, got %v", zones)
+		}
+	}
+}
+
+func TestRingWeights(t *testing.T) {
+	list := ringTestUpstreams(3)
+	list[0].Weight = 2
+	r := NewRing(list, 1)
+
+	counts := make(map[string]int)
+	for _, set := range placements(r) {
+		for node := range set {
+			counts[node]++
+		}
+	}
+
+	// Total weight 4, the heavy node should hold half of the series
+	for i, u := range list {
+		ideal := ringTestSeries * int(u.weight()) / 4
+		if c := counts[u.URL()]; c < ideal*9/10 || c > ideal*11/10 {
+			t.Errorf("node %d with weight %v holds %d series, expected about %d", i, u.weight(), c, ideal)
+		}
+	}
+
+	// Raising a weight only moves series onto that node
+	before := placements(r)
+	list[1].Weight = 3
+	after := placements(NewRing(list, 1))
+	for i := range before {
+		for node := range after[i] {
+			if !before[i][node] && node != list[1].URL() {
+				t.Fatalf("series %d moved to %s whose weight did not change", i, node)
+			}
+		}
+	}
+}
@@ -2,7 +2,12 @@
 package vmupstreams
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"reflect"
+	"strconv"
 	"sync"
 	"time"
 
@@ -10,6 +15,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/rs/zerolog/log"
+
+	vmdiscovery "github.dev.pages/infrastructure/vmwriter/internal/discovery"
 	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
 )
 
@@ -18,6 +25,16 @@ var (
 		Name: "current_upstreams",
 		Help: "current available upstreams",
 	})
+
+	poolUpstreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_pool_upstreams",
+		Help: "Upstreams of the pool receiving writes",
+	}, []string{"pool"})
+
+	upstreamWeight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vmwriter_upstream_weight",
+		Help: "Weight of the upstream when sharding, 0 while it is draining",
+	}, []string{"pool", "upstream"})
 )
 
 //VMUpstream upstream for prometheus compatible instance
@@ -26,13 +43,62 @@ type VMUpstream struct {
 	Status bool
 	Port   int
 	URI    string
+	Meta   map[string]string // Meta metadata from the discoverer that found the upstream
+
+	Draining bool    // Draining the upstream is going away, it receives no new writes but its queue is still replayed
+	Weight   float64 // Weight relative share of the series the upstream receives when sharding, 0 counts as 1
+
+	AdminDrained bool // AdminDrained drained through the admin API, discovery does not change it
+}
+
+//URL write url for the upstream
+func (v *VMUpstream) URL() string {
+	return v.BaseURL() + v.URI
+}
+
+//BaseURL url of the upstream without the write path
+func (v *VMUpstream) BaseURL() string {
+	// IPv6 hosts need brackets around them
+	return "http://" + net.JoinHostPort(v.Host, strconv.Itoa(v.Port))
+}
+
+//Active whether the upstream should receive new writes, it is healthy and not draining
+func (v *VMUpstream) Active() bool {
+	return v.Status && !v.IsDraining()
+}
+
+//IsDraining whether the upstream is drained by discovery or through the admin API
+func (v *VMUpstream) IsDraining() bool {
+	return v.Draining || v.AdminDrained
+}
+
+// weight the weight used for placement, unset weights count as 1
+func (v *VMUpstream) weight() float64 {
+	if v.Weight <= 0 {
+		return 1
+	}
+	return v.Weight
 }
 
 //VMUpstreams list of prometheus compatible upstreams
 type VMUpstreams struct {
+	Name   string       // Name of the pool, empty for the default pool
 	Mu     sync.RWMutex // RW Mutex
 	UList  []VMUpstream // UList list of Upstream objects
 	Config utility.VConfig
+	ring   *Ring // ring hash ring over the active upstreams, rebuilt whenever UList changes
+
+	healthMu sync.Mutex              // healthMu protects health
+	health   map[string]*healthState // health consecutive health check results keyed by upstream url
+
+	breakerMu sync.Mutex          // breakerMu protects breakers
+	breakers  map[string]*Breaker // breakers passive circuit breakers keyed by upstream url
+
+	adminDrained map[string]bool // adminDrained hosts drained through the admin API, protected by Mu
+
+	discoverer  vmdiscovery.Discoverer // discoverer finds the upstreams, protected by Mu
+	watchCancel context.CancelFunc     // watchCancel stops the watch of the current discoverer
+	changed     chan struct{}          // changed signalled by watching discoverers when the targets changed
 }
 
 const watcher = "watcher"
@@ -45,6 +111,14 @@ func (v *VMUpstreams) VMUpstreamsInitialize(config *utility.VConfig) error {
 	// Load the current configuration
 	v.Config = *config
 
+	if v.getDiscoverer() == nil {
+		d, err := vmdiscovery.FromConfig(config)
+		if err != nil {
+			return err
+		}
+		v.SetDiscoverer(d)
+	}
+
 	// Load the upstreams
 	err := v.LoadUpstreams()
 	if err != nil {
@@ -54,12 +128,108 @@ func (v *VMUpstreams) VMUpstreamsInitialize(config *utility.VConfig) error {
 	return nil
 }
 
+//CurrentConfig returns a copy of the configuration in use (Thread Safe)
+func (v *VMUpstreams) CurrentConfig() utility.VConfig {
+	v.Mu.RLock()
+	defer v.Mu.RUnlock()
+	return v.Config
+}
+
+//SetConfig swaps in a new configuration, used when the configuration is reloaded (Thread Safe)
+func (v *VMUpstreams) SetConfig(config *utility.VConfig) error {
+	p, err := v.PrepareConfig(config)
+	if err != nil {
+		return err
+	}
+	p.Apply()
+	return nil
+}
+
+//PendingConfig a configuration whose discovery was set up, ready to be swapped in with Apply
+type PendingConfig struct {
+	v          *VMUpstreams
+	config     utility.VConfig
+	discoverer vmdiscovery.Discoverer // discoverer nil when the discovery settings did not change
+}
+
+//PrepareConfig sets up the discovery of config without touching the configuration in use, so
+//several pools can be checked before any of them changes (Thread Safe)
+func (v *VMUpstreams) PrepareConfig(config *utility.VConfig) (*PendingConfig, error) {
+	old := v.CurrentConfig()
+	p := &PendingConfig{v: v, config: *config}
+
+	// Only restart discovery when its settings changed
+	if v.getDiscoverer() == nil || !reflect.DeepEqual(old.DiscoveryConfig, config.DiscoveryConfig) {
+		d, err := vmdiscovery.FromConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		p.discoverer = d
+	}
+
+	return p, nil
+}
+
+//Apply swaps in the prepared configuration (Thread Safe)
+func (p *PendingConfig) Apply() {
+	v := p.v
+	if p.discoverer != nil {
+		v.SetDiscoverer(p.discoverer)
+	}
+
+	v.Mu.Lock()
+	v.Config = p.config
+	// The replication factor may have changed
+	v.rebuildRing()
+	v.Mu.Unlock()
+
+	// Thresholds may have changed, breakers start closed again with the new ones
+	v.resetBreakers()
+}
+
+//SetDiscoverer replaces the discoverer used to find upstreams and starts its watch if it has one (Thread Safe)
+func (v *VMUpstreams) SetDiscoverer(d vmdiscovery.Discoverer) {
+	v.Mu.Lock()
+	defer v.Mu.Unlock()
+
+	if v.watchCancel != nil {
+		v.watchCancel()
+		v.watchCancel = nil
+	}
+	if v.changed == nil {
+		v.changed = make(chan struct{}, 1)
+	}
+
+	v.discoverer = d
+
+	if w, ok := d.(vmdiscovery.Watcher); ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		v.watchCancel = cancel
+		changed := v.changed
+		go w.Watch(ctx, func() {
+			// Coalesce bursts of changes into a single reload
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+}
+
+// getDiscoverer returns the current discoverer (Thread Safe)
+func (v *VMUpstreams) getDiscoverer() vmdiscovery.Discoverer {
+	v.Mu.RLock()
+	defer v.Mu.RUnlock()
+	return v.discoverer
+}
+
 //UpstreamList obtains the current list of upstreams and returns a thread safe copy
 func (v *VMUpstreams) UpstreamList() ([]VMUpstream, error) {
 	v.Mu.RLock()
 	defer v.Mu.RUnlock()
 	// Return a copy
-	us := v.UList
+	us := make([]VMUpstream, len(v.UList))
+	copy(us, v.UList)
 
 	return us, nil
 }
@@ -68,26 +238,94 @@ func (v *VMUpstreams) UpstreamList() ([]VMUpstream, error) {
 func (v *VMUpstreams) AddUpstream(upstream VMUpstream) error {
 	v.Mu.Lock()
 	defer v.Mu.Unlock()
+	// A drained host that is rediscovered stays drained
+	upstream.AdminDrained = v.adminDrained[upstream.Host]
 	v.UList = append(v.UList, upstream)
+	v.rebuildRing()
 
 	return nil
 }
 
-//UpdateUpstreamByHost updates the status of an upstream keyed by
+//SetAdminDrain drains or undrains every upstream on host and returns them (Thread Safe)
+//
+// The state is kept per host so it survives the upstream disappearing from and coming back to discovery.
+func (v *VMUpstreams) SetAdminDrain(host string, drain bool) ([]VMUpstream, error) {
+	v.Mu.Lock()
+	defer v.Mu.Unlock()
+
+	var found []VMUpstream
+	for i := range v.UList {
+		if v.UList[i].Host == host {
+			v.UList[i].AdminDrained = drain
+			found = append(found, v.UList[i])
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("upstream %s not found", host)
+	}
+
+	if v.adminDrained == nil {
+		v.adminDrained = make(map[string]bool)
+	}
+	if drain {
+		log.Info().Str("service", watcher).Msgf("Draining upstream %s through the admin API", host)
+		v.adminDrained[host] = true
+	} else {
+		log.Info().Str("service", watcher).Msgf("Upstream %s is back in service", host)
+		delete(v.adminDrained, host)
+	}
+	v.rebuildRing()
+
+	return found, nil
+}
+
+//UpstreamsByHost returns a copy of every upstream on host (Thread Safe)
+func (v *VMUpstreams) UpstreamsByHost(host string) []VMUpstream {
+	v.Mu.RLock()
+	defer v.Mu.RUnlock()
+
+	var found []VMUpstream
+	for _, u := range v.UList {
+		if u.Host == host {
+			found = append(found, u)
+		}
+	}
+	return found
+}
+
+//UpdateUpstreamByHost updates the status of an upstream keyed by host and port, other
+//upstreams on the same host are left alone
 func (v *VMUpstreams) UpdateUpstreamByHost(upstream VMUpstream) error {
 	v.Mu.Lock()
 	defer v.Mu.Unlock()
 	for i, ulist := range v.UList {
-		if ulist.Host == upstream.Host {
+		if ulist.Host == upstream.Host && ulist.Port == upstream.Port {
 			// Reference the object
 			u := &v.UList[i]
-			u.Port = upstream.Port
 			u.Status = upstream.Status
 			u.URI = upstream.URI
+			u.Meta = upstream.Meta
+			v.rebuildRing()
+			return nil
 		}
 	}
 
-	return nil
+	return fmt.Errorf("upstream %s not found", upstream.BaseURL())
+}
+
+//SetUpstreamStatus marks the upstream matching u on host, port and URI up or down (Thread Safe)
+func (v *VMUpstreams) SetUpstreamStatus(u VMUpstream, status bool) error {
+	v.Mu.Lock()
+	defer v.Mu.Unlock()
+	for i := range v.UList {
+		if v.UList[i].CEqual(u) {
+			v.UList[i].Status = status
+			v.rebuildRing()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("upstream %s not found", u.URL())
 }
 
 //DeleteUpstreamByHost removes upstream from the list (Thread Safe)
@@ -104,16 +342,85 @@ func (v *VMUpstreams) DeleteUpstreamByHost(host string) error {
 			idx = i
 		}
 	}
+	if idx == -1 {
+		return fmt.Errorf("upstream %s not found", host)
+	}
+
+	// The upstream is gone so stop reporting its health
+	upstreamUp.DeleteLabelValues(v.poolName(), v.UList[idx].URL())
+	upstreamWeight.DeleteLabelValues(v.poolName(), v.UList[idx].URL())
+	v.forgetBreaker(v.UList[idx].URL())
 
 	// Copy last element to idx
 	v.UList[idx] = v.UList[len(v.UList)-1]
 
 	// Erase the last element from the slice
 	v.UList = v.UList[:len(v.UList)-1]
+	v.rebuildRing()
 
 	return nil
 }
 
+// refresh replaces what the discoverer knows about the upstream matching u on host, port and URI (Thread Safe)
+func (v *VMUpstreams) refresh(u VMUpstream) {
+	v.Mu.Lock()
+	defer v.Mu.Unlock()
+
+	for i := range v.UList {
+		if v.UList[i].CEqual(u) {
+			if u.Draining && !v.UList[i].Draining {
+				log.Info().Str("service", watcher).Msgf("Draining upstream %s", u.URL())
+			}
+			v.UList[i].Meta = u.Meta
+			v.UList[i].Draining = u.Draining
+			v.UList[i].Weight = u.Weight
+		}
+	}
+	v.rebuildRing()
+}
+
+// deleteUpstream removes the upstream matching u on host, port and URI (Thread Safe)
+func (v *VMUpstreams) deleteUpstream(u VMUpstream) error {
+	v.Mu.Lock()
+	defer v.Mu.Unlock()
+
+	for i := range v.UList {
+		if v.UList[i].CEqual(u) {
+			upstreamUp.DeleteLabelValues(v.poolName(), v.UList[i].URL())
+			upstreamWeight.DeleteLabelValues(v.poolName(), v.UList[i].URL())
+			v.forgetBreaker(v.UList[i].URL())
+			v.UList = append(v.UList[:i], v.UList[i+1:]...)
+			v.rebuildRing()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("upstream %s not found", u.URL())
+}
+
+//rebuildRing recreates the hash ring from the current list, callers must hold the write lock
+func (v *VMUpstreams) rebuildRing() {
+	v.ring = NewRing(v.UList, v.Config.ReplicationFactor)
+
+	for i := range v.UList {
+		weight := v.UList[i].weight()
+		if v.UList[i].IsDraining() {
+			weight = 0
+		}
+		upstreamWeight.WithLabelValues(v.poolName(), v.UList[i].URL()).Set(weight)
+	}
+}
+
+//GetRing returns the hash ring over the active upstreams (Thread Safe)
+func (v *VMUpstreams) GetRing() *Ring {
+	v.Mu.RLock()
+	defer v.Mu.RUnlock()
+	if v.ring == nil {
+		return NewRing(nil, v.Config.ReplicationFactor)
+	}
+	return v.ring
+}
+
 //GetActiveHostList get a list of hosts (Thread Safe)
 func (v *VMUpstreams) GetActiveHostList() ([]string, error) {
 
@@ -121,8 +428,8 @@ func (v *VMUpstreams) GetActiveHostList() ([]string, error) {
 	defer v.Mu.RUnlock()
 	var retList []string
 	for _, upstream := range v.UList {
-		if upstream.Status == true {
-			retList = append(retList, fmt.Sprintf("http://%s:%d%s", upstream.Host, upstream.Port, upstream.URI))
+		if upstream.Active() {
+			retList = append(retList, upstream.URL())
 		}
 	}
 
@@ -132,7 +439,12 @@ func (v *VMUpstreams) GetActiveHostList() ([]string, error) {
 //LoadUpstreams Loads the current list of upstreams and removes any upstreams not found.
 func (v *VMUpstreams) LoadUpstreams() error {
 
-	instances, err := utility.GetAWSInstancesByTag(&v.Config)
+	d := v.getDiscoverer()
+	if d == nil {
+		return errors.New("no discoverer configured")
+	}
+
+	targets, err := d.Discover()
 	if err != nil {
 		return err
 	}
@@ -143,20 +455,19 @@ func (v *VMUpstreams) LoadUpstreams() error {
 		return err
 	}
 
-	for _, inst := range instances {
+	for _, t := range targets {
 
-		var n VMUpstream
-
-		n.Host = inst.AWSHost
-		n.Port = inst.AWSPort
-		n.URI = inst.AWSURI
-		n.Status = true
+		n := upstreamFromTarget(t)
 
 		// See if the existing upstream in the list, if not then add it.
 		f := false
 		for _, h := range uslist {
 			if h.CEqual(n) {
 				f = true
+				if !reflect.DeepEqual(h.Meta, n.Meta) || h.Draining != n.Draining || h.Weight != n.Weight {
+					// Same upstream, the discoverer just knows more about it now
+					v.refresh(n)
+				}
 			}
 		}
 		if f == false {
@@ -169,25 +480,17 @@ func (v *VMUpstreams) LoadUpstreams() error {
 		}
 	}
 
-	// Remove upstreams that no longer exist by comparing available upstreams
-	// in AWS and removing them from our list stored in []vmupstreams
+	// Remove upstreams that no longer exist by comparing the discovered
+	// targets and removing them from our list stored in []vmupstreams
 	for _, x := range uslist {
 		f := false
-		for _, inst := range instances {
-
-			var p VMUpstream
-
-			p.Host = inst.AWSHost
-			p.Port = inst.AWSPort
-			p.URI = inst.AWSURI
-			p.Status = true
-
-			if x.CEqual(p) {
+		for _, t := range targets {
+			if x.CEqual(upstreamFromTarget(t)) {
 				f = true
 			}
 		}
 		if f == false {
-			err := v.DeleteUpstreamByHost(x.Host)
+			err := v.deleteUpstream(x)
 			if err != nil {
 				return err
 			}
@@ -205,11 +508,49 @@ func (v *VMUpstreams) LoadUpstreams() error {
 	}
 
 	// Set the current upstreams that are available
-	currentUpstreams.Set(float64(len(activeHostList)))
+	if v.poolName() == utility.DefaultPool {
+		currentUpstreams.Set(float64(len(activeHostList)))
+	}
+	poolUpstreams.WithLabelValues(v.poolName()).Set(float64(len(activeHostList)))
 
 	return nil
 }
 
+// poolName name of the pool for metrics and logs
+func (v *VMUpstreams) poolName() string {
+	if v.Name == "" {
+		return utility.DefaultPool
+	}
+	return v.Name
+}
+
+// upstreamFromTarget converts a discovered target into a new, active upstream
+//
+// A weight of 0 drains the upstream, it keeps being listed but gets no new series.
+func upstreamFromTarget(t vmdiscovery.Target) VMUpstream {
+	var n VMUpstream
+
+	n.Host = t.Host
+	n.Port = t.Port
+	n.URI = t.URI
+	n.Meta = t.Meta
+	n.Draining = t.Draining
+	n.Status = true
+	n.Weight = 1
+
+	if w, ok := t.Meta[vmdiscovery.MetaWeight]; ok {
+		weight, err := strconv.ParseFloat(w, 64)
+		if err != nil || weight < 0 {
+			log.Error().Str("service", watcher).Msgf("Ignoring invalid weight %q of upstream %s", w, n.URL())
+		} else {
+			n.Weight = weight
+			n.Draining = n.Draining || weight == 0
+		}
+	}
+
+	return n
+}
+
 //CEqual is a custom equal function to test all elements except for status which could be false if a node is marked down
 func (v *VMUpstream) CEqual(c VMUpstream) bool {
 
@@ -221,18 +562,29 @@ func (v *VMUpstream) CEqual(c VMUpstream) bool {
 		return false
 	}
 
-	if v.URI != v.URI {
+	if v.URI != c.URI {
 		return false
 	}
 	return true
 }
 
-//AWSServiceWorker Continuously updates upstreams based on changes in AWS
+//AWSServiceWorker Continuously updates upstreams based on changes in AWS and the other discoverers
 func (v *VMUpstreams) AWSServiceWorker() error {
 
-	// Updates every five seconds so we do not overload AWS
+	v.Mu.Lock()
+	if v.changed == nil {
+		v.changed = make(chan struct{}, 1)
+	}
+	changed := v.changed
+	v.Mu.Unlock()
+
+	// Polls on an interval so we do not overload AWS, watching discoverers
+	// wake us up as soon as they see a change
 	for {
-		time.Sleep(time.Second * 30)
+		select {
+		case <-time.After(time.Second * time.Duration(v.CurrentConfig().AWSPollingIntervalSeconds)):
+		case <-changed:
+		}
 		err := v.LoadUpstreams()
 		if err != nil {
 			// log the error and keep going
@@ -0,0 +1,314 @@
+package vmupstreams
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/miekg/dns"
+
+	"github.dev.pages/infrastructure/vmwriter/internal/awsfake"
+	vmdiscovery "github.dev.pages/infrastructure/vmwriter/internal/discovery"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+func TestLoadUpstreamsReconcilesTargets(t *testing.T) {
+	var v VMUpstreams
+	v.Config.ReplicationFactor = 1
+
+	v.SetDiscoverer(vmdiscovery.Static{
+		{Host: "10.0.0.1", Port: 8428, URI: "/api/v1/write"},
+		{Host: "10.0.0.2", Port: 8428, URI: "/api/v1/write"},
+	})
+	if err := v.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+	if v.GetRing().Len() != 2 {
+		t.Fatalf("expected 2 upstreams in the ring, got %d", v.GetRing().Len())
+	}
+
+	// Same host on another port is another upstream, the old one goes away
+	v.SetDiscoverer(vmdiscovery.Static{
+		{Host: "10.0.0.1", Port: 8428, URI: "/api/v1/write", Meta: map[string]string{"zone": "a"}},
+		{Host: "10.0.0.2", Port: 8429, URI: "/api/v1/write"},
+	})
+	if err := v.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, _ := v.UpstreamList()
+	if len(list) != 2 {
+		t.Fatalf("expected 2 upstreams, got %v", list)
+	}
+	for _, u := range list {
+		switch u.Host {
+		case "10.0.0.1":
+			if u.Meta["zone"] != "a" || u.Meta[vmdiscovery.MetaSource] != "static" {
+				t.Errorf("expected the metadata to be updated, got %v", u.Meta)
+			}
+		case "10.0.0.2":
+			if u.Port != 8429 {
+				t.Errorf("expected the upstream on the old port to be replaced, got %d", u.Port)
+			}
+		}
+	}
+}
+
+func TestDrainingUpstreamGetsNoWrites(t *testing.T) {
+	var v VMUpstreams
+	v.Config.ReplicationFactor = 1
+
+	v.SetDiscoverer(vmdiscovery.Static{
+		{Host: "10.0.0.1", Port: 8428, URI: "/api/v1/write"},
+		{Host: "10.0.0.2", Port: 8428, URI: "/api/v1/write", Draining: true},
+	})
+	if err := v.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, _ := v.GetActiveHostList()
+	if len(hosts) != 1 || v.GetRing().Len() != 1 {
+		t.Fatalf("expected only the upstream in service to receive writes, got %v", hosts)
+	}
+	list, _ := v.UpstreamList()
+	if len(list) != 2 {
+		t.Fatalf("expected the draining upstream to stay known until it is gone, got %v", list)
+	}
+
+	// The lifecycle hook was abandoned and the instance is back in service
+	v.SetDiscoverer(vmdiscovery.Static{
+		{Host: "10.0.0.1", Port: 8428, URI: "/api/v1/write"},
+		{Host: "10.0.0.2", Port: 8428, URI: "/api/v1/write"},
+	})
+	if err := v.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+	if v.GetRing().Len() != 2 {
+		t.Errorf("expected both upstreams in the ring, got %d", v.GetRing().Len())
+	}
+}
+
+func TestUpstreamWeightFromMeta(t *testing.T) {
+	var v VMUpstreams
+	v.Config.ReplicationFactor = 1
+
+	v.SetDiscoverer(vmdiscovery.Static{
+		{Host: "10.0.0.1", Port: 8428, URI: "/api/v1/write", Meta: map[string]string{vmdiscovery.MetaWeight: "2.5"}},
+		{Host: "10.0.0.2", Port: 8428, URI: "/api/v1/write", Meta: map[string]string{vmdiscovery.MetaWeight: "0"}},
+		{Host: "10.0.0.3", Port: 8428, URI: "/api/v1/write", Meta: map[string]string{vmdiscovery.MetaWeight: "-1"}},
+	})
+	if err := v.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, _ := v.UpstreamList()
+	if len(list) != 3 {
+		t.Fatalf("expected the weight 0 upstream to stay listed, got %v", list)
+	}
+	for _, u := range list {
+		switch u.Host {
+		case "10.0.0.1":
+			if u.weight() != 2.5 || u.Draining {
+				t.Errorf("expected weight 2.5, got %v", u.weight())
+			}
+		case "10.0.0.2":
+			if !u.Draining {
+				t.Error("expected the weight 0 upstream to be draining")
+			}
+		case "10.0.0.3":
+			if u.weight() != 1 || u.Draining {
+				t.Errorf("expected an invalid weight to be ignored, got %v", u.weight())
+			}
+		}
+	}
+	if v.GetRing().Len() != 2 {
+		t.Errorf("expected the weight 0 upstream to be left out of the ring, got %d nodes", v.GetRing().Len())
+	}
+}
+
+func TestAWSServiceWorkerFollowsEC2(t *testing.T) {
+	fake := awsfake.NewEC2(0,
+		awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", map[string]string{"Cluster": "victoriametrix"}),
+		awsfake.Instance("i-2", "10.0.0.2", ec2.InstanceStateNameRunning, "us-west-2b", map[string]string{"Cluster": "victoriametrix"}),
+	)
+	old := utility.NewAWSClients
+	utility.NewAWSClients = awsfake.Clients(fake, nil)
+	defer func() { utility.NewAWSClients = old }()
+
+	var v VMUpstreams
+	config := utility.DefaultConfig()
+	config.AWSDiscoveryEnabled = true
+	config.AWSPollingIntervalSeconds = 3600
+	if err := v.VMUpstreamsInitialize(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, _ := v.GetActiveHostList()
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 upstreams, got %v", hosts)
+	}
+	list, _ := v.UpstreamList()
+	for _, u := range list {
+		if u.Meta[vmdiscovery.MetaInstanceID] == "" || u.Meta[vmdiscovery.MetaZone] == "" {
+			t.Errorf("expected instance metadata, got %v", u.Meta)
+		}
+	}
+
+	go v.AWSServiceWorker()
+
+	// i-2 is terminated and i-3 launched, a change signal stands in for the poll interval
+	fake.SetInstances(
+		awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", map[string]string{"Cluster": "victoriametrix"}),
+		awsfake.Instance("i-2", "10.0.0.2", ec2.InstanceStateNameTerminated, "us-west-2b", map[string]string{"Cluster": "victoriametrix"}),
+		awsfake.Instance("i-3", "10.0.0.3", ec2.InstanceStateNameRunning, "us-west-2c", map[string]string{"Cluster": "victoriametrix"}),
+	)
+	v.changed <- struct{}{}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list, _ := v.UpstreamList()
+		if len(list) == 2 && list[0].Host == "10.0.0.1" && list[1].Host == "10.0.0.3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 10.0.0.1 and 10.0.0.3, got %v", list)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// aaaaServer in-process DNS server answering every AAAA query for name with addr
+func aaaaServer(t *testing.T, name string, addr string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeAAAA && q.Name == name {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 30 IN AAAA %s", name, addr))
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+func TestIPv6UpstreamFromDNS(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	var writes, probes int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			atomic.AddInt32(&probes, 1)
+		case "/api/v1/write":
+			atomic.AddInt32(&writes, 1)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	config := utility.DefaultConfig()
+	config.DNSNames = []string{"vm.example.com"}
+	config.DNSType = utility.DNSTypeAAAA
+	config.DNSPort = l.Addr().(*net.TCPAddr).Port
+	config.DNSServer = aaaaServer(t, "vm.example.com.", "::1")
+
+	var v VMUpstreams
+	v.Config = config
+	d, err := vmdiscovery.FromConfig(&utility.VConfig{DiscoveryConfig: config.DiscoveryConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.SetDiscoverer(d)
+	if err := v.LoadUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, _ := v.UpstreamList()
+	if len(list) != 1 || list[0].Host != "::1" {
+		t.Fatalf("expected the ::1 upstream, got %v", list)
+	}
+
+	// Both the health checks and the writes must reach it
+	if u, err := url.Parse(list[0].URL()); err != nil || u.Host != l.Addr().String() {
+		t.Fatalf("expected a url with host %s, got %s %v", l.Addr(), list[0].URL(), err)
+	}
+	v.CheckHealth(srv.Client())
+	resp, err := srv.Client().Post(list[0].URL(), "application/x-protobuf", strings.NewReader("write"))
+	if err != nil {
+		t.Fatalf("posting to %s: %v", list[0].URL(), err)
+	}
+	resp.Body.Close()
+	if atomic.LoadInt32(&probes) != 1 || atomic.LoadInt32(&writes) != 1 {
+		t.Errorf("expected one health check and one write, got %d and %d", probes, writes)
+	}
+}
+
+func TestIPv6UpstreamURL(t *testing.T) {
+	u := VMUpstream{Host: "2001:db8::1", Port: 8428, URI: "/api/v1/write"}
+	if got, want := u.URL(), "http://[2001:db8::1]:8428/api/v1/write"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if _, err := http.NewRequest(http.MethodPost, u.URL(), nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := http.NewRequest(http.MethodGet, u.HealthURL("/health"), nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPoolsKeepSeparateMetrics(t *testing.T) {
+	upstream := VMUpstream{Host: "10.0.9.1", Port: 8428, URI: "/api/v1/write", Status: true}
+
+	var def VMUpstreams
+	def.Config.ReplicationFactor = 1
+	def.Config.BreakerFailures = 3
+	longTerm := VMUpstreams{Name: "long-term"}
+	longTerm.Config.ReplicationFactor = 1
+	longTerm.Config.BreakerFailures = 3
+
+	for _, v := range []*VMUpstreams{&def, &longTerm} {
+		if err := v.AddUpstream(upstream); err != nil {
+			t.Fatal(err)
+		}
+		v.Breaker(upstream.URL())
+	}
+
+	// The same upstream leaving one pool must not remove the series of the other
+	if err := longTerm.DeleteUpstreamByHost(upstream.Host); err != nil {
+		t.Fatal(err)
+	}
+	if upstreamWeight.DeleteLabelValues("long-term", upstream.URL()) {
+		t.Error("expected the long-term weight to be gone")
+	}
+	if breakerState.DeleteLabelValues("long-term", upstream.URL()) {
+		t.Error("expected the long-term breaker state to be gone")
+	}
+	if !upstreamWeight.DeleteLabelValues(utility.DefaultPool, upstream.URL()) {
+		t.Error("expected the default pool weight to be kept")
+	}
+	if !breakerState.DeleteLabelValues(utility.DefaultPool, upstream.URL()) {
+		t.Error("expected the default pool breaker state to be kept")
+	}
+}
@@ -0,0 +1,751 @@
+package utility
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+//VConfig configuration struct used for various parts of the application
+//
+// The settings are grouped into the sections of the configuration file.  The sections are
+// embedded so the rest of the code keeps reading flat fields such as config.AWSRegion.
+type VConfig struct {
+	ListenerConfig  `yaml:"listener"`
+	DiscoveryConfig `yaml:"discovery"`
+	UpstreamsConfig `yaml:"upstreams"`
+	RoutingConfig   `yaml:"routing"`
+	TenantConfig    `yaml:"tenants"`
+	TimeoutsConfig  `yaml:"timeouts"`
+	QueueConfig     `yaml:"queue"`
+	AuthConfig      `yaml:"auth"`
+	LabelsConfig    `yaml:"labels"`
+	LimitsConfig    `yaml:"limits"`
+
+	Pools []PoolConfig `yaml:"pools"` //Pools named upstream pools that routing rules can send series to, next to the default pool
+
+	RelabelConfigs      []RelabelConfig `yaml:"relabel_configs"`       //RelabelConfigs applied to every series before it is routed
+	WriteRelabelConfigs []RelabelConfig `yaml:"write_relabel_configs"` //WriteRelabelConfigs applied to the series sent to the default pool
+}
+
+//PoolConfig a named pool of upstreams with its own discovery
+type PoolConfig struct {
+	Name            string          `yaml:"name"`      //Name used by the routing rules and in metrics
+	DiscoveryConfig DiscoveryConfig `yaml:"discovery"` //DiscoveryConfig how the upstreams of the pool are found, same settings and defaults as discovery
+
+	WriteRelabelConfigs []RelabelConfig `yaml:"write_relabel_configs"` //WriteRelabelConfigs applied to the series sent to the pool
+}
+
+//RelabelConfig a Prometheus relabel config
+//
+// SEE: https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow"` //SourceLabels labels whose values are joined with Separator and matched against Regex
+	Separator    string   `yaml:"separator"`          //Separator placed between the source label values
+	Regex        string   `yaml:"regex"`              //Regex anchored at both ends
+	Modulus      uint64   `yaml:"modulus"`            //Modulus of the hash of the source label values for hashmod
+	TargetLabel  string   `yaml:"target_label"`       //TargetLabel label written by replace, hashmod and lowercase
+	Replacement  string   `yaml:"replacement"`        //Replacement value written by replace, may refer to the Regex groups
+	Action       string   `yaml:"action"`             //Action to take, see RelabelReplace
+}
+
+//DefaultRelabelConfig the Prometheus defaults of a relabel config
+func DefaultRelabelConfig() RelabelConfig {
+	return RelabelConfig{Separator: ";", Regex: "(.*)", Replacement: "$1", Action: RelabelReplace}
+}
+
+//UnmarshalYAML starts from the Prometheus defaults so rules only list what differs
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelabelConfig
+	rc := plain(DefaultRelabelConfig())
+	if err := unmarshal(&rc); err != nil {
+		return err
+	}
+	*c = RelabelConfig(rc)
+	return nil
+}
+
+//Validate checks the action has the settings it needs and the regex compiles
+func (c *RelabelConfig) Validate() error {
+	switch c.Action {
+	case RelabelReplace, RelabelLowercase:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s needs a target_label", c.Action)
+		}
+	case RelabelHashMod:
+		if c.TargetLabel == "" || c.Modulus == 0 {
+			return fmt.Errorf("relabel action %s needs a target_label and a modulus", c.Action)
+		}
+	case RelabelKeep, RelabelDrop, RelabelLabelMap:
+	case RelabelLabelDrop, RelabelLabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" {
+			return fmt.Errorf("relabel action %s only uses regex", c.Action)
+		}
+	default:
+		return fmt.Errorf("unknown relabel action %s", c.Action)
+	}
+
+	if _, err := regexp.Compile("^(?:" + c.Regex + ")$"); err != nil {
+		return fmt.Errorf("invalid relabel regex %s: %v", c.Regex, err)
+	}
+	return nil
+}
+
+//UnmarshalYAML starts the discovery of a pool from the defaults so pools only list what differs
+func (p *PoolConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PoolConfig
+	pool := plain{DiscoveryConfig: DefaultConfig().DiscoveryConfig}
+	if err := unmarshal(&pool); err != nil {
+		return err
+	}
+	*p = PoolConfig(pool)
+	return nil
+}
+
+//ListenerConfig where vmwriter accepts remote writes
+type ListenerConfig struct {
+	ListenAddress string `yaml:"address"` //ListenAddress address the http server listens on
+}
+
+//DiscoveryConfig how upstreams are found
+type DiscoveryConfig struct {
+	AWSPollingIntervalSeconds int `yaml:"polling_interval_seconds"` //AWSPollingTick How often to poll AWS for new nodes
+	EC2Config                 `yaml:"ec2"`
+	FileSDConfig              `yaml:"file"`
+	DNSSDConfig               `yaml:"dns"`
+	ConsulSDConfig            `yaml:"consul"`
+	KubernetesSDConfig        `yaml:"kubernetes"`
+	StaticUpstreams           []StaticUpstream `yaml:"static"` //StaticUpstreams upstreams that are always used
+}
+
+//FileSDConfig discovery of upstreams listed in files using the Prometheus file_sd format
+type FileSDConfig struct {
+	FileSDFiles []string `yaml:"files"` //FileSDFiles paths or globs of the .json, .yml or .yaml files listing upstreams
+}
+
+//StaticUpstream an upstream listed in the configuration
+type StaticUpstream struct {
+	Host   string            `yaml:"host"`
+	Port   int               `yaml:"port"`
+	URI    string            `yaml:"uri"`
+	Labels map[string]string `yaml:"labels"`
+	Weight *float64          `yaml:"weight"` // Weight relative share of the series, 1 when unset and 0 drains the upstream
+
+	WriteRelabelConfigs []RelabelConfig `yaml:"write_relabel_configs"` // WriteRelabelConfigs applied to the series sent to this upstream, after those of its pool
+}
+
+//DNSSDConfig discovery of upstreams from DNS SRV, A or AAAA records
+type DNSSDConfig struct {
+	DNSNames  []string `yaml:"names"`  //DNSNames names to resolve, empty disables DNS discovery
+	DNSType   string   `yaml:"type"`   //DNSType record type to look up, see DNSTypeSRV
+	DNSPort   int      `yaml:"port"`   //DNSPort port of the upstreams for A and AAAA records, SRV records carry their own
+	DNSURI    string   `yaml:"uri"`    //DNSURI write path of the upstreams
+	DNSServer string   `yaml:"server"` //DNSServer resolver to ask as host:port, defaults to the first nameserver in /etc/resolv.conf
+}
+
+//ConsulSDConfig discovery of upstreams registered as a Consul service
+type ConsulSDConfig struct {
+	ConsulAddress    string `yaml:"address"`    //ConsulAddress url of the Consul agent
+	ConsulService    string `yaml:"service"`    //ConsulService service to look up, empty disables Consul discovery
+	ConsulTag        string `yaml:"tag"`        //ConsulTag only use instances with this tag
+	ConsulDatacenter string `yaml:"datacenter"` //ConsulDatacenter datacenter to look in, the agent's own when empty
+	ConsulToken      string `yaml:"token"`      //ConsulToken ACL token
+	ConsulPortMeta   string `yaml:"port_meta"`  //ConsulPortMeta service metadata key that specifies the destination port
+	ConsulURIMeta    string `yaml:"uri_meta"`   //ConsulURIMeta service metadata key that specifies the destination URI
+}
+
+//KubernetesSDConfig discovery of upstreams from the EndpointSlices of a Kubernetes service
+type KubernetesSDConfig struct {
+	KubeSelector       string `yaml:"selector"`        //KubeSelector label selector of the service, empty disables Kubernetes discovery
+	KubeNamespace      string `yaml:"namespace"`       //KubeNamespace namespace of the service, all namespaces when empty
+	KubeConfig         string `yaml:"kubeconfig"`      //KubeConfig path of a kubeconfig file, the in-cluster configuration is used when empty
+	KubePortAnnotation string `yaml:"port_annotation"` //KubePortAnnotation service annotation that specifies the destination port number or name
+	KubeURIAnnotation  string `yaml:"uri_annotation"`  //KubeURIAnnotation service annotation that specifies the destination URI
+}
+
+//EC2Config discovery of upstreams by EC2 tags
+type EC2Config struct {
+	AWSDiscoveryEnabled bool        `yaml:"enabled"`      //AWSDiscoveryEnabled whether upstreams are looked up in EC2
+	AWSRegion           string      `yaml:"region"`       //AWSRegion region for aws
+	AWSAutoScalingGroup string      `yaml:"asg_name"`     //AWSAutoScalingGroup when set the in service instances of this group are used instead of the tag search
+	AWSRegions          []string    `yaml:"regions"`      //AWSRegions regions to search, AWSRegion alone when empty
+	AWSRoleARNs         []string    `yaml:"role_arns"`    //AWSRoleARNs roles assumed to search other accounts, the default credentials when empty
+	AWSTagFilters       []TagFilter `yaml:"tag_filters"`  //AWSTagFilters more tags the instances must carry, all of them must match
+	AWSAddressType      string      `yaml:"address_type"` //AWSAddressType address used to reach the instances, see AddressPrivate
+	AWSEndpoint         string      `yaml:"endpoint"`     //AWSEndpoint url of an EC2 compatible API to use instead of AWS
+	AWSSearchTag        string      `yaml:"tag"`          //AWSSearchTag tag to filter on
+	AWSSearchTagValue   string      `yaml:"tag_value"`    //AWSSearchTagValue the search tag value to filter on
+	AWSPortTag          string      `yaml:"port_tag"`     //AWSPortTag Tag that specifies the destination port
+	AWSURITag           string      `yaml:"uri_tag"`      //AWSURITag Tag that specifies the destination URI
+	AWSWeightTag        string      `yaml:"weight_tag"`   //AWSWeightTag Tag that specifies the weight of the destination
+	AWSDrainTag         string      `yaml:"drain_tag"`    //AWSDrainTag Tag that puts the destination in maintenance when true
+}
+
+//TagFilter an EC2 tag and the values it may have
+type TagFilter struct {
+	Key    string   `yaml:"key"`
+	Values []string `yaml:"values"`
+}
+
+//UpstreamsConfig how upstreams are health checked and taken out of rotation
+type UpstreamsConfig struct {
+	ServicePollingSeconds  int    `yaml:"health_check_interval_seconds"` //ServicePollingSeconds How oftent to poll services for availability
+	HealthCheckPath        string `yaml:"health_check_path"`             //HealthCheckPath path probed on each upstream to check it is healthy
+	HealthRise             int    `yaml:"health_rise"`                   //HealthRise consecutive passing checks before a down upstream is marked up
+	HealthFall             int    `yaml:"health_fall"`                   //HealthFall consecutive failing checks before an up upstream is marked down
+	BreakerFailures        int    `yaml:"breaker_failures"`              //BreakerFailures consecutive failed writes that open an upstream's circuit breaker, 0 disables
+	BreakerCoolDownSeconds int    `yaml:"breaker_cool_down_seconds"`     //BreakerCoolDownSeconds how long a circuit breaker stays open before a trial write
+}
+
+//RoutingConfig how series are spread over the upstreams and acknowledged
+type RoutingConfig struct {
+	RoutingMode       string `yaml:"mode"`               //RoutingMode how series are spread over the upstreams, see RoutingReplicate and RoutingShard
+	ReplicationFactor int    `yaml:"replication_factor"` //ReplicationFactor number of distinct upstreams each series is sent to when sharding
+	WriteConsistency  string `yaml:"write_consistency"`  //WriteConsistency how many upstreams must accept a series before the write is acknowledged, see WriteConsistencyAny
+	ZoneAware         bool   `yaml:"zone_aware"`         //ZoneAware prefer upstreams in the own availability zone to save cross zone traffic
+	Zone              string `yaml:"zone"`               //Zone own availability zone, looked up from the instance metadata when empty
+
+	Rules []RoutingRule `yaml:"rules"` //Rules send matching series to named pools, the first matching rule wins
+}
+
+//RoutingRule sends the series matching all of its matchers to pools
+type RoutingRule struct {
+	Match   map[string]string `yaml:"match"`    //Match labels that must have exactly these values
+	MatchRE map[string]string `yaml:"match_re"` //MatchRE labels that must match these regular expressions, anchored at both ends
+	Pools   []string          `yaml:"pools"`    //Pools pools the series are sent to, DefaultPool for the default one
+
+	matchRE map[string]*regexp.Regexp // matchRE compiled MatchRE, set by Validate
+}
+
+//Matches whether the series with the labels returned by label matches the rule, Validate must have been called
+func (r *RoutingRule) Matches(label func(name string) string) bool {
+	for name, value := range r.Match {
+		if label(name) != value {
+			return false
+		}
+	}
+	for name, re := range r.matchRE {
+		if !re.MatchString(label(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+//TenantConfig how the VictoriaMetrics cluster tenant of each series is found
+type TenantConfig struct {
+	TenantSources []string `yaml:"sources"` //TenantSources where to look for the tenant, in order, see TenantSourcePath
+	TenantHeader  string   `yaml:"header"`  //TenantHeader request header carrying the tenant
+	TenantLabel   string   `yaml:"label"`   //TenantLabel series label carrying the tenant, removed before forwarding
+	TenantDefault string   `yaml:"default"` //TenantDefault tenant of series no source resolves, empty sends them to the upstream URI unchanged
+	TenantURI     string   `yaml:"uri"`     //TenantURI write path of a tenant on the upstreams, {tenant} is replaced with the tenant
+}
+
+//TimeoutsConfig client and server timeouts
+type TimeoutsConfig struct {
+	HTTPTimeOut               int `yaml:"upstream_seconds"`          //Client timeout for http requests
+	SlowForwardMilliseconds   int `yaml:"slow_forward_warning_ms"`   //SlowForwardMilliseconds warn when forwards take longer than this
+	ServerReadTimeoutSeconds  int `yaml:"server_read_seconds"`       //ServerReadTimeoutSeconds read timeout of the listener
+	ServerWriteTimeoutSeconds int `yaml:"server_write_seconds"`      //ServerWriteTimeoutSeconds write timeout of the listener
+	GracefulShutdownSeconds   int `yaml:"graceful_shutdown_seconds"` //GracefulShutdownSeconds how long to wait for connections to finish on shutdown
+}
+
+//QueueConfig on disk retry queues
+type QueueConfig struct {
+	QueueDir           string `yaml:"dir"`             //QueueDir directory for the on disk retry queues, empty disables them
+	QueueMaxBytes      int64  `yaml:"max_bytes"`       //QueueMaxBytes maximum size of the retry queue of each upstream
+	QueueMaxAgeSeconds int    `yaml:"max_age_seconds"` //QueueMaxAgeSeconds queued writes older than this are dropped instead of replayed
+}
+
+//AuthConfig clients allowed to write, when empty anyone can write
+type AuthConfig struct {
+	Clients []AuthClient `yaml:"clients"`
+}
+
+//AuthClient a client allowed to write, authenticated with basic auth or a bearer token
+type AuthClient struct {
+	Name        string `yaml:"name"`         //Name identifies the client in logs and metrics
+	Username    string `yaml:"username"`     //Username basic auth user
+	Password    string `yaml:"password"`     //Password basic auth password
+	BearerToken string `yaml:"bearer_token"` //BearerToken token sent in the Authorization header
+	Admin       bool   `yaml:"admin"`        //Admin the client may reload the configuration and drain upstreams
+
+	Labels map[string]string `yaml:"labels"` //Labels added to every series the client writes, over the external labels
+}
+
+//LabelsConfig labels added to every series and labels every series must carry
+type LabelsConfig struct {
+	ExternalLabels map[string]string `yaml:"external_labels"`  //ExternalLabels added to every series, replacing the value sent
+	ClientLabel    string            `yaml:"client_label"`     //ClientLabel label set to the name of the authenticated client, empty disables
+	SourceIPLabel  string            `yaml:"source_ip_label"`  //SourceIPLabel label set to the address the write came from, empty disables
+	SourceIPHeader string            `yaml:"source_ip_header"` //SourceIPHeader header with the address of the client when behind a proxy, such as X-Forwarded-For
+	RequiredLabels []string          `yaml:"required_labels"`  //RequiredLabels writes with series missing any of these are rejected
+}
+
+//LimitsConfig limits on the active series and ingestion rate of each tenant
+type LimitsConfig struct {
+	LimitsBy                  string `yaml:"by"`                           //LimitsBy what the limits apply to, see LimitByTenant, empty disables limits and tracking
+	LimitsAction              string `yaml:"action"`                       //LimitsAction what happens to writes over a limit, see LimitActionReject
+	ActiveSeriesWindowSeconds int    `yaml:"active_series_window_seconds"` //ActiveSeriesWindowSeconds a series is active when it was written in this window
+	RateBurstSeconds          int    `yaml:"rate_burst_seconds"`           //RateBurstSeconds seconds of unused samples rate that can be saved up for bursts
+
+	Limit          `yaml:",inline"` //Limit of every tenant without an override
+	LimitOverrides map[string]Limit `yaml:"overrides"` //LimitOverrides limits by tenant, replacing both default limits
+}
+
+//Limit limits of one tenant, zero is unlimited
+type Limit struct {
+	MaxActiveSeries     int     `yaml:"max_active_series"`      //MaxActiveSeries series written within the active series window
+	MaxSamplesPerSecond float64 `yaml:"max_samples_per_second"` //MaxSamplesPerSecond samples written per second
+}
+
+//LimitFor the limits of a tenant
+func (c *LimitsConfig) LimitFor(key string) Limit {
+	if l, ok := c.LimitOverrides[key]; ok {
+		return l
+	}
+	return c.Limit
+}
+
+const (
+	//AddressPrivate reach EC2 instances on their private IPv4 address
+	AddressPrivate = "private"
+	//AddressPublic reach EC2 instances on their public IPv4 address
+	AddressPublic = "public"
+	//AddressIPv6 reach EC2 instances on their first IPv6 address
+	AddressIPv6 = "ipv6"
+)
+
+const (
+	//DNSTypeSRV look up SRV records, which carry the port of each upstream
+	DNSTypeSRV = "SRV"
+	//DNSTypeA look up A records and use DNSPort
+	DNSTypeA = "A"
+	//DNSTypeAAAA look up AAAA records and use DNSPort
+	DNSTypeAAAA = "AAAA"
+)
+
+const (
+	//RoutingReplicate every upstream receives every series
+	RoutingReplicate = "replicate"
+	//RoutingShard each series is sent to ReplicationFactor upstreams chosen from a hash ring of its labels
+	RoutingShard = "shard"
+)
+
+const (
+	//WriteConsistencyAny acknowledge once any upstream accepted each series
+	WriteConsistencyAny = "any"
+	//WriteConsistencyQuorum acknowledge once a majority of the upstreams of each series accepted it
+	WriteConsistencyQuorum = "quorum"
+	//WriteConsistencyAll acknowledge only when every upstream of each series accepted it
+	WriteConsistencyAll = "all"
+)
+
+const (
+	//RelabelReplace sets target_label to replacement when regex matches the source labels
+	RelabelReplace = "replace"
+	//RelabelKeep drops series whose source labels do not match regex
+	RelabelKeep = "keep"
+	//RelabelDrop drops series whose source labels match regex
+	RelabelDrop = "drop"
+	//RelabelLabelDrop removes the labels whose name matches regex
+	RelabelLabelDrop = "labeldrop"
+	//RelabelLabelKeep removes the labels whose name does not match regex
+	RelabelLabelKeep = "labelkeep"
+	//RelabelLabelMap copies the labels whose name matches regex to the name given by replacement
+	RelabelLabelMap = "labelmap"
+	//RelabelHashMod sets target_label to the hash of the source labels modulo modulus
+	RelabelHashMod = "hashmod"
+	//RelabelLowercase sets target_label to the lower cased source labels
+	RelabelLowercase = "lowercase"
+)
+
+// labelNameRE valid Prometheus label names
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+//DefaultPool name of the pool found by the top level discovery
+const DefaultPool = "default"
+
+const (
+	//TenantSourcePath tenant from the /insert/<tenant>/prometheus/api/v1/write path the write was sent to
+	TenantSourcePath = "path"
+	//TenantSourceHeader tenant from the TenantHeader request header
+	TenantSourceHeader = "header"
+	//TenantSourceUser tenant from the basic auth username
+	TenantSourceUser = "user"
+	//TenantSourceLabel tenant from the TenantLabel label of each series
+	TenantSourceLabel = "label"
+)
+
+const (
+	//LimitByTenant limits apply to each VictoriaMetrics cluster tenant
+	LimitByTenant = "tenant"
+	//LimitByClient limits apply to each authenticated client
+	LimitByClient = "client"
+	//LimitBySourceIP limits apply to each address writes come from
+	LimitBySourceIP = "source_ip"
+)
+
+const (
+	//LimitActionReject writes over a limit are answered with a 429 and nothing of them is written
+	LimitActionReject = "reject"
+	//LimitActionDrop the series over a limit are dropped and the rest is written
+	LimitActionDrop = "drop"
+)
+
+//DefaultConfig configuration used for anything not set in the file or by flags
+func DefaultConfig() VConfig {
+	var config VConfig
+
+	config.ListenAddress = "0.0.0.0:5000"
+
+	config.AWSPollingIntervalSeconds = 30
+	config.AWSDiscoveryEnabled = false
+	config.AWSRegion = "us-west-2"
+	config.AWSSearchTag = "Cluster"
+	config.AWSSearchTagValue = "victoriametrix"
+	config.AWSURITag = "ClusterVMURI"
+	config.AWSPortTag = "ClusterVMPort"
+	config.AWSWeightTag = "ClusterVMWeight"
+	config.AWSDrainTag = "ClusterVMDrain"
+	config.AWSAddressType = AddressPrivate
+
+	config.ConsulAddress = "http://127.0.0.1:8500"
+	config.ConsulPortMeta = "ClusterVMPort"
+	config.ConsulURIMeta = "ClusterVMURI"
+
+	config.KubePortAnnotation = "ClusterVMPort"
+	config.KubeURIAnnotation = "ClusterVMURI"
+
+	config.DNSType = DNSTypeSRV
+	config.DNSURI = "/api/v1/write"
+
+	config.ServicePollingSeconds = 10
+	config.HealthCheckPath = "/health"
+	config.HealthRise = 2
+	config.HealthFall = 3
+	config.BreakerFailures = 5
+	config.BreakerCoolDownSeconds = 30
+
+	config.RoutingMode = RoutingReplicate
+	config.ReplicationFactor = 1
+	config.WriteConsistency = WriteConsistencyAny
+
+	config.TenantSources = []string{TenantSourcePath}
+	config.TenantHeader = "X-Scope-OrgID"
+	config.TenantLabel = "vm_account_id"
+	config.TenantURI = "/insert/{tenant}/prometheus/api/v1/write"
+
+	config.LimitsAction = LimitActionReject
+	config.ActiveSeriesWindowSeconds = 3600
+	config.RateBurstSeconds = 10
+
+	config.HTTPTimeOut = 3
+	config.SlowForwardMilliseconds = 500
+	config.ServerReadTimeoutSeconds = 15
+	config.ServerWriteTimeoutSeconds = 15
+	config.GracefulShutdownSeconds = 15
+
+	config.QueueMaxBytes = 512 * 1024 * 1024
+	config.QueueMaxAgeSeconds = 24 * 3600
+
+	return config
+}
+
+//LoadConfigFile reads a YAML configuration file on top of config, unknown fields are an error
+func LoadConfigFile(path string, config *VConfig) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	return nil
+}
+
+//Validate checks the configuration for values the application can not work with
+func (c *VConfig) Validate() error {
+
+	if c.ListenAddress == "" {
+		return fmt.Errorf("listener address must be set")
+	}
+
+	if err := c.DiscoveryConfig.Validate(); err != nil {
+		return err
+	}
+
+	pools := map[string]bool{DefaultPool: true}
+	for i := range c.Pools {
+		p := &c.Pools[i]
+		if p.Name == "" || pools[p.Name] {
+			return fmt.Errorf("pool %d needs a unique name other than %s", i, DefaultPool)
+		}
+		pools[p.Name] = true
+		if err := p.DiscoveryConfig.Validate(); err != nil {
+			return fmt.Errorf("pool %s: %v", p.Name, err)
+		}
+	}
+
+	if c.RoutingMode != RoutingReplicate && c.RoutingMode != RoutingShard {
+		return fmt.Errorf("unknown routing mode %s, expected %s or %s", c.RoutingMode, RoutingReplicate, RoutingShard)
+	}
+
+	if c.ReplicationFactor < 1 {
+		return fmt.Errorf("replication factor must be at least 1, got %d", c.ReplicationFactor)
+	}
+
+	switch c.WriteConsistency {
+	case WriteConsistencyAny, WriteConsistencyQuorum, WriteConsistencyAll:
+	default:
+		return fmt.Errorf("unknown write consistency %s, expected any, quorum or all", c.WriteConsistency)
+	}
+
+	for _, source := range c.TenantSources {
+		switch source {
+		case TenantSourcePath, TenantSourceHeader, TenantSourceUser, TenantSourceLabel:
+		default:
+			return fmt.Errorf("unknown tenant source %s, expected path, header, user or label", source)
+		}
+	}
+
+	if !strings.Contains(c.TenantURI, "{tenant}") {
+		return fmt.Errorf("tenant uri %s must contain {tenant}", c.TenantURI)
+	}
+
+	if c.TenantDefault != "" && !ValidTenant(c.TenantDefault) {
+		return fmt.Errorf("invalid default tenant %s, expected accountID or accountID:projectID", c.TenantDefault)
+	}
+
+	if c.HTTPTimeOut <= 0 {
+		return fmt.Errorf("upstream timeout must be positive, got %d", c.HTTPTimeOut)
+	}
+	if c.SlowForwardMilliseconds <= 0 {
+		return fmt.Errorf("slow forward warning must be positive, got %d", c.SlowForwardMilliseconds)
+	}
+	if c.ServerReadTimeoutSeconds <= 0 {
+		return fmt.Errorf("server read timeout must be positive, got %d", c.ServerReadTimeoutSeconds)
+	}
+	if c.ServerWriteTimeoutSeconds <= 0 {
+		return fmt.Errorf("server write timeout must be positive, got %d", c.ServerWriteTimeoutSeconds)
+	}
+	if c.GracefulShutdownSeconds <= 0 {
+		return fmt.Errorf("graceful shutdown timeout must be positive, got %d", c.GracefulShutdownSeconds)
+	}
+
+	if c.QueueMaxAgeSeconds <= 0 {
+		return fmt.Errorf("queue maximum age must be positive, got %d", c.QueueMaxAgeSeconds)
+	}
+
+	for name := range c.ExternalLabels {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("invalid external label name %q", name)
+		}
+	}
+	for _, name := range append([]string{c.ClientLabel, c.SourceIPLabel}, c.RequiredLabels...) {
+		if name != "" && !labelNameRE.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+
+	switch c.LimitsBy {
+	case "", LimitByTenant, LimitByClient, LimitBySourceIP:
+	default:
+		return fmt.Errorf("unknown limits by %s, expected tenant, client or source_ip", c.LimitsBy)
+	}
+	if c.LimitsAction != LimitActionReject && c.LimitsAction != LimitActionDrop {
+		return fmt.Errorf("unknown limits action %s, expected %s or %s", c.LimitsAction, LimitActionReject, LimitActionDrop)
+	}
+	if c.ActiveSeriesWindowSeconds <= 0 || c.RateBurstSeconds <= 0 {
+		return fmt.Errorf("limits active series window and rate burst must be positive")
+	}
+	if c.MaxActiveSeries < 0 || c.MaxSamplesPerSecond < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	for key, l := range c.LimitOverrides {
+		if l.MaxActiveSeries < 0 || l.MaxSamplesPerSecond < 0 {
+			return fmt.Errorf("limits of %s must not be negative", key)
+		}
+	}
+
+	if err := validateRelabelConfigs(c.RelabelConfigs); err != nil {
+		return err
+	}
+	if err := validateRelabelConfigs(c.WriteRelabelConfigs); err != nil {
+		return err
+	}
+	for _, p := range c.Pools {
+		if err := validateRelabelConfigs(p.WriteRelabelConfigs); err != nil {
+			return fmt.Errorf("pool %s: %v", p.Name, err)
+		}
+	}
+
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if len(r.Pools) == 0 {
+			return fmt.Errorf("routing rule %d has no pools", i)
+		}
+		for _, p := range r.Pools {
+			if !pools[p] {
+				return fmt.Errorf("routing rule %d sends to unknown pool %s", i, p)
+			}
+		}
+		r.matchRE = make(map[string]*regexp.Regexp)
+		for name, expr := range r.MatchRE {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return fmt.Errorf("routing rule %d: invalid regular expression for %s: %v", i, name, err)
+			}
+			r.matchRE[name] = re
+		}
+	}
+
+	for i, client := range c.Clients {
+		if client.Name == "" {
+			return fmt.Errorf("auth client %d has no name", i)
+		}
+		if client.BearerToken == "" && client.Username == "" {
+			return fmt.Errorf("auth client %s needs a username or a bearer token", client.Name)
+		}
+		for name := range client.Labels {
+			if !labelNameRE.MatchString(name) {
+				return fmt.Errorf("auth client %s has an invalid label name %q", client.Name, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+//Validate checks the discovery settings
+func (d *DiscoveryConfig) Validate() error {
+
+	if d.AWSPollingIntervalSeconds <= 0 {
+		return fmt.Errorf("discovery polling interval must be positive, got %d", d.AWSPollingIntervalSeconds)
+	}
+
+	switch d.AWSAddressType {
+	case AddressPrivate, AddressPublic, AddressIPv6:
+	default:
+		return fmt.Errorf("unknown ec2 address type %s, expected private, public or ipv6", d.AWSAddressType)
+	}
+
+	for i, f := range d.AWSTagFilters {
+		if f.Key == "" || len(f.Values) == 0 {
+			return fmt.Errorf("ec2 tag filter %d needs a key and values", i)
+		}
+	}
+
+	for _, pattern := range d.FileSDFiles {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file discovery pattern %s: %v", pattern, err)
+		}
+	}
+
+	if len(d.DNSNames) > 0 {
+		switch d.DNSType {
+		case DNSTypeSRV:
+		case DNSTypeA, DNSTypeAAAA:
+			if d.DNSPort <= 0 {
+				return fmt.Errorf("dns discovery of %s records needs a port", d.DNSType)
+			}
+		default:
+			return fmt.Errorf("unknown dns record type %s, expected SRV, A or AAAA", d.DNSType)
+		}
+	}
+
+	for i, u := range d.StaticUpstreams {
+		if u.Host == "" || u.Port <= 0 {
+			return fmt.Errorf("static upstream %d needs a host and a port", i)
+		}
+		if u.URI == "" {
+			d.StaticUpstreams[i].URI = "/api/v1/write"
+		}
+		if u.Weight != nil && *u.Weight < 0 {
+			return fmt.Errorf("static upstream %d has a negative weight", i)
+		}
+		if err := validateRelabelConfigs(u.WriteRelabelConfigs); err != nil {
+			return fmt.Errorf("static upstream %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func validateRelabelConfigs(configs []RelabelConfig) error {
+	for i := range configs {
+		if err := configs[i].Validate(); err != nil {
+			return fmt.Errorf("relabel config %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+//ValidTenant whether tenant is a VictoriaMetrics cluster tenant, accountID or accountID:projectID
+func ValidTenant(tenant string) bool {
+	parts := strings.Split(tenant, ":")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+//PoolConfig the configuration with the discovery and write relabeling of the named pool in place of the top level ones
+func (c *VConfig) PoolConfig(name string) (VConfig, bool) {
+	if name == DefaultPool {
+		return *c, true
+	}
+	for _, p := range c.Pools {
+		if p.Name == name {
+			pool := *c
+			pool.DiscoveryConfig = p.DiscoveryConfig
+			pool.WriteRelabelConfigs = p.WriteRelabelConfigs
+			return pool, true
+		}
+	}
+	return VConfig{}, false
+}
+
+//Regions the EC2 regions to search
+func (c *EC2Config) Regions() []string {
+	if len(c.AWSRegions) > 0 {
+		return c.AWSRegions
+	}
+	return []string{c.AWSRegion}
+}
+
+//ConfigStore holds the configuration in use so it can be swapped atomically on reload
+type ConfigStore struct {
+	value atomic.Value
+}
+
+//NewConfigStore creates a store holding a copy of config
+func NewConfigStore(config *VConfig) *ConfigStore {
+	s := &ConfigStore{}
+	s.Store(config)
+	return s
+}
+
+//Load returns the configuration in use, it must not be modified
+func (s *ConfigStore) Load() *VConfig {
+	return s.value.Load().(*VConfig)
+}
+
+//Store swaps in a copy of config
+func (s *ConfigStore) Store(config *VConfig) {
+	c := *config
+	s.value.Store(&c)
+}
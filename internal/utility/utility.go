@@ -3,27 +3,22 @@ package utility
 
 import (
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/rs/zerolog/log"
 )
 
-//VConfig configuration struct used for various parts of the application
-type VConfig struct {
-	AWSRegion                 string //AWSRegion region for aws
-	AWSSearchTag              string //AWSSearchTag tag to filter on
-	AWSSearchTagValue         string //AWSSearchTagValue the search tag value to filter on
-	AWSPortTag                string //AWSPortTag Tag that specifies the destination port
-	AWSURITag                 string //AWSURITag Tag that specifies the destination URI
-	AWSPollingIntervalSeconds int    //AWSPollingTick How often to poll AWS for new nodes
-	ServicePollingSeconds     int    //ServicePollingSeconds How oftent to poll services for availability
-	HTTPTimeOut               int    //Client timeout for http requests
-}
-
 //VInstances EC2 instance list
 type VInstances struct {
 	Instances []VInstance
@@ -31,93 +26,327 @@ type VInstances struct {
 
 //VInstance An actual instance
 type VInstance struct {
-	AWSHost       string
-	AWSURI        string
-	AWSPort       int
-	AWSInstanceID string
-	AWSName       string
+	AWSHost             string
+	AWSURI              string
+	AWSPort             int
+	AWSInstanceID       string
+	AWSName             string
+	AWSRegion           string  // AWSRegion region the instance runs in
+	AWSAvailabilityZone string  // AWSAvailabilityZone availability zone the instance runs in
+	AWSDraining         bool    // AWSDraining the instance is being terminated or in maintenance and should not receive new writes
+	AWSWeight           float64 // AWSWeight relative share of the series the instance should receive, 0 drains it
 }
 
 const configservice = "configservice"
 
-//GetAWSInstancesByTag get all AWS hosts by tag including their port and URI
+//AWSClients EC2 and auto scaling clients for one region of one account
+type AWSClients struct {
+	Region      string
+	Role        string // Role assumed role, empty for the default credentials
+	EC2         ec2iface.EC2API
+	AutoScaling autoscalingiface.AutoScalingAPI
+}
+
+func (c AWSClients) String() string {
+	if c.Role == "" {
+		return c.Region
+	}
+	return fmt.Sprintf("%s as %s", c.Region, c.Role)
+}
+
+//NewAWSClients creates the clients for every region and account to search, tests replace it with fakes
+var NewAWSClients = newAWSClients
+
+//GetAWSInstancesByTag get all AWS hosts matching every tag filter including their port and URI
+//
+// Every configured region is searched, in every assumed role account when role ARNs are
+// set, and all pages of the results are read.
 func GetAWSInstancesByTag(config *VConfig) ([]VInstance, error) {
 
-	log.Debug().Str("service", configservice).Msgf("AWS Parameters - region: [%s] search: [%s] tag: [%s] uri: [%s] port: [%s]",
-		config.AWSRegion, config.AWSSearchTag, config.AWSSearchTagValue, config.AWSURITag, config.AWSPortTag)
+	log.Debug().Str("service", configservice).Msgf("AWS Parameters - regions: %v search: [%s] tag: [%s] filters: %v uri: [%s] port: [%s]",
+		config.Regions(), config.AWSSearchTag, config.AWSSearchTagValue, config.AWSTagFilters, config.AWSURITag, config.AWSPortTag)
 
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-		Region: aws.String(config.AWSRegion),
-		},
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-
-	tagName := fmt.Sprintf("tag:%s", config.AWSSearchTag)
-	tagValues := config.AWSSearchTagValue
-
-	params := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name: aws.String(tagName),
-				Values: []*string{
-					aws.String(tagValues),
-				},
-			},
+	// Filters are ANDed by EC2, the values of one filter are ORed
+	filters := []*ec2.Filter{
+		{
+			Name:   aws.String("instance-state-name"),
+			Values: []*string{aws.String(ec2.InstanceStateNameRunning)},
 		},
 	}
+	if config.AWSSearchTag != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", config.AWSSearchTag)),
+			Values: []*string{aws.String(config.AWSSearchTagValue)},
+		})
+	}
+	for _, f := range config.AWSTagFilters {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", f.Key)),
+			Values: aws.StringSlice(f.Values),
+		})
+	}
+
+	var instances []VInstance
 
-	svc := ec2.New(sess)
-	res, err := svc.DescribeInstances(params)
+	scopes, err := NewAWSClients(config)
 	if err != nil {
-		log.Error().Err(err).Str("service", configservice).Msgf("Error getting list of aws instances by tag %s : %s", config.AWSSearchTag, config.AWSSearchTagValue)
 		return nil, err
 	}
 
-	var instances []VInstance
+	// A region or account that cannot be searched is skipped so the others keep their upstreams
+	var failed int
+	for _, scope := range scopes {
+		params := &ec2.DescribeInstancesInput{Filters: filters}
+
+		var found []VInstance
+		err = scope.EC2.DescribeInstancesPages(params, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+			for _, r := range page.Reservations {
+				for _, j := range r.Instances {
+					if j.State == nil || aws.StringValue(j.State.Name) != ec2.InstanceStateNameRunning {
+						continue
+					}
+					instance, ok := instanceFromTags(config, scope.Region, j)
+					if !ok {
+						continue
+					}
+					found = append(found, instance)
+
+					log.Debug().Str("service", configservice).Msgf("Found instance %s in %s with IP %s using port %d with uri %s",
+						instance.AWSInstanceID, instance.AWSAvailabilityZone, instance.AWSHost, instance.AWSPort, instance.AWSURI)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			log.Error().Err(err).Str("service", configservice).Msgf("Error getting list of aws instances by tag %s : %s in %s, skipping it", config.AWSSearchTag, config.AWSSearchTagValue, scope)
+			failed++
+			continue
+		}
+		instances = append(instances, found...)
+	}
+	if len(scopes) > 0 && failed == len(scopes) {
+		return nil, fmt.Errorf("no region could be searched: %v", err)
+	}
 
-	if len(res.Reservations) == 0 {
+	if len(instances) == 0 {
 		log.Debug().Str("service", configservice).Msgf("No EC2 instances found, no upstreams will be configured.  Please check your settings")
+	}
+
+	return instances, nil
+}
+
+//GetAWSInstancesByASG get the instances of an auto scaling group that are in service and healthy including their port and URI
+//
+// Instances waiting in a Terminating:Wait lifecycle hook are returned as draining so writes
+// queued for them can still be delivered while no new writes are sent.  A group of the same
+// name is looked up in every configured region and assumed role account.
+func GetAWSInstancesByASG(config *VConfig) ([]VInstance, error) {
+
+	log.Debug().Str("service", configservice).Msgf("AWS Parameters - regions: %v asg: [%s] uri: [%s] port: [%s]",
+		config.Regions(), config.AWSAutoScalingGroup, config.AWSURITag, config.AWSPortTag)
+
+	var instances []VInstance
+
+	scopes, err := NewAWSClients(config)
+	if err != nil {
 		return nil, err
 	}
 
-	for _, r := range res.Reservations {
-		for _, j := range r.Instances {
-			port := 8428
-			uri := "/api/v1/write"
-			name := "unknown"
-			for _, t := range j.Tags {
-				if *t.Key == config.AWSPortTag {
-					port, err = strconv.Atoi(*t.Value)
-					if err != nil {
-						log.Error().Err(err).Str("service", configservice).Msg("Error converting port to string")
-					}
-				}
+	// A region or account that cannot be searched is skipped so the others keep their upstreams
+	var failed int
+	for _, scope := range scopes {
+		var found []VInstance
+		found, err = instancesByASG(config, scope)
+		if err != nil {
+			log.Error().Err(err).Str("service", configservice).Msgf("Error getting instances of auto scaling group %s in %s, skipping it", config.AWSAutoScalingGroup, scope)
+			failed++
+			continue
+		}
+		instances = append(instances, found...)
+	}
+	if len(scopes) > 0 && failed == len(scopes) {
+		return nil, fmt.Errorf("no region could be searched: %v", err)
+	}
+
+	return instances, nil
+}
+
+// instancesByASG the in service and draining instances of the auto scaling group in one scope
+func instancesByASG(config *VConfig, scope AWSClients) ([]VInstance, error) {
 
-				if *t.Key == config.AWSURITag {
-					uri = *t.Value
+	// Lifecycle state of every instance we want, keyed by instance id
+	draining := make(map[string]bool)
+	var ids []*string
+
+	params := &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(config.AWSAutoScalingGroup)},
+	}
+
+	err := scope.AutoScaling.DescribeAutoScalingGroupsPages(params, func(page *autoscaling.DescribeAutoScalingGroupsOutput, last bool) bool {
+		for _, g := range page.AutoScalingGroups {
+			for _, i := range g.Instances {
+				state := aws.StringValue(i.LifecycleState)
+				switch {
+				case state == autoscaling.LifecycleStateInService && aws.StringValue(i.HealthStatus) == "Healthy":
+					draining[aws.StringValue(i.InstanceId)] = false
+				case state == autoscaling.LifecycleStateTerminatingWait:
+					draining[aws.StringValue(i.InstanceId)] = true
+				default:
+					log.Debug().Str("service", configservice).Msgf("Skipping instance %s in state %s health %s",
+						aws.StringValue(i.InstanceId), state, aws.StringValue(i.HealthStatus))
+					continue
 				}
+				ids = append(ids, i.InstanceId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		log.Debug().Str("service", configservice).Msgf("No instances in service in %s in %s", config.AWSAutoScalingGroup, scope)
+		return nil, nil
+	}
 
-				if strings.ToLower(*t.Key) == "name" {
-					name = *t.Value
+	// The group only knows instance ids, the addresses and tags come from EC2
+	var instances []VInstance
+	err = scope.EC2.DescribeInstancesPages(&ec2.DescribeInstancesInput{InstanceIds: ids}, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, r := range page.Reservations {
+			for _, j := range r.Instances {
+				instance, ok := instanceFromTags(config, scope.Region, j)
+				if !ok {
+					continue
 				}
+				instance.AWSDraining = instance.AWSDraining || draining[instance.AWSInstanceID]
+				instances = append(instances, instance)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// instanceFromTags reads the address and placement of an instance and the port and URI from its tags,
+// instances without an address of the configured type are skipped
+func instanceFromTags(config *VConfig, region string, j *ec2.Instance) (VInstance, bool) {
+	var instance VInstance
+	instance.AWSInstanceID = aws.StringValue(j.InstanceId)
+	instance.AWSRegion = region
+	instance.AWSPort = 8428
+	instance.AWSURI = "/api/v1/write"
+	instance.AWSName = "unknown"
+	instance.AWSWeight = 1
+
+	if j.Placement != nil {
+		instance.AWSAvailabilityZone = aws.StringValue(j.Placement.AvailabilityZone)
+	}
+
+	switch config.AWSAddressType {
+	case AddressPublic:
+		instance.AWSHost = aws.StringValue(j.PublicIpAddress)
+	case AddressIPv6:
+		for _, ni := range j.NetworkInterfaces {
+			if len(ni.Ipv6Addresses) > 0 {
+				instance.AWSHost = aws.StringValue(ni.Ipv6Addresses[0].Ipv6Address)
+				break
+			}
+		}
+	default:
+		instance.AWSHost = aws.StringValue(j.PrivateIpAddress)
+	}
+	if instance.AWSHost == "" {
+		log.Debug().Str("service", configservice).Msgf("Skipping instance %s without a %s address", instance.AWSInstanceID, config.AWSAddressType)
+		return instance, false
+	}
 
+	for _, t := range j.Tags {
+		if *t.Key == config.AWSPortTag {
+			port, err := strconv.Atoi(*t.Value)
+			if err != nil {
+				log.Error().Err(err).Str("service", configservice).Msg("Error converting port to string")
+				continue
 			}
-			if *j.State.Name == "running" {
-				var instance VInstance
-				instance.AWSHost = *j.PrivateIpAddress
-				instance.AWSInstanceID = *j.InstanceId
-				instance.AWSPort = port
-				instance.AWSURI = uri
-				instance.AWSName = name
+			instance.AWSPort = port
+		}
 
-				instances = append(instances, instance)
+		if *t.Key == config.AWSURITag {
+			instance.AWSURI = *t.Value
+		}
+
+		if *t.Key == config.AWSDrainTag {
+			drain, err := strconv.ParseBool(*t.Value)
+			if err != nil {
+				log.Error().Str("service", configservice).Msgf("Ignoring invalid drain tag %q of instance %s", *t.Value, instance.AWSInstanceID)
+				continue
+			}
+			instance.AWSDraining = drain
+		}
 
-				log.Debug().Str("service", configservice).Msgf("Found instance %s with IP %s using port %d with uri %s",
-					*j.InstanceId, *j.PrivateIpAddress, port, uri)
+		if *t.Key == config.AWSWeightTag {
+			weight, err := strconv.ParseFloat(*t.Value, 64)
+			if err != nil || weight < 0 {
+				log.Error().Str("service", configservice).Msgf("Ignoring invalid weight %q of instance %s", *t.Value, instance.AWSInstanceID)
+				continue
 			}
-			//fmt.Println(*i.InstanceId, *i.State.Name, *i.PrivateIpAddress, port, uri)
+			instance.AWSWeight = weight
+		}
+
+		if strings.ToLower(*t.Key) == "name" {
+			instance.AWSName = *t.Value
 		}
 	}
-	return instances, nil
+
+	return instance, true
+}
+
+// newAWSClients a session for every configured region, in every assumed role account when role ARNs are set
+//
+// The endpoint override only applies to EC2 and auto scaling, roles are still assumed through AWS STS.
+func newAWSClients(config *VConfig) ([]AWSClients, error) {
+	var clients []AWSClients
+
+	override := &aws.Config{}
+	if config.AWSEndpoint != "" {
+		override.Endpoint = aws.String(config.AWSEndpoint)
+	}
+
+	for _, region := range config.Regions() {
+		sess, err := session.NewSessionWithOptions(session.Options{
+			Config:            aws.Config{Region: aws.String(region)},
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(config.AWSRoleARNs) == 0 {
+			clients = append(clients, AWSClients{Region: region, EC2: ec2.New(sess, override), AutoScaling: autoscaling.New(sess, override)})
+			continue
+		}
+
+		for _, role := range config.AWSRoleARNs {
+			assumed := sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(sess, role)})
+			clients = append(clients, AWSClients{Region: region, Role: role, EC2: ec2.New(assumed, override), AutoScaling: autoscaling.New(assumed, override)})
+		}
+	}
+
+	return clients, nil
+}
+
+//GetAvailabilityZone availability zone of the instance vmwriter runs on from the instance metadata service
+func GetAvailabilityZone() (string, error) {
+	sess, err := session.NewSession(&aws.Config{
+		HTTPClient: &http.Client{Timeout: 2 * time.Second},
+		MaxRetries: aws.Int(1),
+	})
+	if err != nil {
+		return "", err
+	}
+	return ec2metadata.New(sess).GetMetadata("placement/availability-zone")
 }
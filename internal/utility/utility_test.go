@@ -0,0 +1,263 @@
+package utility_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.dev.pages/infrastructure/vmwriter/internal/awsfake"
+	vmupstreams "github.dev.pages/infrastructure/vmwriter/internal/upstreams"
+	utility "github.dev.pages/infrastructure/vmwriter/internal/utility"
+)
+
+// useFakeAWS serves the AWS calls from the fakes for the duration of the test
+func useFakeAWS(t *testing.T, e *awsfake.EC2, a *awsfake.AutoScaling) {
+	old := utility.NewAWSClients
+	utility.NewAWSClients = awsfake.Clients(e, a)
+	t.Cleanup(func() { utility.NewAWSClients = old })
+}
+
+func clusterTags(extra map[string]string) map[string]string {
+	tags := map[string]string{"Cluster": "victoriametrix", "Name": "vm"}
+	for k, v := range extra {
+		tags[k] = v
+	}
+	return tags
+}
+
+func TestGetAWSInstancesByTag(t *testing.T) {
+	fake := awsfake.NewEC2(2,
+		awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(map[string]string{"ClusterVMPort": "8480", "ClusterVMURI": "/insert/0/prometheus/api/v1/write", "ClusterVMWeight": "2"})),
+		awsfake.Instance("i-2", "10.0.0.2", ec2.InstanceStateNameRunning, "us-west-2b", clusterTags(map[string]string{"ClusterVMPort": "not-a-port", "ClusterVMWeight": "-2"})),
+		awsfake.Instance("i-3", "", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(nil)),
+		awsfake.Instance("i-4", "10.0.0.4", ec2.InstanceStateNameStopped, "us-west-2a", clusterTags(nil)),
+		awsfake.Instance("i-5", "10.0.0.5", ec2.InstanceStateNameRunning, "us-west-2c", map[string]string{"Cluster": "other"}),
+		awsfake.Instance("i-6", "10.0.0.6", ec2.InstanceStateNameRunning, "us-west-2c", clusterTags(map[string]string{"ClusterVMDrain": "true"})),
+	)
+	useFakeAWS(t, fake, nil)
+
+	config := utility.DefaultConfig()
+	instances, err := utility.GetAWSInstancesByTag(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// i-3 has no address, i-4 is stopped and i-5 is in another cluster
+	got := make(map[string]utility.VInstance)
+	for _, i := range instances {
+		got[i.AWSInstanceID] = i
+	}
+	if len(got) != 3 || got["i-1"].AWSHost == "" || got["i-2"].AWSHost == "" || got["i-6"].AWSHost == "" {
+		t.Fatalf("expected i-1, i-2 and i-6, got %+v", instances)
+	}
+	if fake.Calls() != 2 {
+		t.Errorf("expected the 3 matching instances to be read in 2 pages, got %d calls", fake.Calls())
+	}
+
+	if i := got["i-1"]; i.AWSPort != 8480 || i.AWSURI != "/insert/0/prometheus/api/v1/write" || i.AWSName != "vm" ||
+		i.AWSRegion != "us-west-2" || i.AWSAvailabilityZone != "us-west-2a" || i.AWSWeight != 2 {
+		t.Errorf("unexpected instance %+v", i)
+	}
+	if got["i-1"].AWSDraining || !got["i-6"].AWSDraining {
+		t.Errorf("expected only i-6 to be drained by its tag")
+	}
+	if i := got["i-2"]; i.AWSPort != 8428 || i.AWSWeight != 1 {
+		t.Errorf("expected the defaults for bad port and weight tags, got %+v", i)
+	}
+}
+
+func TestGetAWSInstancesByTagFilters(t *testing.T) {
+	fake := awsfake.NewEC2(0,
+		awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(map[string]string{"Environment": "prod", "Team": "metrics"})),
+		awsfake.Instance("i-2", "10.0.0.2", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(map[string]string{"Environment": "dev", "Team": "metrics"})),
+		awsfake.Instance("i-3", "10.0.0.3", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(map[string]string{"Environment": "prod"})),
+	)
+	useFakeAWS(t, fake, nil)
+
+	config := utility.DefaultConfig()
+	config.AWSTagFilters = []utility.TagFilter{
+		{Key: "Environment", Values: []string{"prod", "staging"}},
+		{Key: "Team", Values: []string{"metrics"}},
+	}
+	instances, err := utility.GetAWSInstancesByTag(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].AWSInstanceID != "i-1" {
+		t.Fatalf("expected only i-1 to match every filter, got %+v", instances)
+	}
+}
+
+func TestGetAWSInstancesAddressTypes(t *testing.T) {
+	i := awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(nil))
+	i.PublicIpAddress = aws.String("54.0.0.1")
+	i.NetworkInterfaces = []*ec2.InstanceNetworkInterface{{Ipv6Addresses: []*ec2.InstanceIpv6Address{{Ipv6Address: aws.String("2600:1f14::1")}}}}
+	useFakeAWS(t, awsfake.NewEC2(0, i), nil)
+
+	for addressType, want := range map[string]string{
+		utility.AddressPrivate: "10.0.0.1",
+		utility.AddressPublic:  "54.0.0.1",
+		utility.AddressIPv6:    "2600:1f14::1",
+	} {
+		config := utility.DefaultConfig()
+		config.AWSAddressType = addressType
+		instances, err := utility.GetAWSInstancesByTag(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) != 1 || instances[0].AWSHost != want {
+			t.Fatalf("%s: expected %s, got %+v", addressType, want, instances)
+		}
+
+		// The upstream built from the instance must be reachable at that address
+		in := instances[0]
+		upstream := vmupstreams.VMUpstream{Host: in.AWSHost, Port: in.AWSPort, URI: in.AWSURI}
+		u, err := url.Parse(upstream.URL())
+		if err != nil || u.Host != net.JoinHostPort(want, "8428") {
+			t.Errorf("%s: expected a url for %s, got %s %v", addressType, want, upstream.URL(), err)
+			continue
+		}
+		if _, err := http.NewRequest(http.MethodPost, upstream.URL(), nil); err != nil {
+			t.Errorf("%s: %v", addressType, err)
+		}
+	}
+}
+
+func TestGetAWSInstancesByASG(t *testing.T) {
+	ec2Fake := awsfake.NewEC2(0,
+		awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(nil)),
+		awsfake.Instance("i-2", "10.0.0.2", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(nil)),
+		awsfake.Instance("i-3", "10.0.0.3", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(nil)),
+		awsfake.Instance("i-4", "10.0.0.4", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(nil)),
+	)
+	asgFake := awsfake.NewAutoScaling(awsfake.Group("vmstorage", map[string]string{
+		"i-1": autoscaling.LifecycleStateInService + "/Healthy",
+		"i-2": autoscaling.LifecycleStateInService + "/Unhealthy",
+		"i-3": autoscaling.LifecycleStatePending + "/Healthy",
+		"i-4": autoscaling.LifecycleStateTerminatingWait + "/Healthy",
+	}))
+	useFakeAWS(t, ec2Fake, asgFake)
+
+	config := utility.DefaultConfig()
+	config.AWSAutoScalingGroup = "vmstorage"
+	instances, err := utility.GetAWSInstancesByASG(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]utility.VInstance)
+	for _, i := range instances {
+		got[i.AWSInstanceID] = i
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected i-1 and i-4, got %+v", instances)
+	}
+	if got["i-1"].AWSDraining || !got["i-4"].AWSDraining {
+		t.Errorf("expected only the terminating instance to drain, got %+v", instances)
+	}
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	cases := map[string]func(c *utility.VConfig, v int){
+		"upstream_seconds":          func(c *utility.VConfig, v int) { c.HTTPTimeOut = v },
+		"slow_forward_warning_ms":   func(c *utility.VConfig, v int) { c.SlowForwardMilliseconds = v },
+		"server_read_seconds":       func(c *utility.VConfig, v int) { c.ServerReadTimeoutSeconds = v },
+		"server_write_seconds":      func(c *utility.VConfig, v int) { c.ServerWriteTimeoutSeconds = v },
+		"graceful_shutdown_seconds": func(c *utility.VConfig, v int) { c.GracefulShutdownSeconds = v },
+	}
+	for field, set := range cases {
+		t.Run(field, func(t *testing.T) {
+			for _, v := range []int{0, -1} {
+				config := utility.DefaultConfig()
+				set(&config, v)
+				if err := config.Validate(); err == nil {
+					t.Errorf("expected %s of %d to be rejected", field, v)
+				}
+			}
+			config := utility.DefaultConfig()
+			set(&config, 1)
+			if err := config.Validate(); err != nil {
+				t.Errorf("expected %s of 1 to be accepted, got %v", field, err)
+			}
+		})
+	}
+}
+
+func TestGetAWSInstancesSkipsFailingRegion(t *testing.T) {
+	healthy := awsfake.NewEC2(0, awsfake.Instance("i-1", "10.0.0.1", ec2.InstanceStateNameRunning, "us-west-2a", clusterTags(nil)))
+	healthyASG := awsfake.NewAutoScaling(awsfake.Group("vmstorage", map[string]string{"i-1": autoscaling.LifecycleStateInService + "/Healthy"}))
+	broken := awsfake.NewEC2(0)
+	broken.SetError(errors.New("AccessDenied"))
+	brokenASG := awsfake.NewAutoScaling()
+	brokenASG.SetError(errors.New("AccessDenied"))
+
+	old := utility.NewAWSClients
+	utility.NewAWSClients = func(config *utility.VConfig) ([]utility.AWSClients, error) {
+		return []utility.AWSClients{
+			{Region: "us-east-1", Role: "arn:aws:iam::111111111111:role/vmwriter", EC2: broken, AutoScaling: brokenASG},
+			{Region: "us-west-2", EC2: healthy, AutoScaling: healthyASG},
+		}, nil
+	}
+	t.Cleanup(func() { utility.NewAWSClients = old })
+
+	config := utility.DefaultConfig()
+	config.AWSAutoScalingGroup = "vmstorage"
+
+	byTag, err := utility.GetAWSInstancesByTag(&config)
+	if err != nil || len(byTag) != 1 {
+		t.Errorf("expected the instance of the healthy region by tag, got %+v %v", byTag, err)
+	}
+	byASG, err := utility.GetAWSInstancesByASG(&config)
+	if err != nil || len(byASG) != 1 {
+		t.Errorf("expected the instance of the healthy region by group, got %+v %v", byASG, err)
+	}
+
+	// Discovery only fails when no region can be searched
+	healthy.SetError(errors.New("RequestLimitExceeded"))
+	healthyASG.SetError(errors.New("RequestLimitExceeded"))
+	if _, err := utility.GetAWSInstancesByTag(&config); err == nil {
+		t.Error("expected an error by tag when every region fails")
+	}
+	if _, err := utility.GetAWSInstancesByASG(&config); err == nil {
+		t.Error("expected an error by group when every region fails")
+	}
+}
+
+func TestAWSEndpointOverridesEC2AndAutoScaling(t *testing.T) {
+	config := utility.DefaultConfig()
+	config.AWSEndpoint = "http://localhost:4566"
+	config.AWSRoleARNs = []string{"arn:aws:iam::111111111111:role/vmwriter"}
+
+	clients, err := utility.NewAWSClients(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) == 0 {
+		t.Fatal("expected clients for the configured regions")
+	}
+	for _, c := range clients {
+		if got := c.EC2.(*ec2.EC2).Endpoint; got != config.AWSEndpoint {
+			t.Errorf("expected EC2 in %s to use the endpoint, got %s", c, got)
+		}
+		if got := c.AutoScaling.(*autoscaling.AutoScaling).Endpoint; got != config.AWSEndpoint {
+			t.Errorf("expected auto scaling in %s to use the endpoint, got %s", c, got)
+		}
+	}
+
+	// Without an override the regional AWS endpoints are used
+	config.AWSEndpoint = ""
+	clients, err = utility.NewAWSClients(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := clients[0].EC2.(*ec2.EC2).Endpoint; !strings.Contains(got, "amazonaws.com") {
+		t.Errorf("expected the AWS endpoint, got %s", got)
+	}
+}